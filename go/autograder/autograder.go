@@ -1,6 +1,6 @@
 // Package autograder provides the logic to parse the Jupyter notebook submissions,
 // extract the assignment ID, match the assignment to the autograder scripts,
-// set up the scratch directory and run the autograder tests under nsjail.
+// set up the scratch directory and run the autograder tests in a sandbox.
 package autograder
 
 import (
@@ -16,6 +16,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
@@ -35,7 +36,10 @@ type Autograder struct {
 	ScratchDir string
 	// NSJailPath is the path to nsjail, /usr/local/bin/nsjail by default.
 	NSJailPath string
-	// PythonPath is the path to python binary, /usr/bin/python by default.
+	// Sandbox runs the tests. If nil, the tests run under nsjail at NSJailPath.
+	Sandbox Sandbox
+	// PythonPath is the path to python binary, /usr/bin/python3 by default.
+	// The test harness requires Python 3.
 	PythonPath string
 	// DisableCleanup instructs the autograder not to delete the scratch directory.
 	DisableCleanup bool
@@ -45,6 +49,16 @@ type Autograder struct {
 	// IncludeLogs instructs the autograder to include the low-lever logs
 	// from nsjail invocation into test report. This is useful for debugging.
 	IncludeLogs bool
+	// Parallelism is the maximum number of tests run at the same time.
+	// If greater than one, the exercises and the test files of a submission
+	// are graded concurrently, each test file in its own copy of the scratch
+	// directory. Zero or one means sequential grading.
+	Parallelism int
+
+	// slots limits the number of tests running at the same time
+	// to Parallelism.
+	slots     chan struct{}
+	slotsOnce sync.Once
 }
 
 // New creates a new autograder instance given the autograder directory.
@@ -53,7 +67,7 @@ func New(dir string) *Autograder {
 		Dir:        dir,
 		ScratchDir: "/tmp",
 		NSJailPath: "/usr/local/bin/nsjail",
-		PythonPath: "/usr/bin/python",
+		PythonPath: "/usr/bin/python3",
 	}
 }
 
@@ -63,46 +77,92 @@ type InlineTestFill struct {
 	Inline     string
 }
 
-// The output format uses double braces to facilitate parsing
-// of the output by regexps.
-var inlineTestTmpl = template.Must(template.New("inlinetest").Parse(`import sys
-{{if .Context}}
-try:
-  {{.Context}}
-except Exception as e:
-  print("\nWhile executing context: ERROR{{"{{"}}%s{{"}}"}}" % e)
-  raise e
-{{end}}
-try:
-  {{.Submission}}
-except Exception as e:
-  print("\nWhile executing submission: FAIL{{"{{"}}%s: %s{{"}}"}}" % (e.__class__, e))
-  sys.exit(1)
-try:
-  {{.Inline}}
-  print("OK{{"{{}}"}}")
-except AssertionError as e:
-  print("\nWhile executing inline test: FAIL{{"{{"}}%s{{"}}"}}" % str(e))
-  sys.exit(1)
-except Exception as e:
-  print("\nWhile executing inline test: ERROR{{"{{"}}%s{{"}}"}}" % e)
-  raise e
+// The test runs the context, the submission and the inline test in a namespace
+// of their own, and reports its result to resultsFD (see TestResult). It also
+// prints the result in double braces for the logs. The parts are filled in as
+// Python string literals.
+var inlineTestTmpl = template.Must(template.New("inlinetest").Parse(harnessMarker + `
+def _main():
+  import json
+  import os
+  import sys
+  import time
+  import traceback
+
+  # Keep the results out of the way of the submission.
+  try:
+    fd = os.dup(3)
+    os.close(3)
+    results = os.fdopen(fd, 'w')
+  except OSError:
+    # The autograder parses the output if it did not pass the results file.
+    results = None
+  start = time.time()
+
+  def write(record):
+    if results is not None:
+      results.write(json.dumps(record) + '\n')
+      results.flush()
+
+  def report(status, message):
+    write({
+        'status': status,
+        'message': message,
+        'duration': time.time() - start,
+        'traceback': traceback.format_exc() if status != 'ok' else '',
+    })
+
+  write({'status': 'started'})
+
+  namespace = {'__name__': '__main__'}
+{{- if .Context}}
+  try:
+    exec(compile({{.Context}}, 'context.py', 'exec'), namespace)
+  except Exception as e:
+    print("\nWhile executing context: ERROR{{"{{"}}%s{{"}}"}}" % e)
+    report('error', str(e))
+    raise e
+{{- end}}
+  try:
+    exec(compile({{.Submission}}, 'submission.py', 'exec'), namespace)
+  except Exception as e:
+    print("\nWhile executing submission: FAIL{{"{{"}}%s: %s{{"}}"}}" % (e.__class__, e))
+    report('fail', '%s: %s' % (e.__class__, e))
+    sys.exit(1)
+  try:
+    exec(compile({{.Inline}}, 'inline.py', 'exec'), namespace)
+    print("OK{{"{{}}"}}")
+    report('ok', '')
+  except AssertionError as e:
+    print("\nWhile executing inline test: FAIL{{"{{"}}%s{{"}}"}}" % str(e))
+    report('fail', str(e))
+    sys.exit(1)
+  except Exception as e:
+    print("\nWhile executing inline test: ERROR{{"{{"}}%s{{"}}"}}" % e)
+    report('error', str(e))
+    raise e
+
+
+_main()
 `))
 
+// pythonString returns s as a Python string literal. JSON strings are valid
+// Python string literals, and marshaling a string never fails.
+func pythonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
 func generateInlineTest(context, submission, test string) ([]byte, error) {
 	var output bytes.Buffer
-	context = strings.ReplaceAll(context, "\n", "\n  ")
-	submission = strings.ReplaceAll(submission, "\n", "\n  ")
-	test = strings.ReplaceAll(test, "\n", "\n  ")
-	if strings.Trim(context, " \t\r\n") == "" {
-		context = ""
-	}
-	err := inlineTestTmpl.Execute(&output, &InlineTestFill{
-		// Indent the parts by two spaces to match the template.
-		Context:    context,
-		Submission: submission,
-		Inline:     test,
-	})
+	fill := &InlineTestFill{
+		Submission: pythonString(submission),
+		Inline:     pythonString(test),
+	}
+	if strings.Trim(context, " \t\r\n") != "" {
+		fill.Context = pythonString(context)
+	}
+	err := inlineTestTmpl.Execute(&output, fill)
 	if err != nil {
 		return nil, err
 	}
@@ -247,6 +307,16 @@ func (ag *Autograder) Grade(notebookBytes []byte) ([]byte, error) {
 				reflect.TypeOf(v))
 		}
 	}
+	// The exercise variants are chosen by the seed the student notebook was
+	// produced with, so that the tests check the values the student saw.
+	// Without the seed, the first variant is used. The seed must match the
+	// user hash set by the upload server, so that the students cannot pick
+	// a variant by editing the seed in the notebook metadata.
+	seed, _ := metadata[notebook.VariantSeedKey].(string)
+	if seed != "" && userHash != "unknown" && seed != userHash {
+		return nil, idErrorf(submissionID, "metadata.%s does not match the user, "+
+			"the notebook was produced for a different student", notebook.VariantSeedKey)
+	}
 	var requestedExerciseID string
 	if v, ok := metadata["requested_exercise_id"]; ok {
 		val, ok := v.(string)
@@ -290,8 +360,13 @@ func (ag *Autograder) Grade(notebookBytes []byte) ([]byte, error) {
 			_ = os.RemoveAll(baseScratchDir)
 		}()
 	}
-	result := make(map[string]interface{})
-	exerciseFound := false
+	type exercise struct {
+		id, dir, source string
+		outcome         map[string]interface{}
+	}
+	var exercises []*exercise
+	// index maps the exercise ID to its position in exercises.
+	index := make(map[string]int)
 	for _, cell := range n.Cells {
 		if cell.Metadata == nil {
 			continue
@@ -310,7 +385,6 @@ func (ag *Autograder) Grade(notebookBytes []byte) ([]byte, error) {
 			// Skip other exercises if requested a specific one.
 			continue
 		}
-		exerciseFound = true
 		exerciseDir := filepath.Join(dir, exerciseID)
 		fs, err = os.Stat(exerciseDir)
 		if err != nil {
@@ -321,16 +395,42 @@ func (ag *Autograder) Grade(notebookBytes []byte) ([]byte, error) {
 			return nil, idErrorf(submissionID, "%q is not a directory", exerciseDir)
 		}
 		glog.V(5).Infof("exercise_id: %s, source:\n%s\n--", exerciseID, cell.Source)
-		scratchDir := filepath.Join(baseScratchDir, exerciseID)
-		outcome, err := ag.GradeExercise(exerciseDir, scratchDir, cell.Source)
+		ex := &exercise{id: exerciseID, dir: exerciseDir, source: cell.Source}
+		if i, ok := index[exerciseID]; ok {
+			// The last cell with the same exercise ID takes precedence.
+			exercises[i] = ex
+			continue
+		}
+		index[exerciseID] = len(exercises)
+		exercises = append(exercises, ex)
+	}
+	err = ag.forEach(len(exercises), func(i int) error {
+		ex := exercises[i]
+		scratchDir := filepath.Join(baseScratchDir, ex.id)
+		outcome, err := ag.GradeExerciseVariant(ex.dir, scratchDir, ex.source, seed)
 		if err != nil {
-			return nil, idErrorf(submissionID, "error grading exercise %s: %s", exerciseID, err)
+			return idErrorf(submissionID, "error grading exercise %s: %s", ex.id, err)
+		}
+		ex.outcome = outcome
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{})
+	totalPoints := &Points{}
+	for _, ex := range exercises {
+		result[ex.id] = ex.outcome
+		if p, ok := ex.outcome["points"].(*Points); ok {
+			totalPoints.Earned += p.Earned
+			totalPoints.Possible += p.Possible
 		}
-		result[exerciseID] = outcome
 	}
-	if !exerciseFound {
+	if len(exercises) == 0 {
 		result["error"] = fmt.Sprintf("no exercises found. requested_exercise_id=%q", requestedExerciseID)
 	}
+	result["points"] = totalPoints
+	glog.V(3).Infof("submission %s earned %v of %v points", submissionID, totalPoints.Earned, totalPoints.Possible)
 	result["assignment_id"] = assignmentID
 	result["user_hash"] = userHash
 	result["submission_id"] = submissionID
@@ -351,37 +451,66 @@ func (ag *Autograder) Grade(notebookBytes []byte) ([]byte, error) {
 // Returns the outcome JSON object for the exercise, including the follwing fields:
 // * logs: a map from test name to the merged test output, useful for debugging.
 // * outcomes: a map from the test name to the test outcomes.
+// * points: the points earned for the exercise, see scorePoints.
 // * report: a raw HTML string containing all generated reports concatenated together.
 //   Note, the order of the report concatenation is not well defined, so one is
 //   expected to use only one template or only one inline test to get a predictable
 //   output.
+// * reporter_errors: the report templates that failed, see ReporterError.
 // Note: this function does not do any cleanup assuming that the caller will delete
 // the base scratch directory.
 func (ag *Autograder) GradeExercise(exerciseDir, scratchDir, submission string) (map[string]interface{}, error) {
+	return ag.GradeExerciseVariant(exerciseDir, scratchDir, submission, "")
+}
+
+// GradeExerciseVariant is GradeExercise for the variant of the exercise chosen
+// by the seed (see notebook.VariantValues). If the exercise has parameters,
+// the lines marked with # PARAMETER in the autograder scripts get the values
+// of the variant, and the values are returned in the parameters field.
+func (ag *Autograder) GradeExerciseVariant(exerciseDir, scratchDir, submission, seed string) (map[string]interface{}, error) {
 	glog.V(3).Infof("Grade exercise %s, submission of %d bytes", exerciseDir, len(submission))
 	glog.V(5).Infof("submission source:\n%s\n--", submission)
+	values, err := readVariant(exerciseDir, seed)
+	if err != nil {
+		return nil, err
+	}
 	// Check whether the submission is not trivial.
 	filename := filepath.Join(exerciseDir, "empty_submission.py")
 	if b, err := ioutil.ReadFile(filename); err == nil {
-		if string(b) == submission {
+		if notebook.ApplyParameters(string(b), values) == submission {
 			// The submission is not changed from the default state.
 			exerciseName := filepath.Base(exerciseDir)
+			weights, err := readPoints(exerciseDir)
+			if err != nil {
+				return nil, err
+			}
 			return map[string]interface{}{
 				"report": fmt.Sprintf("%s: empty submission", exerciseName),
+				"points": scorePoints(weights, nil, nil),
 			}, nil
 		}
 	}
 	glog.Infof("exercise scratch dir: %s", scratchDir)
-	err := ag.CreateScratchDir(exerciseDir, scratchDir, []byte(submission))
+	err = ag.CreateScratchDir(exerciseDir, scratchDir, []byte(submission))
 	if err != nil {
 		return nil, fmt.Errorf("error creating scratch dir %s: %s", scratchDir, err)
 	}
+	if values != nil {
+		err = applyVariant(scratchDir, values)
+		if err != nil {
+			return nil, err
+		}
+	}
+	limits, err := readLimits(exerciseDir)
+	if err != nil {
+		return nil, err
+	}
 	glog.V(3).Infof("Running tests in directory %s", scratchDir)
-	unitOutcomes, unitLogs, err := ag.RunUnitTests(scratchDir)
+	unitOutcomes, unitLogs, unitResults, err := ag.runUnitTests(scratchDir, unitTestLimits.withOverrides(limits))
 	if err != nil {
 		return nil, fmt.Errorf("error running unit tests in %q: %s", scratchDir, err)
 	}
-	inlineOutcomes, inlineLogs, inlineReports, err := ag.RunInlineTests(scratchDir)
+	inlineOutcomes, inlineLogs, inlineReports, inlineResults, err := ag.runInlineTests(scratchDir, inlineTestLimits.withOverrides(limits))
 	if err != nil {
 		return nil, fmt.Errorf("error running inline tests in %q: %s", scratchDir, err)
 	}
@@ -399,16 +528,39 @@ func (ag *Autograder) GradeExercise(exerciseDir, scratchDir, submission string)
 	for k, v := range inlineLogs {
 		mergedLogs[k] = v
 	}
+	weights, err := readPoints(exerciseDir)
+	if err != nil {
+		return nil, err
+	}
 	// The data object for the report generation.
 	outcomeData := map[string]interface{}{
 		"results": mergedOutcomes,
 		"logs":    mergedLogs,
 		"reports": inlineReports,
+		"points":  scorePoints(weights, unitOutcomes, inlineOutcomes),
+	}
+	// The structured results of individual tests, keyed by the unit test
+	// name or the inline test name.
+	tests := make(map[string][]*TestResult)
+	for k, v := range unitResults {
+		tests[k] = v
+	}
+	for k, v := range inlineResults {
+		tests[k] = v
+	}
+	if len(tests) > 0 {
+		outcomeData["tests"] = tests
 	}
-	report, err := ag.RenderReports(scratchDir, outcomeData)
+	if values != nil {
+		outcomeData["parameters"] = values
+	}
+	report, reporterErrors, err := ag.renderReports(scratchDir, outcomeData, reportLimits)
 	if err != nil {
 		return nil, err
 	}
+	if len(reporterErrors) > 0 {
+		outcomeData["reporter_errors"] = reporterErrors
+	}
 	if len(report) > 0 {
 		// If there was a template, take its output, ignoring
 		// autogenerated reports from inline tests.
@@ -421,102 +573,337 @@ func (ag *Autograder) GradeExercise(exerciseDir, scratchDir, submission string)
 	return outcomeData, nil
 }
 
-var outcomeRegex = regexp.MustCompile(`(test[a-zA-Z0-9_]*) \(([a-zA-Z0-9_-]+)\.([a-zA-Z0-9_]*)\) \.\.\. (ok|FAIL|ERROR)`)
+// readVariant reads the parameter declarations from the autograder directory
+// of an exercise and returns the values of the variant chosen by the seed,
+// or nil if the exercise has no parameters.
+func readVariant(exerciseDir, seed string) (map[string]interface{}, error) {
+	filename := filepath.Join(exerciseDir, notebook.ParametersFilename)
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %q: %s", filename, err)
+	}
+	parameters := make(map[string][]interface{})
+	err = json.Unmarshal(b, &parameters)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %q: %s", filename, err)
+	}
+	for name, values := range parameters {
+		if len(values) == 0 {
+			return nil, fmt.Errorf("parameter %s in %q has no values", name, filename)
+		}
+	}
+	return notebook.VariantValues(parameters, seed, filepath.Base(exerciseDir)), nil
+}
+
+// applyVariant sets the values of the variant in the python files of the
+// scratch directory, except for the submission files.
+func applyVariant(scratchDir string, values map[string]interface{}) error {
+	fss, err := ioutil.ReadDir(scratchDir)
+	if err != nil {
+		return fmt.Errorf("error on listing %q: %s", scratchDir, err)
+	}
+	for _, fs := range fss {
+		name := fs.Name()
+		if fs.IsDir() || !strings.HasSuffix(name, ".py") ||
+			name == "submission.py" || name == "submission_source.py" {
+			continue
+		}
+		filename := filepath.Join(scratchDir, name)
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("error reading %q: %s", filename, err)
+		}
+		source := notebook.ApplyParameters(string(b), values)
+		if source == string(b) {
+			continue
+		}
+		err = ioutil.WriteFile(filename, []byte(source), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing %q: %s", filename, err)
+		}
+	}
+	return nil
+}
+
+// Points is the score of an exercise or of the whole assignment.
+type Points struct {
+	Earned   float64 `json:"earned"`
+	Possible float64 `json:"possible"`
+}
+
+// readLimits reads the resource limits of the tests from the autograder
+// directory of an exercise. It returns nil if the exercise does not
+// define the limits.
+func readLimits(exerciseDir string) (map[string]float64, error) {
+	filename := filepath.Join(exerciseDir, notebook.LimitsFilename)
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %q: %s", filename, err)
+	}
+	limits := make(map[string]float64)
+	err = json.Unmarshal(b, &limits)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %q: %s", filename, err)
+	}
+	return limits, nil
+}
+
+// readPoints reads the points of the tests from the autograder directory
+// of an exercise. It returns nil if the directory has no points file.
+func readPoints(exerciseDir string) (map[string]float64, error) {
+	filename := filepath.Join(exerciseDir, notebook.PointsFilename)
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %q: %s", filename, err)
+	}
+	weights := make(map[string]float64)
+	err = json.Unmarshal(b, &weights)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %q: %s", filename, err)
+	}
+	return weights, nil
+}
+
+// scorePoints computes the points earned for the exercise from the outcomes
+// of the unit tests and inline tests. Each unit test method (named as
+// Class.method) and each inline test is worth the number of points given
+// in weights. The weights list all tests of the exercise (see
+// notebook.PointsFilename), so the tests that did not report an outcome,
+// e.g. because the test crashed, count as failed, the outcomes of unlisted
+// tests are ignored, and the possible points do not depend on the submission.
+// If weights is nil, e.g. for an autograder directory generated before the
+// points file existed, each test with an outcome is worth one point.
+func scorePoints(weights map[string]float64, unitOutcomes, inlineOutcomes map[string]interface{}) *Points {
+	ret := &Points{}
+	seen := make(map[string]bool)
+	add := func(name string, passed bool) {
+		weight, ok := weights[name]
+		if !ok {
+			if weights != nil {
+				return
+			}
+			weight = 1
+		}
+		seen[name] = true
+		ret.Possible += weight
+		if passed {
+			ret.Earned += weight
+		}
+	}
+	for testname, v := range unitOutcomes {
+		outcome, _ := v.(map[string]interface{})
+		for method, v := range outcome {
+			if method == "passed" || method == "error" {
+				continue
+			}
+			passed, _ := v.(bool)
+			add(testname+"."+method, passed)
+		}
+	}
+	for testname, v := range inlineOutcomes {
+		outcome, _ := v.(map[string]interface{})
+		passed, _ := outcome["passed"].(bool)
+		add(testname, passed)
+	}
+	for name, weight := range weights {
+		if !seen[name] {
+			ret.Possible += weight
+		}
+	}
+	return ret
+}
+
+// sandbox returns the sandbox to run the tests in.
+func (ag *Autograder) sandbox() Sandbox {
+	if ag.Sandbox != nil {
+		return ag.Sandbox
+	}
+	return &NSJail{Path: ag.NSJailPath}
+}
+
+// outcomeRegex matches the verbose unittest output, used if the harness has
+// not reported any results. Python 3.11 also prints the module name in the
+// parentheses, i.e. test_x (Module.Class.test_x).
+var outcomeRegex = regexp.MustCompile(`(test[a-zA-Z0-9_]*) \(([a-zA-Z0-9_.-]+)\) \.\.\. (ok|FAIL|ERROR)`)
 
 // RunUnitTests runs all tests in a scratch directory found by a glob *Test.py.
 // The name of the unit test is its base name without .py suffix.
 func (ag *Autograder) RunUnitTests(dir string) (map[string]interface{}, map[string]string, error) {
+	outcomes, logs, _, err := ag.runUnitTests(dir, unitTestLimits)
+	return outcomes, logs, err
+}
+
+// runUnitTests is RunUnitTests with the given resource limits. It also returns
+// the structured results reported by the harness for each test name.
+func (ag *Autograder) runUnitTests(dir string, limits Limits) (map[string]interface{}, map[string]string, map[string][]*TestResult, error) {
 	dir, err := filepath.Abs(dir)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error getting abs path for %q: %s", dir, err)
+		return nil, nil, nil, fmt.Errorf("error getting abs path for %q: %s", dir, err)
 	}
-	err = os.Chdir(dir)
+	fss, err := ioutil.ReadDir(dir)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error on chdir %q: %s", dir, err)
+		return nil, nil, nil, fmt.Errorf("error on listing %q: %s", dir, err)
 	}
-	fss, err := ioutil.ReadDir(dir)
+	var filenames []string
+	for _, fs := range fss {
+		if strings.HasSuffix(fs.Name(), "Test.py") {
+			filenames = append(filenames, fs.Name())
+		}
+	}
+	if len(filenames) > 0 {
+		err = writeUnittestHarness(dir)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	testOutcomes := make([]map[string]interface{}, len(filenames))
+	testLogs := make([]string, len(filenames))
+	testResults := make([][]*TestResult, len(filenames))
+	err = ag.forEachTest(dir, filenames, func(i int, dir string) error {
+		var err error
+		testOutcomes[i], testLogs[i], testResults[i], err = ag.runUnitTest(dir, filenames[i], limits)
+		return err
+	})
 	if err != nil {
-		return nil, nil, fmt.Errorf("error on listing %q: %s", dir, err)
+		return nil, nil, nil, err
 	}
 	// outcomes is a map from test name to the object with the following fields:
 	// * passed: boolean indicating whether the test run exited with 0 status (success).
 	// * test_case_name: boolean indicating whether a specific test case passed or not.
 	// Note, that if the there was an error during running the test, the outcome
-	// may not contain all of the test case names, because the test case names
-	// are extracted from the test runner logs.
+	// may not contain all of the test case names, e.g. if the test module
+	// failed to import.
 	outcomes := make(map[string]interface{})
 	// logs is a map from test name to the merged output.
 	logs := make(map[string]string)
-	for _, fs := range fss {
-		filename := fs.Name()
-		if !strings.HasSuffix(filename, "Test.py") {
-			continue
-		}
+	// results is a map from test name to the results reported by the harness.
+	results := make(map[string][]*TestResult)
+	for i, filename := range filenames {
 		// The test name is a file name with .py suffix stripped.
 		testname := filename[:len(filename)-len(".py")]
-		// nsjail -Mo --time_limit 2 --max_cpus 1 --rlimit_as 700 -E LANG=en_US.UTF-8 --disable_proc --chroot / --cwd $PWD --user nobody --group nogroup --iface_no_lo -- /usr/bin/python3 -m unittest discover -v -p '*Test.py'
-		testOutcome := make(map[string]interface{})
-		outcomes[testname] = testOutcome
-		cmd := exec.Command(ag.NSJailPath,
-			"-Mo",
-			// NSJail does not work under docker without these disable flags.
-			"--disable_clone_newcgroup",
-			"--disable_clone_newipc",
-			"--disable_clone_newnet",
-			"--disable_clone_newns",
-			"--disable_clone_newpid",
-			"--disable_clone_newuser",
-			"--disable_clone_newuts",
-			"--disable_no_new_privs",
-			"--time_limit", "30",
-			"--max_cpus", "1",
-			"--rlimit_as", "700",
-			"--env", "LANG=en_US.UTF-8",
-			"--disable_proc",
-			//"--chroot", "/",
-			"--cwd", dir,
-			"--user", "nobody",
-			"--group", "nogroup",
-			"--iface_no_lo",
-			"--",
-			ag.PythonPath, "-m", "unittest",
-			"-v", fs.Name())
-		glog.V(5).Infof("about to execute %s %q", cmd.Path, cmd.Args)
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			if _, ok := err.(*exec.ExitError); !ok {
-				return nil, nil, fmt.Errorf("error running unit test command %q %q: %s", cmd.Path, cmd.Args, err)
-			}
-			// Overall there was an error running the test, or a failed test case.
-			testOutcome["passed"] = false
-		} else {
-			// The test run with exit status 0 (success).
-			testOutcome["passed"] = true
+		outcomes[testname] = testOutcomes[i]
+		logs[filename] = testLogs[i]
+		if len(testResults[i]) > 0 {
+			results[testname] = testResults[i]
 		}
-		logs[filename] = string(out)
-		// TODO(salikh): Implement a more robust way of reporting individual
-		// test statuses from inside the test runner.
+	}
+	return outcomes, logs, results, nil
+}
+
+// runUnitTest runs one unit test file in the scratch directory with the
+// harness already written into it, and returns the outcome, the merged output
+// and the structured results of the test.
+func (ag *Autograder) runUnitTest(dir, filename string, limits Limits) (map[string]interface{}, string, []*TestResult, error) {
+	testname := filename[:len(filename)-len(".py")]
+	source, err := ioutil.ReadFile(filepath.Join(dir, filename))
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("error reading unit test %q: %s", filename, err)
+	}
+	expected := expectedTests(source)
+	testOutcome := make(map[string]interface{})
+	resultsFile, err := newResultsFile()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer resultsFile.Close()
+	out, err := ag.run(dir, limits, nil, []*os.File{resultsFile}, ag.PythonPath, unittestHarnessFilename, testname)
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, "", nil, fmt.Errorf("error running unit test %s in %q: %s", filename, dir, err)
+		}
+		// Overall there was an error running the test, or a failed test case.
+		testOutcome["passed"] = false
+	} else {
+		// The test run with exit status 0 (success).
+		testOutcome["passed"] = true
+	}
+	results, started, err := readResults(resultsFile)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if !started {
+		// Fall back to parsing the test runner output if the harness
+		// has not started, e.g. because the sandbox did not pass the
+		// results file. Once the harness has started, the output may
+		// come from the submission.
+		glog.Warningf("unit test %s in %q reported no results, parsing the output", filename, dir)
 		mm := outcomeRegex.FindAllSubmatch(out, -1)
 		if len(mm) == 0 {
-			// Cannot find any individual test case outcomes, mark overall test as
-			// not passed.
+			// The test did not run at all, e.g. it crashed or
+			// exited from the submission.
 			testOutcome["passed"] = false
-			testOutcome["error"] = "no test cases found"
-			continue
+			testOutcome["error"] = "no test results reported"
 		}
 		for _, m := range mm {
 			method := string(m[1])
-			//className := string(m[3])  // Not used, as it is the same as testname.
-			status := string(m[4])
-			if status == "ok" {
+			if !expected[method] {
+				continue
+			}
+			if string(m[3]) == "ok" {
 				testOutcome[method] = true
 			} else {
 				testOutcome[method] = false
 				testOutcome["passed"] = false
 			}
 		}
+		return testOutcome, string(out), nil, nil
+	}
+	if len(results) == 0 {
+		// The harness started, but the test run was interrupted,
+		// e.g. the submission exited.
+		testOutcome["passed"] = false
+		testOutcome["error"] = "no test results reported"
+	}
+	// The harness reports each test once, so the unexpected and repeated
+	// results do not come from the harness.
+	reported := make(map[string]bool)
+	for _, r := range results {
+		// The ID is Class.method, except for the errors outside
+		// of test methods, e.g. in module import or setUpClass.
+		method := r.ID[strings.LastIndex(r.ID, ".")+1:]
+		if !strings.HasPrefix(method, "test") {
+			testOutcome["passed"] = false
+			testOutcome["error"] = r.Message
+			continue
+		}
+		if !expected[method] {
+			glog.Warningf("unit test %s in %q reported unknown test %q", filename, dir, r.ID)
+			continue
+		}
+		if reported[method] {
+			testOutcome[method] = false
+			testOutcome["passed"] = false
+			testOutcome["error"] = fmt.Sprintf("test %s reported more than once", method)
+			continue
+		}
+		reported[method] = true
+		switch r.Status {
+		case "ok":
+			testOutcome[method] = true
+		case "skip":
+			// Skipped tests have no outcome.
+		default:
+			testOutcome[method] = false
+			testOutcome["passed"] = false
+		}
 	}
-	return outcomes, logs, nil
+	for method := range expected {
+		if !reported[method] {
+			// The test did not run, e.g. the test run was
+			// interrupted. Its points are not earned.
+			testOutcome["passed"] = false
+		}
+	}
+	return testOutcome, string(out), results, nil
 }
 
 var (
@@ -563,41 +950,33 @@ var inlineReportTmpl = htmltemplate.Must(htmltemplate.New("inlinereport").Parse(
 // Also returns the complete merged log of the test execution, as well
 // as an autogenerated report for this inline test.
 func (ag *Autograder) RunInlineTest(dir, filename, submissionFilename string) (map[string]interface{}, string, string, error) {
+	outcome, log, report, _, err := ag.runInlineTest(dir, filename, submissionFilename, inlineTestLimits)
+	return outcome, log, report, err
+}
+
+// runInlineTest is RunInlineTest with the given resource limits. It also
+// returns the structured results reported by the test.
+func (ag *Autograder) runInlineTest(dir, filename, submissionFilename string, limits Limits) (map[string]interface{}, string, string, []*TestResult, error) {
 	submission, err := ioutil.ReadFile(submissionFilename)
 	if err != nil {
-		return nil, "", "", fmt.Errorf("error reading submission file %q: %s", submissionFilename, err)
+		return nil, "", "", nil, fmt.Errorf("error reading submission file %q: %s", submissionFilename, err)
+	}
+	script, err := ioutil.ReadFile(filepath.Join(dir, filename))
+	if err != nil {
+		return nil, "", "", nil, fmt.Errorf("error reading inline test %q: %s", filename, err)
 	}
+	harnessed := bytes.HasPrefix(script, []byte(harnessMarker))
 	outcome := make(map[string]interface{})
-	cmd := exec.Command(ag.NSJailPath,
-		"-Mo",
-		// NSJail does not work under docker without these disable flags.
-		"--disable_clone_newcgroup",
-		"--disable_clone_newipc",
-		"--disable_clone_newnet",
-		"--disable_clone_newns",
-		"--disable_clone_newpid",
-		"--disable_clone_newuser",
-		"--disable_clone_newuts",
-		"--disable_no_new_privs",
-		"--time_limit", "10",
-		"--max_cpus", "1",
-		"--rlimit_as", "700",
-		"--env", "LANG=en_US.UTF-8",
-		"--disable_proc",
-		//"--chroot", "/",
-		"--cwd", dir,
-		"--user", "nobody",
-		"--group", "nogroup",
-		"--iface_no_lo",
-		"--",
-		ag.PythonPath,
-		filename)
 	var passed bool
-	glog.V(5).Infof("about to execute %s %q", cmd.Path, cmd.Args)
-	out, err := cmd.CombinedOutput()
+	resultsFile, err := newResultsFile()
+	if err != nil {
+		return nil, "", "", nil, err
+	}
+	defer resultsFile.Close()
+	out, err := ag.run(dir, limits, nil, []*os.File{resultsFile}, ag.PythonPath, filename)
 	if err != nil {
 		if _, ok := err.(*exec.ExitError); !ok {
-			return nil, "", "", fmt.Errorf("error running unit test command %q %q: %s", cmd.Path, cmd.Args, err)
+			return nil, "", "", nil, fmt.Errorf("error running inline test %s in %q: %s", filename, dir, err)
 		}
 		// Overall status was non-ok.
 		passed = false
@@ -625,19 +1004,44 @@ func (ag *Autograder) RunInlineTest(dir, filename, submissionFilename string) (m
 	}
 	outcome["error"] = strings.Join(errors, "; ")
 	outcome["passed"] = passed
-	mm = inlineOutcomeRegex.FindAllSubmatch(out, -1)
-	if len(mm) == 0 {
+	results, started, err := readResults(resultsFile)
+	if err != nil {
+		return nil, "", "", nil, err
+	}
+	type statusMessage struct{ status, message string }
+	var statuses []statusMessage
+	for _, r := range results {
+		statuses = append(statuses, statusMessage{strings.ToUpper(r.Status), r.Message})
+	}
+	if len(results) > 1 {
+		// The test reports one result, so the rest do not come from it.
+		statuses = append(statuses, statusMessage{"FAIL", "more than one test result reported"})
+	}
+	if !harnessed || !started {
+		// The legacy test scripts only print the markers to the output,
+		// and the harness prints them too if it did not get the results
+		// file. Once the harness has started, the output may come from
+		// the submission.
+		for _, m := range inlineOutcomeRegex.FindAllSubmatch(out, -1) {
+			statuses = append(statuses, statusMessage{string(m[1]), string(m[2])})
+		}
+	}
+	if len(statuses) == 0 {
 		// Cannot find any individual test case outcomes.
 		outcome["passed"] = false
+		if harnessed {
+			passed = false
+			errors = append(errors, "no test results reported")
+			outcome["error"] = strings.Join(errors, "; ")
+		}
 	}
 	var reportBuf bytes.Buffer
-	for _, m := range mm {
-		status := string(m[1])
-		message := string(m[2])
-		if status != "OK" {
+	for _, s := range statuses {
+		message := s.message
+		if s.status != "OK" {
 			outcome["passed"] = false
 		}
-		if status == "ERROR" {
+		if s.status == "ERROR" {
 			message = "Test error: " + message
 		}
 		if message != "" {
@@ -653,7 +1057,7 @@ func (ag *Autograder) RunInlineTest(dir, filename, submissionFilename string) (m
 		var sourceBuf bytes.Buffer
 		err := sourceTmpl.Execute(&sourceBuf, submission)
 		if err != nil {
-			return nil, "", "", err
+			return nil, "", "", nil, err
 		}
 		formattedSource = sourceBuf.Bytes()
 	}
@@ -669,9 +1073,9 @@ func (ag *Autograder) RunInlineTest(dir, filename, submissionFilename string) (m
 		Logs:            logs,
 	})
 	if err != nil {
-		return nil, "", "", err
+		return nil, "", "", nil, err
 	}
-	return outcome, string(out), reportBuf.String(), nil
+	return outcome, string(out), reportBuf.String(), results, nil
 }
 
 // RunInlineTests runs all inline tests in a scratch directory found by a glob
@@ -681,91 +1085,175 @@ func (ag *Autograder) RunInlineTest(dir, filename, submissionFilename string) (m
 // - logs map[string]string
 // - reports map[string]string
 func (ag *Autograder) RunInlineTests(dir string) (map[string]interface{}, map[string]string, map[string]string, error) {
+	outcomes, logs, reports, _, err := ag.runInlineTests(dir, inlineTestLimits)
+	return outcomes, logs, reports, err
+}
+
+// runInlineTests is RunInlineTests with the given resource limits. It also
+// returns the structured results of the tests keyed by the test name.
+func (ag *Autograder) runInlineTests(dir string, limits Limits) (map[string]interface{}, map[string]string, map[string]string, map[string][]*TestResult, error) {
 	glog.V(3).Infof("RunInlineTests(%s)", dir)
 	dir, err := filepath.Abs(dir)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("error getting abs path for %q: %s", dir, err)
-	}
-	err = os.Chdir(dir)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("error on chdir %q: %s", dir, err)
+		return nil, nil, nil, nil, fmt.Errorf("error getting abs path for %q: %s", dir, err)
 	}
 	submissionFilename := filepath.Join(dir, "submission.py")
 	_, err = os.Stat(submissionFilename)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("error statting %s/submission.py: %s", dir, err)
+		return nil, nil, nil, nil, fmt.Errorf("error statting %s/submission.py: %s", dir, err)
 	}
 	fss, err := ioutil.ReadDir(dir)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("error on listing %q: %s", dir, err)
+		return nil, nil, nil, nil, fmt.Errorf("error on listing %q: %s", dir, err)
+	}
+	var filenames []string
+	for _, fs := range fss {
+		if strings.HasSuffix(fs.Name(), "_inlinetest.py") {
+			filenames = append(filenames, fs.Name())
+		}
+	}
+	testOutcomes := make([]map[string]interface{}, len(filenames))
+	testLogs := make([]string, len(filenames))
+	testReports := make([]string, len(filenames))
+	testResults := make([][]*TestResult, len(filenames))
+	err = ag.forEachTest(dir, filenames, func(i int, dir string) error {
+		var err error
+		testOutcomes[i], testLogs[i], testReports[i], testResults[i], err = ag.runInlineTest(dir, filenames[i], submissionFilename, limits)
+		return err
+	})
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
 	outcomes := make(map[string]interface{})
 	reports := make(map[string]string)
 	logs := make(map[string]string)
-	for _, fs := range fss {
-		filename := fs.Name()
-		if !strings.HasSuffix(filename, "_inlinetest.py") {
-			continue
-		}
+	results := make(map[string][]*TestResult)
+	for i, filename := range filenames {
 		// Extract the test name by stripping _inlinetest.py.
 		testname := filename[:len(filename)-len("_inlinetest.py")]
-		testOutcome, testLog, testReport, err := ag.RunInlineTest(dir, filename, submissionFilename)
-		if err != nil {
-			return nil, nil, nil, err
+		outcomes[testname] = testOutcomes[i]
+		logs[testname] = testLogs[i]
+		if testReports[i] != "" {
+			reports[testname] = testReports[i]
 		}
-		outcomes[testname] = testOutcome
-		logs[testname] = testLog
-		if testReport != "" {
-			reports[testname] = testReport
+		if len(testResults[i]) > 0 {
+			results[testname] = testResults[i]
 		}
 	}
-	return outcomes, logs, reports, nil
+	return outcomes, logs, reports, results, nil
 }
 
-// RenderReports looks for report templates in the specified scratch dir and renders all reports.
-// It returns the concatenation of all reports output.
-func (ag *Autograder) RenderReports(dir string, data map[string]interface{}) ([]byte, error) {
-	err := os.Chdir(dir)
+// ReporterError describes a report template that failed to render.
+type ReporterError struct {
+	// Template is the file name of the report template.
+	Template string `json:"template"`
+	// Error is the reason of the failure.
+	Error string `json:"error"`
+	// Output is the output of the template, e.g. the Python traceback.
+	Output string `json:"output,omitempty"`
+}
+
+// maxReportInput is the maximum size of the outcome JSON passed to the report
+// templates on stdin.
+const maxReportInput = 1 << 20
+
+// reportInput returns the outcome JSON for the report templates. If it is
+// larger than maxReportInput, the logs and the structured test results,
+// which are the bulk of the outcome, are omitted.
+func reportInput(data map[string]interface{}) ([]byte, error) {
+	b, err := json.Marshal(data)
 	if err != nil {
-		return nil, fmt.Errorf("error on chdir %q: %s", dir, err)
+		return nil, fmt.Errorf("error serializing the outcome: %s", err)
 	}
-	fss, err := ioutil.ReadDir(dir)
+	if len(b) <= maxReportInput {
+		return b, nil
+	}
+	trimmed := make(map[string]interface{})
+	for k, v := range data {
+		trimmed[k] = v
+	}
+	// The templates expect the logs to be present.
+	trimmed["logs"] = map[string]string{}
+	delete(trimmed, "tests")
+	glog.Warningf("outcome of %d bytes exceeds the report input limit of %d bytes, omitting logs and tests",
+		len(b), maxReportInput)
+	b, err = json.Marshal(trimmed)
 	if err != nil {
-		return nil, fmt.Errorf("error on listing %q: %s", dir, err)
+		return nil, fmt.Errorf("error serializing the outcome: %s", err)
+	}
+	if len(b) > maxReportInput {
+		return nil, fmt.Errorf("outcome of %d bytes exceeds the report input limit of %d bytes",
+			len(b), maxReportInput)
 	}
-	dataJson, err := json.Marshal(data)
+	return b, nil
+}
+
+// RenderReports looks for report templates in the specified scratch dir and renders all reports.
+// It returns the concatenation of all reports output. The templates that fail
+// are logged and skipped, GradeExercise returns them in reporter_errors.
+func (ag *Autograder) RenderReports(dir string, data map[string]interface{}) ([]byte, error) {
+	report, reporterErrors, err := ag.renderReports(dir, data, reportLimits)
 	if err != nil {
 		return nil, err
 	}
-	var reports [][]byte
+	for _, e := range reporterErrors {
+		glog.Errorf("Reporter error in %s: %s", e.Template, e.Error)
+	}
+	return report, nil
+}
+
+// renderReports is RenderReports with the given resource limits. The templates
+// run in the sandbox with the outcome JSON on stdin. It also returns
+// the templates that failed.
+func (ag *Autograder) renderReports(dir string, data map[string]interface{}, limits Limits) ([]byte, []*ReporterError, error) {
+	fss, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error on listing %q: %s", dir, err)
+	}
+	var filenames []string
 	for _, fs := range fss {
-		filename := fs.Name()
-		if !strings.HasSuffix(filename, "_template.py") {
-			continue
+		if strings.HasSuffix(fs.Name(), "_template.py") {
+			filenames = append(filenames, fs.Name())
 		}
-		cmd := exec.Command("python", filename)
-		glog.V(3).Infof("Starting command %s %q with input %q", cmd.Path, cmd.Args, string(dataJson))
-		cmdIn, err := cmd.StdinPipe()
-		if err != nil {
-			return nil, err
+	}
+	if len(filenames) == 0 {
+		return nil, nil, nil
+	}
+	var reporterErrors []*ReporterError
+	dataJson, err := reportInput(data)
+	if err != nil {
+		for _, filename := range filenames {
+			reporterErrors = append(reporterErrors, &ReporterError{
+				Template: filename,
+				Error:    err.Error(),
+			})
 		}
-		go func() {
-			cmdIn.Write(dataJson)
-			cmdIn.Close()
-		}()
-		output, err := cmd.CombinedOutput()
+		return nil, reporterErrors, nil
+	}
+	var reports [][]byte
+	for _, filename := range filenames {
+		glog.V(3).Infof("Rendering report %s with input %q", filename, string(dataJson))
+		output, err := ag.run(dir, limits, dataJson, nil, ag.PythonPath, filename)
 		if err != nil {
-			reports = append(reports, []byte(fmt.Sprintf(`
-<h2 style='color: red'>Reporter error</h2>
-<pre>%s</pre>`, err.Error())))
-			glog.Errorf("Reporter error: %s", err)
-			reports = append(reports, output)
+			if _, ok := err.(*exec.ExitError); !ok {
+				return nil, nil, fmt.Errorf("error running report template %s in %q: %s", filename, dir, err)
+			}
+			message := err.Error()
+			if timeoutRegex.Find(output) != nil {
+				message = "Time out."
+			}
+			glog.V(3).Infof("Reporter error in %s: %s\n%s", filename, message, string(output))
+			reporterErrors = append(reporterErrors, &ReporterError{
+				Template: filename,
+				Error:    message,
+				Output:   string(output),
+			})
 			continue
 		}
 		glog.V(3).Infof("Output: %s", string(output))
 		reports = append(reports, output)
 	}
-	return bytes.Join(reports, nil), nil
+	return bytes.Join(reports, nil), reporterErrors, nil
 }
 
 // CopyDirFiles copies all files in the directory (one level).
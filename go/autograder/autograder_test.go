@@ -0,0 +1,187 @@
+package autograder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScorePoints(t *testing.T) {
+	unit := map[string]interface{}{
+		"XTest": map[string]interface{}{
+			"passed": false,
+			"error":  "",
+			"test_x": true,
+			"test_y": false,
+		},
+	}
+	inline := map[string]interface{}{
+		"Test1": map[string]interface{}{"passed": true, "error": ""},
+	}
+	tests := []struct {
+		name             string
+		weights          map[string]float64
+		unit, inline     map[string]interface{}
+		earned, possible float64
+	}{
+		{"no points file", nil, unit, inline, 2, 3},
+		{"weights", map[string]float64{"XTest.test_x": 2, "XTest.test_y": 1, "Test1": 0.5}, unit, inline, 2.5, 3.5},
+		{"missing outcomes", map[string]float64{"XTest.test_x": 2, "XTest.test_y": 1, "Test1": 0.5}, nil, inline, 0.5, 3.5},
+		{"unlisted test", map[string]float64{"XTest.test_y": 1, "Test1": 0.5}, unit, inline, 0.5, 1.5},
+		{"nothing", nil, nil, nil, 0, 0},
+	}
+	for _, tt := range tests {
+		got := scorePoints(tt.weights, tt.unit, tt.inline)
+		if got.Earned != tt.earned || got.Possible != tt.possible {
+			t.Errorf("%s: scorePoints() = %+v, want earned %v, possible %v", tt.name, got, tt.earned, tt.possible)
+		}
+	}
+}
+
+func TestReportInput(t *testing.T) {
+	results := map[string]interface{}{"Test1": map[string]interface{}{"passed": true}}
+	bigLog := strings.Repeat("x", maxReportInput)
+	tests := []struct {
+		name    string
+		data    map[string]interface{}
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "small",
+			data: map[string]interface{}{"results": results, "logs": map[string]string{"Test1": "ok"}, "tests": map[string]interface{}{}},
+			want: map[string]interface{}{"results": results, "logs": map[string]interface{}{"Test1": "ok"}, "tests": map[string]interface{}{}},
+		},
+		{
+			name: "large logs",
+			data: map[string]interface{}{"results": results, "logs": map[string]string{"Test1": bigLog}, "tests": map[string]interface{}{"Test1": bigLog}},
+			want: map[string]interface{}{"results": results, "logs": map[string]interface{}{}},
+		},
+		{
+			name:    "large results",
+			data:    map[string]interface{}{"results": map[string]interface{}{"Test1": bigLog}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		b, err := reportInput(tt.data)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: reportInput() returned %d bytes, want error", tt.name, len(b))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: reportInput() returned error %s", tt.name, err)
+			continue
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Errorf("%s: reportInput() returned invalid JSON: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: reportInput() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if _, ok := tests[1].data["tests"]; !ok {
+		t.Errorf("reportInput() modified the outcome")
+	}
+}
+
+// fakeSandbox returns the output without running the command, and writes
+// the results to the first file passed to the command.
+type fakeSandbox struct {
+	output  string
+	results string
+}
+
+// Run implements Sandbox.
+func (s *fakeSandbox) Run(dir string, limits Limits, stdin []byte, files []*os.File, args ...string) ([]byte, error) {
+	if s.results != "" && len(files) > 0 {
+		if _, err := files[0].WriteString(s.results); err != nil {
+			return nil, err
+		}
+	}
+	return []byte(s.output), nil
+}
+
+func TestRunUnitTest(t *testing.T) {
+	tests := []struct {
+		name    string
+		sandbox *fakeSandbox
+		want    map[string]interface{}
+	}{
+		{
+			name: "results",
+			sandbox: &fakeSandbox{
+				output:  "test_x (XTest.test_x) ... FAIL\n",
+				results: `{"status": "started"}` + "\n" + `{"id": "XTest.test_x", "status": "ok"}` + "\n" + `{"id": "XTest.test_y", "status": "fail"}` + "\n",
+			},
+			want: map[string]interface{}{"passed": false, "test_x": true, "test_y": false},
+		},
+		{
+			name:    "fallback to output",
+			sandbox: &fakeSandbox{output: "test_x (XTest.test_x) ... ok\ntest_y (XTest.XTest.test_y) ... FAIL\n"},
+			want:    map[string]interface{}{"passed": false, "test_x": true, "test_y": false},
+		},
+		{
+			name:    "no results",
+			sandbox: &fakeSandbox{output: "Killed\n"},
+			want:    map[string]interface{}{"passed": false, "error": "no test results reported"},
+		},
+		{
+			name: "printed outcome after start",
+			sandbox: &fakeSandbox{
+				output:  "test_x (XTest.test_x) ... ok\ntest_y (XTest.test_y) ... ok\n",
+				results: `{"status": "started"}` + "\n",
+			},
+			want: map[string]interface{}{"passed": false, "error": "no test results reported"},
+		},
+		{
+			name: "unknown test",
+			sandbox: &fakeSandbox{
+				results: `{"status": "started"}` + "\n" + `{"id": "XTest.test_x", "status": "ok"}` + "\n" + `{"id": "XTest.test_y", "status": "ok"}` + "\n" +
+					`{"id": "XTest.test_z", "status": "ok"}` + "\n",
+			},
+			want: map[string]interface{}{"passed": true, "test_x": true, "test_y": true},
+		},
+		{
+			name: "repeated test",
+			sandbox: &fakeSandbox{
+				results: `{"status": "started"}` + "\n" + `{"id": "XTest.test_x", "status": "ok"}` + "\n" + `{"id": "XTest.test_y", "status": "ok"}` + "\n" +
+					`{"id": "XTest.test_x", "status": "fail"}` + "\n",
+			},
+			want: map[string]interface{}{"passed": false, "test_x": false, "test_y": true, "error": "test test_x reported more than once"},
+		},
+		{
+			name:    "missing test",
+			sandbox: &fakeSandbox{results: `{"status": "started"}` + "\n" + `{"id": "XTest.test_x", "status": "ok"}` + "\n"},
+			want:    map[string]interface{}{"passed": false, "test_x": true},
+		},
+	}
+	dir, err := ioutil.TempDir("", "autograder_test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	source := "class XTest(unittest.TestCase):\n  def test_x(self):\n    pass\n  def test_y(self):\n    pass\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "XTest.py"), []byte(source), 0644); err != nil {
+		t.Fatalf("error writing test: %s", err)
+	}
+	for _, tt := range tests {
+		ag := &Autograder{Sandbox: tt.sandbox}
+		got, _, _, err := ag.runUnitTest(dir, "XTest.py", unitTestLimits)
+		if err != nil {
+			t.Errorf("%s: runUnitTest() returned error %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: runUnitTest() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package autograder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/golang/glog"
+)
+
+// The tests report their results through a side-channel file instead of the
+// output, so that the prints of the submission cannot spoof or break them.
+// The file is opened by the autograder outside of the scratch directory and
+// passed to the test as the file descriptor resultsFD. It has one JSON object
+// per line in the format of TestResult. Before running the submission, the
+// harness moves the file to a descriptor of its own, closes resultsFD and
+// reports the status started, and the autograder accepts only one result
+// for each test it expects. If the harness has not started, e.g. because
+// the sandbox did not pass the file, the outcome is parsed from the output.
+//
+// This is not a security boundary. The submission runs in the same process
+// as the harness, so it can still find the descriptor, e.g. by trying the
+// descriptor numbers, write forged results and exit before the tests run.
+// The results only stop the submission from spoofing the outcome by printing
+// or by the names in its namespace. Trusted results would need the submission
+// to run in a process separate from the tests.
+
+// resultsFD is the file descriptor of the results file in the test process.
+const resultsFD = 3
+
+// harnessMarker starts the test scripts that report to the results file.
+// The scripts without it are run as before the harness existed, and their
+// outcome is parsed from the output.
+const harnessMarker = "# Reports the results to file descriptor 3.\n"
+
+// TestResult is the structured result of a single test as reported
+// by the test harness.
+type TestResult struct {
+	// ID is Class.method for unit tests. It is empty for inline tests,
+	// which are identified by the test name.
+	ID string `json:"id,omitempty"`
+	// Status is one of ok, fail, error or skip, or startedStatus.
+	Status string `json:"status"`
+	// Message is the short description of the failure or the skip reason.
+	Message string `json:"message,omitempty"`
+	// Duration is the run time of the test in seconds.
+	Duration float64 `json:"duration"`
+	// Traceback is the Python traceback of the failure.
+	Traceback string `json:"traceback,omitempty"`
+}
+
+// startedStatus is the status of the result that the harness reports before
+// running the tests.
+const startedStatus = "started"
+
+// unittestHarnessFilename is the name of the unit test harness
+// in the scratch directory.
+const unittestHarnessFilename = "unittest_harness.py"
+
+// unittestHarness runs the unit tests from the module given as the argument
+// with verbose output and writes the results to resultsFD.
+const unittestHarness = harnessMarker + `
+
+def _main():
+  import json
+  import os
+  import sys
+  import time
+  import traceback
+  import unittest
+
+  # Keep the results out of the way of the submission imported by the tests.
+  try:
+    fd = os.dup(3)
+    os.close(3)
+    results = os.fdopen(fd, 'w')
+  except OSError:
+    # The autograder parses the output if it did not pass the results file.
+    results = None
+  module = sys.argv.pop(1)
+
+  def write(record):
+    if results is not None:
+      results.write(json.dumps(record) + '\n')
+      results.flush()
+
+  write({'status': 'started'})
+
+  class Result(unittest.TextTestResult):
+
+    def startTest(self, test):
+      self._start = time.time()
+      super().startTest(test)
+
+    def _emit(self, test, status, err=None, message=None):
+      name = getattr(test, '_testMethodName', None)
+      record = {
+          'id': type(test).__name__ + '.' + name if name else test.id(),
+          'status': status,
+          'duration': time.time() - getattr(self, '_start', time.time()),
+      }
+      if err is not None:
+        record['message'] = traceback.format_exception_only(err[0], err[1])[-1].strip()
+        record['traceback'] = ''.join(traceback.format_exception(*err))
+      if message is not None:
+        record['message'] = message
+      write(record)
+
+    def addSuccess(self, test):
+      super().addSuccess(test)
+      self._emit(test, 'ok')
+
+    def addFailure(self, test, err):
+      super().addFailure(test, err)
+      self._emit(test, 'fail', err)
+
+    def addError(self, test, err):
+      super().addError(test, err)
+      self._emit(test, 'error', err)
+
+    def addSkip(self, test, reason):
+      super().addSkip(test, reason)
+      self._emit(test, 'skip', message=reason)
+
+    def addExpectedFailure(self, test, err):
+      super().addExpectedFailure(test, err)
+      self._emit(test, 'ok')
+
+    def addUnexpectedSuccess(self, test):
+      super().addUnexpectedSuccess(test)
+      self._emit(test, 'fail', message='unexpected success')
+
+  runner = unittest.TextTestRunner(verbosity=2, resultclass=Result)
+  result = runner.run(unittest.defaultTestLoader.loadTestsFromName(module))
+  sys.exit(0 if result.wasSuccessful() else 1)
+
+
+_main()
+`
+
+// testMethodRegex matches the test methods defined in a unit test file.
+var testMethodRegex = regexp.MustCompile(`(?m)^[ \t]+def (test[a-zA-Z_0-9]*)\(`)
+
+// expectedTests returns the names of the test methods defined in the source
+// of a unit test file.
+func expectedTests(source []byte) map[string]bool {
+	ret := make(map[string]bool)
+	for _, m := range testMethodRegex.FindAllSubmatch(source, -1) {
+		ret[string(m[1])] = true
+	}
+	return ret
+}
+
+// writeUnittestHarness writes the unit test harness into the scratch directory.
+func writeUnittestHarness(dir string) error {
+	filename := filepath.Join(dir, unittestHarnessFilename)
+	err := ioutil.WriteFile(filename, []byte(unittestHarness), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing %q: %s", filename, err)
+	}
+	return nil
+}
+
+// newResultsFile creates an empty results file in the system temporary
+// directory. The file is removed right away, so that it is only reachable
+// through the returned handle and the file descriptor passed to the test.
+func newResultsFile() (*os.File, error) {
+	f, err := ioutil.TempFile("", "results-")
+	if err != nil {
+		return nil, fmt.Errorf("error creating results file: %s", err)
+	}
+	err = os.Remove(f.Name())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error removing results file %q: %s", f.Name(), err)
+	}
+	return f, nil
+}
+
+// readResults reads the results written by the test from the beginning of
+// the results file, and whether the harness has started. It returns nil if
+// the test has not reported any results, e.g. because the test script did
+// not compile. Malformed lines are skipped.
+func readResults(f io.ReadSeeker) ([]*TestResult, bool, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, false, fmt.Errorf("error seeking results file: %s", err)
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, false, fmt.Errorf("error reading results file: %s", err)
+	}
+	var results []*TestResult
+	started := false
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		result := &TestResult{}
+		err := json.Unmarshal(line, result)
+		if err != nil || result.Status == "" {
+			glog.Warningf("malformed test result: %q", line)
+			continue
+		}
+		if result.Status == startedStatus {
+			started = true
+			continue
+		}
+		results = append(results, result)
+	}
+	return results, started, nil
+}
@@ -0,0 +1,90 @@
+package autograder
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadResults(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		want        []*TestResult
+		wantStarted bool
+	}{
+		{"empty", "", nil, false},
+		{"started", `{"status": "started"}`, nil, true},
+		{
+			name: "unit test",
+			input: `{"status": "started"}
+{"id": "XTest.test_x", "status": "ok", "duration": 0.5}
+{"id": "XTest.test_y", "status": "fail", "message": "AssertionError: 1 != 2", "duration": 1, "traceback": "Traceback"}
+`,
+			want: []*TestResult{
+				{ID: "XTest.test_x", Status: "ok", Duration: 0.5},
+				{ID: "XTest.test_y", Status: "fail", Message: "AssertionError: 1 != 2", Duration: 1, Traceback: "Traceback"},
+			},
+			wantStarted: true,
+		},
+		{
+			name:  "malformed",
+			input: "{\"status\": \"ok\"}\nnot json\n{\"status\": \n{\"message\": \"no status\"}\n\n{\"status\": \"skip\"}",
+			want:  []*TestResult{{Status: "ok"}, {Status: "skip"}},
+		},
+	}
+	for _, tt := range tests {
+		r := strings.NewReader(tt.input)
+		// readResults reads from the beginning of the file.
+		if _, err := r.Seek(0, io.SeekEnd); err != nil {
+			t.Fatalf("error seeking: %s", err)
+		}
+		got, started, err := readResults(r)
+		if err != nil {
+			t.Errorf("%s: readResults() returned error %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) || started != tt.wantStarted {
+			t.Errorf("%s: readResults() = %v, %v, want %v, %v", tt.name, got, started, tt.want, tt.wantStarted)
+		}
+	}
+}
+
+func TestNewResultsFile(t *testing.T) {
+	f, err := newResultsFile()
+	if err != nil {
+		t.Fatalf("newResultsFile() returned error %s", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(`{"status": "ok"}` + "\n"); err != nil {
+		t.Fatalf("error writing results: %s", err)
+	}
+	got, _, err := readResults(f)
+	if err != nil || len(got) != 1 || got[0].Status != "ok" {
+		t.Errorf("readResults() = %v, %v, want one ok result", got, err)
+	}
+}
+
+func TestGenerateInlineTest(t *testing.T) {
+	b, err := generateInlineTest("  \n", "s = \"\"\"a\n  b\"\"\"\n", "assert s")
+	if err != nil {
+		t.Fatalf("generateInlineTest() returned error %s", err)
+	}
+	got := string(b)
+	if !strings.HasPrefix(got, harnessMarker) {
+		t.Errorf("generateInlineTest() = %q, want prefix %q", got, harnessMarker)
+	}
+	// The parts are string literals, not indented code.
+	for _, want := range []string{
+		`exec(compile("s = \"\"\"a\n  b\"\"\"\n", 'submission.py', 'exec'), namespace)`,
+		`exec(compile("assert s", 'inline.py', 'exec'), namespace)`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generateInlineTest() = %s, want it to contain %s", got, want)
+		}
+	}
+	if strings.Contains(got, "context.py") {
+		t.Errorf("generateInlineTest() with empty context = %s, want no context", got)
+	}
+}
@@ -0,0 +1,91 @@
+package autograder
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// forEach calls f for each i in [0, n) and returns the first error in the
+// order of i. If ag.Parallelism is greater than one, the calls are made
+// concurrently by at most ag.Parallelism workers, and f must be safe to
+// call so.
+func (ag *Autograder) forEach(n int, f func(i int) error) error {
+	if ag.Parallelism <= 1 {
+		for i := 0; i < n; i++ {
+			err := f(i)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	workers := ag.Parallelism
+	if workers > n {
+		workers = n
+	}
+	indices := make(chan int)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				errs[i] = f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachTest calls f for each of the test files in the scratch directory
+// dir like forEach, with the directory to run the test in. The tests may
+// write files into the scratch directory, so if they run concurrently, each
+// test runs in its own copy of dir, created next to it and named after the
+// test file.
+func (ag *Autograder) forEachTest(dir string, filenames []string, f func(i int, dir string) error) error {
+	if ag.Parallelism <= 1 || len(filenames) <= 1 {
+		return ag.forEach(len(filenames), func(i int) error {
+			return f(i, dir)
+		})
+	}
+	return ag.forEach(len(filenames), func(i int) error {
+		testDir := dir + "." + strings.TrimSuffix(filepath.Base(filenames[i]), ".py")
+		err := os.RemoveAll(testDir)
+		if err != nil {
+			return err
+		}
+		err = CopyDirFiles(dir, testDir)
+		if err != nil {
+			return err
+		}
+		return f(i, testDir)
+	})
+}
+
+// run runs the command in the sandbox once one of ag.Parallelism slots
+// is available. The slots are shared by all submissions being graded by ag.
+func (ag *Autograder) run(dir string, limits Limits, stdin []byte, files []*os.File, args ...string) ([]byte, error) {
+	if ag.Parallelism > 1 {
+		ag.slotsOnce.Do(func() {
+			ag.slots = make(chan struct{}, ag.Parallelism)
+		})
+		ag.slots <- struct{}{}
+		defer func() {
+			<-ag.slots
+		}()
+	}
+	return ag.sandbox().Run(dir, limits, stdin, files, args...)
+}
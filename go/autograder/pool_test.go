@@ -0,0 +1,116 @@
+package autograder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForEach(t *testing.T) {
+	for _, parallelism := range []int{0, 1, 3, 20} {
+		ag := &Autograder{Parallelism: parallelism}
+		got := make([]int, 10)
+		err := ag.forEach(len(got), func(i int) error {
+			got[i] = i * i
+			return nil
+		})
+		if err != nil {
+			t.Errorf("forEach() with parallelism %d returned error %s", parallelism, err)
+		}
+		for i, v := range got {
+			if v != i*i {
+				t.Errorf("forEach() with parallelism %d set %d at %d, want %d", parallelism, v, i, i*i)
+			}
+		}
+	}
+}
+
+func TestForEachError(t *testing.T) {
+	for _, parallelism := range []int{1, 4} {
+		ag := &Autograder{Parallelism: parallelism}
+		err := ag.forEach(10, func(i int) error {
+			if i == 3 || i == 7 {
+				// The later error finishes first.
+				if i == 3 {
+					time.Sleep(10 * time.Millisecond)
+				}
+				return fmt.Errorf("error %d", i)
+			}
+			return nil
+		})
+		if err == nil || err.Error() != "error 3" {
+			t.Errorf("forEach() with parallelism %d returned error %v, want error 3", parallelism, err)
+		}
+	}
+}
+
+func TestForEachBounded(t *testing.T) {
+	const parallelism = 3
+	ag := &Autograder{Parallelism: parallelism}
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	err := ag.forEach(20, func(i int) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("forEach() returned error %s", err)
+	}
+	if maxRunning > parallelism {
+		t.Errorf("forEach() ran %d calls at the same time, want at most %d", maxRunning, parallelism)
+	}
+	if maxRunning < 2 {
+		t.Errorf("forEach() ran at most %d calls at the same time, want them to run concurrently", maxRunning)
+	}
+}
+
+func TestForEachTest(t *testing.T) {
+	base, err := ioutil.TempDir("", "pool_test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(base)
+	dir := filepath.Join(base, "ex1")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("error creating scratch dir: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "submission.py"), []byte("x = 1"), 0644); err != nil {
+		t.Fatalf("error writing submission: %s", err)
+	}
+	filenames := []string{"ATest.py", "BTest.py"}
+	for _, tt := range []struct {
+		parallelism int
+		want        []string
+	}{
+		{1, []string{dir, dir}},
+		{2, []string{dir + ".ATest", dir + ".BTest"}},
+	} {
+		ag := &Autograder{Parallelism: tt.parallelism}
+		got := make([]string, len(filenames))
+		err := ag.forEachTest(dir, filenames, func(i int, dir string) error {
+			got[i] = dir
+			_, err := os.Stat(filepath.Join(dir, "submission.py"))
+			return err
+		})
+		if err != nil {
+			t.Errorf("forEachTest() with parallelism %d returned error %s", tt.parallelism, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("forEachTest() with parallelism %d ran in %q, want %q", tt.parallelism, got, tt.want)
+		}
+	}
+}
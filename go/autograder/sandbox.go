@@ -0,0 +1,290 @@
+package autograder
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Limits are the resource limits of a command run in the sandbox.
+type Limits struct {
+	// Time is the limit of the wall time. Zero means no limit.
+	Time time.Duration
+	// MemoryMB is the limit of the address space in megabytes.
+	// Zero means no limit.
+	MemoryMB int
+	// CPUs is the maximum number of CPUs. Zero means no limit.
+	CPUs int
+	// CPUTime is the limit of the CPU time. Zero means the wall time limit.
+	CPUTime time.Duration
+	// OutputBytes is the maximum size of the output, the rest of the output
+	// is discarded. Zero means no limit.
+	OutputBytes int
+	// Processes is the maximum number of processes of the user.
+	// Zero means no limit.
+	Processes int
+}
+
+// withOverrides returns the limits with the values given in the limits.json
+// file of an exercise (see notebook.LimitsKey) replacing the defaults.
+func (l Limits) withOverrides(overrides map[string]float64) Limits {
+	for name, v := range overrides {
+		switch name {
+		case "wall_time":
+			l.Time = time.Duration(v * float64(time.Second))
+		case "cpu_time":
+			l.CPUTime = time.Duration(v * float64(time.Second))
+		case "memory":
+			l.MemoryMB = int(v)
+		case "cpus":
+			l.CPUs = int(v)
+		case "output_size":
+			l.OutputBytes = int(v)
+		case "processes":
+			l.Processes = int(v)
+		}
+	}
+	return l
+}
+
+var (
+	// unitTestLimits are the limits of a unit test run.
+	unitTestLimits = Limits{Time: 30 * time.Second, MemoryMB: 700, CPUs: 1}
+	// inlineTestLimits are the limits of an inline test run.
+	inlineTestLimits = Limits{Time: 10 * time.Second, MemoryMB: 700, CPUs: 1}
+	// reportLimits are the limits of a report template run.
+	reportLimits = Limits{Time: 10 * time.Second, MemoryMB: 700, CPUs: 1}
+)
+
+// seconds rounds the duration up to whole seconds.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// Sandbox runs the test commands isolated from the host system.
+type Sandbox interface {
+	// Run runs the command given by args in the directory dir within
+	// the limits with stdin as the standard input, and returns the combined
+	// output. The files are passed to the command as the file descriptors
+	// 3, 4 and so on. If the command ran but failed or exceeded the time
+	// limit, the error is *exec.ExitError.
+	Run(dir string, limits Limits, stdin []byte, files []*os.File, args ...string) ([]byte, error)
+}
+
+// NewSandbox returns the sandbox by name: "nsjail" (the binary at nsjailPath),
+// "bubblewrap" (bwrap found in PATH) or "subprocess".
+func NewSandbox(name, nsjailPath string) (Sandbox, error) {
+	switch name {
+	case "nsjail":
+		return &NSJail{Path: nsjailPath}, nil
+	case "bubblewrap":
+		return &Bubblewrap{Path: "bwrap"}, nil
+	case "subprocess":
+		return &Subprocess{}, nil
+	}
+	return nil, fmt.Errorf("unknown sandbox %q, want nsjail, bubblewrap or subprocess", name)
+}
+
+// NSJail runs the commands under nsjail.
+type NSJail struct {
+	// Path is the path to nsjail binary.
+	Path string
+}
+
+// Run implements Sandbox.
+func (s *NSJail) Run(dir string, limits Limits, stdin []byte, files []*os.File, args ...string) ([]byte, error) {
+	cmd := exec.Command(s.Path, nsjailArgs(dir, limits, len(files), args)...)
+	cmd.Dir = dir
+	cmd.ExtraFiles = files
+	glog.V(5).Infof("about to execute %s %q", cmd.Path, cmd.Args)
+	// nsjail enforces the time limit itself.
+	return runCommand(cmd, stdin, 0, limits.OutputBytes)
+}
+
+// nsjailArgs returns the nsjail arguments that run args in dir within
+// the limits, keeping the given number of files open from descriptor 3.
+func nsjailArgs(dir string, limits Limits, files int, args []string) []string {
+	// nsjail -Mo --time_limit 2 --max_cpus 1 --rlimit_as 700 -E LANG=en_US.UTF-8 --disable_proc --chroot / --cwd $PWD --user nobody --group nogroup --iface_no_lo -- /usr/bin/python3 -m unittest discover -v -p '*Test.py'
+	flags := []string{
+		"-Mo",
+		// NSJail does not work under docker without these disable flags.
+		"--disable_clone_newcgroup",
+		"--disable_clone_newipc",
+		"--disable_clone_newnet",
+		"--disable_clone_newns",
+		"--disable_clone_newpid",
+		"--disable_clone_newuser",
+		"--disable_clone_newuts",
+		"--disable_no_new_privs",
+	}
+	if limits.Time > 0 {
+		flags = append(flags, "--time_limit", fmt.Sprint(seconds(limits.Time)))
+	}
+	if limits.CPUs > 0 {
+		flags = append(flags, "--max_cpus", fmt.Sprint(limits.CPUs))
+	}
+	if limits.MemoryMB > 0 {
+		flags = append(flags, "--rlimit_as", fmt.Sprint(limits.MemoryMB))
+	}
+	if limits.CPUTime > 0 {
+		flags = append(flags, "--rlimit_cpu", fmt.Sprint(seconds(limits.CPUTime)))
+	}
+	if limits.Processes > 0 {
+		flags = append(flags, "--rlimit_nproc", fmt.Sprint(limits.Processes))
+	}
+	for i := 0; i < files; i++ {
+		flags = append(flags, "--pass_fd", fmt.Sprint(3+i))
+	}
+	flags = append(flags,
+		"--env", "LANG=en_US.UTF-8",
+		"--disable_proc",
+		//"--chroot", "/",
+		"--cwd", dir,
+		"--user", "nobody",
+		"--group", "nogroup",
+		"--iface_no_lo",
+		"--")
+	return append(flags, args...)
+}
+
+// Bubblewrap runs the commands under bubblewrap with all namespaces
+// unshared, the file system read-only except for dir, and no network.
+// The limits are enforced with ulimit and the process group kill.
+type Bubblewrap struct {
+	// Path is the path to bwrap binary.
+	Path string
+}
+
+// Run implements Sandbox.
+func (s *Bubblewrap) Run(dir string, limits Limits, stdin []byte, files []*os.File, args ...string) ([]byte, error) {
+	cmd := exec.Command(s.Path, bubblewrapArgs(dir, limits, args)...)
+	cmd.Dir = dir
+	cmd.ExtraFiles = files
+	glog.V(5).Infof("about to execute %s %q", cmd.Path, cmd.Args)
+	return runCommand(cmd, stdin, limits.Time, limits.OutputBytes)
+}
+
+// bubblewrapArgs returns the bwrap arguments that run args in dir within
+// the memory, CPU time and process limits. The open files are inherited
+// by the command.
+func bubblewrapArgs(dir string, limits Limits, args []string) []string {
+	flags := []string{
+		"--ro-bind", "/", "/",
+		"--dev", "/dev",
+		"--tmpfs", "/tmp",
+		"--bind", dir, dir,
+		"--unshare-all",
+		"--die-with-parent",
+		"--new-session",
+		"--chdir", dir,
+		"--setenv", "LANG", "en_US.UTF-8",
+		"--",
+	}
+	return append(flags, ulimitArgs(limits, args)...)
+}
+
+// Subprocess runs the commands as plain subprocesses with the resource limits
+// set by ulimit, and kills the whole process group on timeout. It does not
+// isolate the commands from the host and does not limit the CPUs, so it is
+// only meant for development.
+type Subprocess struct{}
+
+// Run implements Sandbox.
+func (s *Subprocess) Run(dir string, limits Limits, stdin []byte, files []*os.File, args ...string) ([]byte, error) {
+	args = ulimitArgs(limits, args)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "LANG=en_US.UTF-8")
+	cmd.ExtraFiles = files
+	glog.V(5).Infof("about to execute %s %q", cmd.Path, cmd.Args)
+	return runCommand(cmd, stdin, limits.Time, limits.OutputBytes)
+}
+
+// ulimitArgs wraps the command into a shell that sets the memory, CPU time
+// and process limits before running it. Note that the process limit counts
+// all processes of the user, not only the ones started by the command.
+func ulimitArgs(limits Limits, args []string) []string {
+	script := ""
+	if limits.MemoryMB > 0 {
+		script += fmt.Sprintf("ulimit -v %d && ", limits.MemoryMB*1024)
+	}
+	cpuTime := limits.CPUTime
+	if cpuTime == 0 {
+		cpuTime = limits.Time
+	}
+	if cpuTime > 0 {
+		script += fmt.Sprintf("ulimit -t %d && ", seconds(cpuTime))
+	}
+	if limits.Processes > 0 {
+		script += fmt.Sprintf("ulimit -u %d && ", limits.Processes)
+	}
+	script += `exec "$@"`
+	return append([]string{"/bin/sh", "-c", script, "sh"}, args...)
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards
+// the rest. Zero limit means no limit. The buffer is not embedded, so that
+// io.Copy cannot bypass Write through bytes.Buffer.ReadFrom.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+// Write implements io.Writer. It never fails, so that the command is not
+// disturbed by the discarded output.
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.limit > 0 && b.buf.Len()+n > b.limit {
+		p = p[:b.limit-b.buf.Len()]
+		b.truncated = true
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// runCommand runs the command in a new process group with the given standard
+// input and returns its combined output, limited to outputBytes. If the command does not finish
+// within the timeout, the whole process group is killed, and the output gets
+// the same message as from nsjail. Zero timeout means no timeout.
+func runCommand(cmd *exec.Cmd, stdin []byte, timeout time.Duration, outputBytes int) ([]byte, error) {
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	out := &limitedBuffer{limit: outputBytes}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err = <-done:
+	case <-expired:
+		// Kill the command together with all processes it started.
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		err = <-done
+		fmt.Fprintf(&out.buf, "\nrun time >= time limit (%d s). Killing it\n", seconds(timeout))
+	}
+	if out.truncated {
+		fmt.Fprintf(&out.buf, "\n[output truncated to %d bytes]\n", outputBytes)
+	}
+	return out.buf.Bytes(), err
+}
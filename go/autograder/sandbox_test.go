@@ -0,0 +1,205 @@
+package autograder
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithOverrides(t *testing.T) {
+	base := Limits{Time: 10 * time.Second, MemoryMB: 700, CPUs: 1}
+	tests := []struct {
+		name      string
+		overrides map[string]float64
+		want      Limits
+	}{
+		{"none", nil, base},
+		{"wall time", map[string]float64{"wall_time": 2.5},
+			Limits{Time: 2500 * time.Millisecond, MemoryMB: 700, CPUs: 1}},
+		{"all", map[string]float64{"wall_time": 60, "cpu_time": 30, "memory": 2000, "cpus": 4, "output_size": 65536, "processes": 16},
+			Limits{Time: 60 * time.Second, CPUTime: 30 * time.Second, MemoryMB: 2000, CPUs: 4, OutputBytes: 65536, Processes: 16}},
+		{"unknown", map[string]float64{"disk": 1}, base},
+	}
+	for _, tt := range tests {
+		if got := base.withOverrides(tt.overrides); got != tt.want {
+			t.Errorf("%s: withOverrides(%v) = %+v, want %+v", tt.name, tt.overrides, got, tt.want)
+		}
+	}
+	if base.withOverrides(map[string]float64{"memory": 1}); base.MemoryMB != 700 {
+		t.Errorf("withOverrides() modified the base limits: %+v", base)
+	}
+}
+
+func TestUlimitArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		want   string
+	}{
+		{"no limits", Limits{}, `exec "$@"`},
+		{"memory and time", Limits{Time: 10 * time.Second, MemoryMB: 700},
+			`ulimit -v 716800 && ulimit -t 10 && exec "$@"`},
+		{"cpu time", Limits{Time: 10 * time.Second, CPUTime: 2500 * time.Millisecond},
+			`ulimit -t 3 && exec "$@"`},
+		{"processes", Limits{Processes: 16}, `ulimit -u 16 && exec "$@"`},
+		{"ignored", Limits{CPUs: 2, OutputBytes: 100}, `exec "$@"`},
+	}
+	for _, tt := range tests {
+		got := ulimitArgs(tt.limits, []string{"python", "x.py"})
+		want := []string{"/bin/sh", "-c", tt.want, "sh", "python", "x.py"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: ulimitArgs(%v) = %q, want %q", tt.name, tt.limits, got, want)
+		}
+	}
+}
+
+// flagValue returns the value following the flag in args before "--",
+// and whether the flag is present.
+func flagValue(args []string, flag string) (string, bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == flag && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+func TestNSJailArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		files  int
+		want   map[string]string
+		absent []string
+	}{
+		{
+			name:   "no limits",
+			want:   map[string]string{"--cwd": "/scratch", "--user": "nobody"},
+			absent: []string{"--time_limit", "--max_cpus", "--rlimit_as", "--rlimit_cpu", "--rlimit_nproc", "--pass_fd"},
+		},
+		{
+			name:   "all limits",
+			limits: Limits{Time: 1500 * time.Millisecond, MemoryMB: 700, CPUs: 2, CPUTime: 5 * time.Second, Processes: 16},
+			files:  1,
+			want: map[string]string{
+				"--time_limit":   "2",
+				"--max_cpus":     "2",
+				"--rlimit_as":    "700",
+				"--rlimit_cpu":   "5",
+				"--rlimit_nproc": "16",
+				"--pass_fd":      "3",
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := nsjailArgs("/scratch", tt.limits, tt.files, []string{"python", "x.py"})
+		for flag, want := range tt.want {
+			if value, ok := flagValue(got, flag); value != want || !ok {
+				t.Errorf("%s: nsjailArgs() has %s %q, want %q in %q", tt.name, flag, value, want, got)
+			}
+		}
+		for _, flag := range tt.absent {
+			if _, ok := flagValue(got, flag); ok {
+				t.Errorf("%s: nsjailArgs() has %s, want none in %q", tt.name, flag, got)
+			}
+		}
+		if tail := got[len(got)-3:]; !reflect.DeepEqual(tail, []string{"--", "python", "x.py"}) {
+			t.Errorf("%s: nsjailArgs() ends with %q, want the command after --", tt.name, tail)
+		}
+	}
+}
+
+func TestNSJailArgsFiles(t *testing.T) {
+	got := strings.Join(nsjailArgs("/scratch", Limits{}, 2, []string{"python"}), " ")
+	if !strings.Contains(got, "--pass_fd 3 --pass_fd 4") {
+		t.Errorf("nsjailArgs() with 2 files = %q, want --pass_fd 3 --pass_fd 4", got)
+	}
+}
+
+func TestBubblewrapArgs(t *testing.T) {
+	limits := Limits{Time: 10 * time.Second, MemoryMB: 700}
+	got := bubblewrapArgs("/scratch", limits, []string{"python", "x.py"})
+	for flag, want := range map[string]string{"--bind": "/scratch", "--chdir": "/scratch", "--ro-bind": "/"} {
+		if value, ok := flagValue(got, flag); value != want || !ok {
+			t.Errorf("bubblewrapArgs() has %s %q, want %q in %q", flag, value, want, got)
+		}
+	}
+	if !strings.Contains(strings.Join(got, " "), " --unshare-all ") {
+		t.Errorf("bubblewrapArgs() = %q, want --unshare-all", got)
+	}
+	i := len(got) - len(ulimitArgs(limits, []string{"python", "x.py"}))
+	if got[i-1] != "--" || !reflect.DeepEqual(got[i:], ulimitArgs(limits, []string{"python", "x.py"})) {
+		t.Errorf("bubblewrapArgs() = %q, want the ulimit command after --", got)
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	tests := []struct {
+		name          string
+		limit         int
+		writes        []string
+		want          string
+		wantTruncated bool
+	}{
+		{"no limit", 0, []string{"abc", "def"}, "abcdef", false},
+		{"within limit", 6, []string{"abc", "def"}, "abcdef", false},
+		{"truncated", 4, []string{"abc", "def"}, "abcd", true},
+		{"after limit", 3, []string{"abc", "def"}, "abc", true},
+	}
+	for _, tt := range tests {
+		b := &limitedBuffer{limit: tt.limit}
+		for _, s := range tt.writes {
+			n, err := b.Write([]byte(s))
+			if n != len(s) || err != nil {
+				t.Errorf("%s: Write(%q) = %d, %v, want %d, nil", tt.name, s, n, err, len(s))
+			}
+		}
+		if b.buf.String() != tt.want || b.truncated != tt.wantTruncated {
+			t.Errorf("%s: got %q, truncated %v, want %q, truncated %v", tt.name, b.buf.String(), b.truncated, tt.want, tt.wantTruncated)
+		}
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	out, err := runCommand(exec.Command("/bin/sh", "-c", "echo 0123456789"), nil, 0, 4)
+	if err != nil {
+		t.Errorf("runCommand() returned error %s", err)
+	}
+	if want := "0123\n[output truncated to 4 bytes]\n"; string(out) != want {
+		t.Errorf("runCommand() = %q, want %q", out, want)
+	}
+	out, err = runCommand(exec.Command("/bin/sh", "-c", "sleep 10"), nil, 100*time.Millisecond, 0)
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Errorf("runCommand() past the timeout returned error %v, want *exec.ExitError", err)
+	}
+	if !timeoutRegex.Match(out) {
+		t.Errorf("runCommand() past the timeout = %q, want the time limit message", out)
+	}
+	out, err = runCommand(exec.Command("/bin/cat"), []byte("input"), 0, 0)
+	if err != nil || !bytes.Equal(out, []byte("input")) {
+		t.Errorf("runCommand(cat) = %q, %v, want the stdin", out, err)
+	}
+}
+
+func TestSubprocessFiles(t *testing.T) {
+	f, err := newResultsFile()
+	if err != nil {
+		t.Fatalf("newResultsFile() returned error %s", err)
+	}
+	defer f.Close()
+	_, err = (&Subprocess{}).Run(os.TempDir(), Limits{Time: 10 * time.Second}, nil, []*os.File{f}, "/bin/sh", "-c", `echo '{"status": "ok"}' >&3`)
+	if err != nil {
+		t.Fatalf("Run() returned error %s", err)
+	}
+	got, _, err := readResults(f)
+	if err != nil || len(got) != 1 || got[0].Status != "ok" {
+		t.Errorf("readResults() after Run() = %v, %v, want one ok result", got, err)
+	}
+}
@@ -10,10 +10,23 @@
 //     -preamble ../exercises/preamble.py
 //
 //   go run cmd/assign/assign.go
+//     -command student
+//     -input ../exercises/helloworld-en-master.ipynb
+//     -output ./helloworld-student.ipynb
+//     -profile jupyterlab
+//     -server_url https://example.com
+//
+//   go run cmd/assign/assign.go
 //     -command autograder
 //     -input ../exercies/helloworld-en-master.ipynb
 //     -output ./autograder-dir
 //
+//   go run cmd/assign/assign.go
+//     -command upgrade
+//     -input ../exercises/helloworld-en-master.ipynb
+//     -student ./helloworld-student-in-progress.ipynb
+//     -output ./helloworld-student-upgraded.ipynb
+//
 package main
 
 import (
@@ -25,6 +38,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/google/prog-edu-assistant/notebook"
 )
@@ -32,11 +46,17 @@ import (
 var (
 	command = flag.String("command", "", "The command to execute.")
 	input   = flag.String("input", "",
-		"The file name of the input master notebook.")
+		"The file name of the input master notebook. Files with .py extension "+
+			"are read in jupytext percent format.")
 	output = flag.String("output", "",
 		"The file name of the output. If empty, output is written to stdout.")
 	language = flag.String("language", "",
-		"The language that should be used in the output notebook.")
+		"The language that should be used in the output notebook, as a BCP 47 "+
+			"tag (e.g. 'en', 'ko', 'es-MX'). Several comma-separated languages, "+
+			"or 'all' for all languages used in the master notebook, produce "+
+			"one student notebook per language. The language is then inserted "+
+			"into the --output file name, replacing '{lang}' if present or "+
+			"before the extension otherwise.")
 	preamble = flag.String("preamble", "",
 		"The file name of the preamble, i.e. a python code snippet "+
 			"to be added as a first code cell in student notebook.")
@@ -53,6 +73,44 @@ var (
 			"cell after each exercise (in the student notebook). For example, "+
 			"Use 'Submit(\"{{.exercise_id}}\")' for Colab export. "+
 			"{{.exercise_id}} is replaced with the exercise ID.")
+	profile = flag.String("profile", "",
+		"The platform profile of the student notebook: colab, "+
+			"jupyter-nbextension, jupyterlab or offline. The profile provides "+
+			"the preamble, check cells and notebook metadata; --preamble and "+
+			"--insert_check_cell override the ones of the profile.")
+	serverURL = flag.String("server_url", "",
+		"The URL of the upload server used in the preamble of the --profile.")
+	validate = flag.Bool("validate", false,
+		"If true, the input notebook is checked against the nbformat schema "+
+			"before processing, and any violations are reported as errors.")
+	outputNBFormat = flag.Int("output_nbformat", 4,
+		"The nbformat major version of the student notebook. Use 3 only "+
+			"for tools that cannot read nbformat v4. The input notebook "+
+			"may be either v3 or v4.")
+	outputFormat = flag.String("output_format", "",
+		"The format of the student notebook: 'ipynb' or 'py' (jupytext "+
+			"percent format). If empty, the format is chosen by the extension "+
+			"of --output, defaulting to ipynb.")
+	recordProvenance = flag.Bool("record_provenance", false,
+		"If true, each cell of the student notebook records the index, id "+
+			"and content hash of the master cell it was produced from in "+
+			"metadata.provenance. The upgrade command records the provenance "+
+			"unless --record_provenance=false is given.")
+	lintFormat = flag.String("lint_format", "text",
+		"The output format of the lint command: 'text' for one problem per line, "+
+			"or 'json' for a JSON list of objects with cell, severity and message fields.")
+	seed = flag.String("seed", "",
+		"The seed of the variant of exercise parameters in the student notebook, "+
+			"e.g. the user hash. If empty, the first value of each parameter is used. "+
+			"The upgrade command uses the seed of the --student notebook by default.")
+	student = flag.String("student", "",
+		"The file name of the student notebook to upgrade with the upgrade command. "+
+			"The student's answers are carried over into the student notebook "+
+			"produced from the new master notebook in --input.")
+	preserveUnknown = flag.Bool("preserve_unknown", true,
+		"If true, the fields of the input notebook and cells that are not "+
+			"understood by the assign tool (e.g. cell ids) are preserved in "+
+			"the student notebook.")
 )
 
 type commandDesc struct {
@@ -62,8 +120,12 @@ type commandDesc struct {
 
 var commands = map[string]commandDesc{
 	"parse":      commandDesc{"Try parsing the input", parseCommand},
+	"validate":   commandDesc{"Check the input against the nbformat schema", validateCommand},
+	"lint":       commandDesc{"Report all problems in the master notebook", lintCommand},
 	"student":    commandDesc{"Extract student notebook", studentCommand},
 	"autograder": commandDesc{"Extract autograder scripts", autograderCommand},
+	"solution":   commandDesc{"Extract solution notebook (answer key)", solutionCommand},
+	"upgrade":    commandDesc{"Upgrade student notebook to the new master", upgradeCommand},
 }
 
 func main() {
@@ -89,8 +151,88 @@ func run() error {
 	return cmd.Func()
 }
 
-func parseCommand() error {
+// readInput reads and parses the notebook specified by --input.
+// If --validate is enabled, it also checks the notebook against
+// the nbformat schema. The schema does not apply to jupytext files.
+func readInput() (*notebook.Notebook, error) {
+	if !*validate || notebook.IsPercentFile(*input) {
+		return notebook.ParseFile(*input)
+	}
+	b, err := ioutil.ReadFile(*input)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %q: %s", *input, err)
+	}
+	if errs := notebook.Validate(b); len(errs) > 0 {
+		return nil, fmt.Errorf("%q is not a valid notebook:\n%s", *input, errs)
+	}
+	// ParseFile records the file name to resolve # INCLUDE directives.
+	return notebook.ParseFile(*input)
+}
+
+func validateCommand() error {
+	b, err := ioutil.ReadFile(*input)
+	if err != nil {
+		return fmt.Errorf("error reading %q: %s", *input, err)
+	}
+	errs := notebook.Validate(b)
+	for _, err := range errs {
+		fmt.Printf("%s: %s\n", *input, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d problems found in %q", len(errs), *input)
+	}
+	return nil
+}
+
+func lintCommand() error {
+	var problems notebook.Problems
+	if !notebook.IsPercentFile(*input) {
+		b, err := ioutil.ReadFile(*input)
+		if err != nil {
+			return fmt.Errorf("error reading %q: %s", *input, err)
+		}
+		for _, err := range notebook.Validate(b) {
+			problems = append(problems, &notebook.Problem{
+				Cell:     err.Cell,
+				Severity: notebook.Error,
+				// Problem.String adds the cell index.
+				Message: fmt.Sprintf("%s (at %s, byte %d)", err.Message, err.Path, err.Offset),
+			})
+		}
+	}
+	// Schema violations may make the notebook unparseable,
+	// in which case they are the only problems reported.
 	n, err := notebook.ParseFile(*input)
+	if err == nil {
+		problems = append(problems, n.Lint()...)
+	} else if len(problems) == 0 {
+		return err
+	}
+	switch *lintFormat {
+	case "text":
+		for _, p := range problems {
+			fmt.Printf("%s: %s\n", *input, p)
+		}
+	case "json":
+		if problems == nil {
+			problems = notebook.Problems{}
+		}
+		b, err := json.MarshalIndent(problems, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", b)
+	default:
+		return fmt.Errorf("unsupported --lint_format %q, want text or json", *lintFormat)
+	}
+	if problems.HasErrors() {
+		return fmt.Errorf("errors found in %q", *input)
+	}
+	return nil
+}
+
+func parseCommand() error {
+	n, err := readInput()
 	if err != nil {
 		return err
 	}
@@ -103,68 +245,235 @@ func parseCommand() error {
 	return nil
 }
 
-func parseLanguage(l string) (notebook.Language, error) {
-	switch l {
-	case "ja":
-		return notebook.Japanese, nil
-	case "en":
-		return notebook.English, nil
-	case "":
-		return notebook.AnyLanguage, nil
-	default:
-		return notebook.AnyLanguage, fmt.Errorf("unknown language: %s", l)
+// parseLanguages parses the --language flag value. The master notebook
+// is used to expand 'all' into the list of languages it uses.
+func parseLanguages(value string, n *notebook.Notebook) ([]notebook.Language, error) {
+	if value == "all" {
+		ls := n.Languages()
+		if len(ls) == 0 {
+			return []notebook.Language{notebook.AnyLanguage}, nil
+		}
+		return ls, nil
+	}
+	var ret []notebook.Language
+	for _, tag := range strings.Split(value, ",") {
+		l, err := notebook.ParseLanguage(strings.TrimSpace(tag))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, l)
+	}
+	return ret, nil
+}
+
+// languageOutput returns the output file name for the given language.
+func languageOutput(output string, l notebook.Language) string {
+	if strings.Contains(output, "{lang}") {
+		return strings.Replace(output, "{lang}", l.String(), -1)
 	}
+	ext := filepath.Ext(output)
+	return strings.TrimSuffix(output, ext) + "-" + l.String() + ext
 }
 
 func studentCommand() error {
-	l, err := parseLanguage(*language)
+	n, err := readInput()
 	if err != nil {
 		return err
 	}
-	n, err := notebook.ParseFile(*input)
+	return forEachLanguage(n, writeStudent)
+}
+
+func solutionCommand() error {
+	n, err := readInput()
 	if err != nil {
 		return err
 	}
-	n, err = n.ToStudent(l, &notebook.StudentOptions{
-		InsertCheckCell:   *insertCheckCell,
-		CheckCellTemplate: *checkCellTemplate,
+	return forEachLanguage(n, func(n *notebook.Notebook, l notebook.Language, output string) error {
+		n, err := n.ToSolution(l)
+		if err != nil {
+			return err
+		}
+		return writeNotebook(n, output)
 	})
+}
+
+// forEachLanguage calls write for each of the languages in --language
+// with the output file name for the language.
+func forEachLanguage(n *notebook.Notebook, write func(n *notebook.Notebook, l notebook.Language, output string) error) error {
+	languages, err := parseLanguages(*language, n)
 	if err != nil {
 		return err
 	}
+	if len(languages) == 1 {
+		return write(n, languages[0], *output)
+	}
+	if *output == "" {
+		return fmt.Errorf("--output is required for multiple languages")
+	}
+	for _, l := range languages {
+		err := write(n, l, languageOutput(*output, l))
+		if err != nil {
+			return fmt.Errorf("language %s: %s", l, err)
+		}
+	}
+	return nil
+}
+
+// writeStudent converts the master notebook into the student notebook
+// in the given language and writes it to the output file, or to stdout
+// if output is empty.
+func writeStudent(n *notebook.Notebook, l notebook.Language, output string) error {
+	n, err := toStudent(n, l, *seed)
+	if err != nil {
+		return err
+	}
+	return writeNotebook(n, output)
+}
+
+// toStudent converts the master notebook into the student notebook
+// in the given language and variant with the --profile and --preamble.
+func toStudent(n *notebook.Notebook, l notebook.Language, seed string) (*notebook.Notebook, error) {
+	var source string
+	var metadata map[string]interface{} = nil
 	if *preamble != "" {
 		b, err := ioutil.ReadFile(*preamble)
 		if err != nil {
-			return fmt.Errorf("error reading --preamble %q: %w",
+			return nil, fmt.Errorf("error reading --preamble %q: %w",
 				*preamble, err)
 		}
-		var metadata map[string]interface{} = nil
+		source = string(b)
 		if *preambleMetadata != "" {
 			metadata = make(map[string]interface{})
 			err := json.Unmarshal([]byte(*preambleMetadata), &metadata)
 			if err != nil {
-				return fmt.Errorf("error parsing JSON from --preamble_metadata %q: %s",
+				return nil, fmt.Errorf("error parsing JSON from --preamble_metadata %q: %s",
 					*preambleMetadata, err)
 			}
 		}
+	}
+	options := &notebook.StudentOptions{
+		InsertCheckCell:   *insertCheckCell,
+		CheckCellTemplate: *checkCellTemplate,
+		RecordProvenance:  *recordProvenance,
+		Seed:              seed,
+	}
+	if *profile != "" {
+		p, err := notebook.LookupProfile(*profile)
+		if err != nil {
+			return nil, fmt.Errorf("bad --profile: %s", err)
+		}
+		p.ServerURL = *serverURL
+		if *preamble != "" {
+			p.Preamble, p.PreambleType, p.PreambleMetadata = source, "code", metadata
+		}
+		options.Profile = p
+	}
+	n, err := n.ToStudent(l, options)
+	if err != nil {
+		return nil, err
+	}
+	if *preamble != "" && *profile == "" {
 		// Prepend the preamble as a code cell.
 		n.Cells = append([]*notebook.Cell{
 			&notebook.Cell{
 				Type:     "code",
-				Source:   string(b),
+				Source:   source,
 				Metadata: metadata,
 			},
 		}, n.Cells...)
 	}
-	b, err := n.Marshal()
+	return n, nil
+}
+
+// writeNotebook writes the student or solution notebook in the format chosen by
+// --output_format to the output file, or to stdout if output is empty.
+func writeNotebook(n *notebook.Notebook, output string) error {
+	var err error
+	format := *outputFormat
+	if format == "" {
+		format = "ipynb"
+		if notebook.IsPercentFile(output) {
+			format = "py"
+		}
+	}
+	var b []byte
+	switch {
+	case format == "py":
+		b, err = n.MarshalPercent()
+	case format != "ipynb":
+		return fmt.Errorf("unsupported --output_format %q, want ipynb or py", format)
+	case *outputNBFormat == 4:
+		b, err = n.MarshalWithOptions(&notebook.MarshalOptions{
+			PreserveUnknown: *preserveUnknown,
+		})
+	case *outputNBFormat == 3:
+		b, err = n.MarshalV3()
+	default:
+		return fmt.Errorf("unsupported --output_nbformat %d, want 3 or 4", *outputNBFormat)
+	}
 	if err != nil {
 		return fmt.Errorf("error serializing notebook: %s", err)
 	}
-	if *output == "" {
+	if output == "" {
 		_, err := os.Stdout.Write(b)
 		return err
 	}
-	return ioutil.WriteFile(*output, b, 0775)
+	return ioutil.WriteFile(output, b, 0775)
+}
+
+// upgradeCommand produces the student notebook from the new master notebook
+// and carries over the answers from the --student notebook.
+func upgradeCommand() error {
+	if *student == "" {
+		return fmt.Errorf("--student is required for the upgrade command")
+	}
+	n, err := readInput()
+	if err != nil {
+		return err
+	}
+	old, err := notebook.ParseFile(*student)
+	if err != nil {
+		return err
+	}
+	if !flagPassed("record_provenance") {
+		// Record the provenance, so that the upgraded notebook can be
+		// upgraded again without carrying over the unedited cells.
+		*recordProvenance = true
+	}
+	variant := *seed
+	if variant == "" {
+		// Keep the variant of the student notebook.
+		variant, _ = old.Metadata[notebook.VariantSeedKey].(string)
+	}
+	return forEachLanguage(n, func(n *notebook.Notebook, l notebook.Language, output string) error {
+		upgraded, err := toStudent(n, l, variant)
+		if err != nil {
+			return err
+		}
+		report := notebook.CarryOverAnswers(upgraded, old)
+		for _, id := range report.Unmatched {
+			fmt.Fprintf(os.Stderr, "%s: exercise %s is not in the new master, the answer is dropped\n", *student, id)
+		}
+		for _, id := range report.Missing {
+			fmt.Fprintf(os.Stderr, "%s: exercise %s has no answer, it is left as in the new master\n", *student, id)
+		}
+		for _, id := range report.Unchanged {
+			fmt.Fprintf(os.Stderr, "%s: exercise %s was not edited, it is taken from the new master\n", *student, id)
+		}
+		return writeNotebook(upgraded, output)
+	})
+}
+
+// flagPassed returns true if the flag with the given name was given
+// on the command line.
+func flagPassed(name string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
 }
 
 var nilErr = errors.New("is nil")
@@ -180,8 +489,28 @@ func getString(v interface{}) (string, error) {
 	return s, nil
 }
 
+// autograderFilename returns the path of the autograder file relative to the
+// output directory: <assignment_id>/<exercise_id>/<filename> for the exercise
+// files, and <assignment_id>/<filename> for the assignment files such as
+// the manifest.
+func autograderFilename(assignmentID string, cell *notebook.Cell) (string, error) {
+	filename, ok := cell.Metadata["filename"].(string)
+	if !ok {
+		return "", fmt.Errorf("missing or incorrect filename metadata: %v", cell.Metadata["filename"])
+	}
+	v, ok := cell.Metadata["exercise_id"]
+	if !ok {
+		return filepath.Join(assignmentID, filename), nil
+	}
+	exerciseID, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("incorrect exercise_id metadata: %v", v)
+	}
+	return filepath.Join(assignmentID, exerciseID, filename), nil
+}
+
 func autograderCommand() error {
-	n, err := notebook.ParseFile(*input)
+	n, err := readInput()
 	if err != nil {
 		return err
 	}
@@ -197,10 +526,11 @@ func autograderCommand() error {
 	if *output == "" {
 		fmt.Print("## Dry run mode. Would generate the following files:\n\n")
 		for _, cell := range n.Cells {
-			exerciseID := cell.Metadata["exercise_id"].(string)
-			filename := cell.Metadata["filename"].(string)
-			source := cell.Source
-			fmt.Printf("-- %s/%s/%s:\n%s\n\n", assignmentID, exerciseID, filename, source)
+			filename, err := autograderFilename(assignmentID, cell)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("-- %s:\n%s\n\n", filename, cell.Source)
 		}
 		return nil
 	}
@@ -209,21 +539,19 @@ func autograderCommand() error {
 		return fmt.Errorf("could not create output directory %q: %s", *output, err)
 	}
 	for _, cell := range n.Cells {
-		source := cell.Source
-		filename, ok := cell.Metadata["filename"].(string)
-		if !ok {
-			return fmt.Errorf("missing or incorrect filename metadata: %v", filename)
-		}
-		exerciseID, ok := cell.Metadata["exercise_id"].(string)
-		if !ok {
-			return fmt.Errorf("missing or incorrect exercise_id metadata: %v", exerciseID)
+		filename, err := autograderFilename(assignmentID, cell)
+		if err != nil {
+			return err
 		}
-		dir := filepath.Join(*output, assignmentID, exerciseID)
-		err = os.MkdirAll(dir, 0775)
+		filename = filepath.Join(*output, filename)
+		err = os.MkdirAll(filepath.Dir(filename), 0775)
 		if err != nil {
 			return err
 		}
-		err = ioutil.WriteFile(filepath.Join(dir, filename), []byte(source), 0775)
+		err = ioutil.WriteFile(filename, []byte(cell.Source), 0775)
+		if err != nil {
+			return fmt.Errorf("error writing %q: %s", filename, err)
+		}
 	}
 	return nil
 }
@@ -53,7 +53,7 @@ func run() error {
 		part, err := w.CreateFormFile(*fileInputName, basename)
 		if err != nil {
 			return fmt.Errorf("multipart.Writer.CreateFormFile(%q, %q) returned error: %s",
-				*fileInputName, path.Base(*submissionNotebook))
+				*fileInputName, path.Base(*submissionNotebook), err)
 		}
 		_, err = part.Write(content)
 		if err != nil {
@@ -27,6 +27,10 @@ var (
 		"The root directory of autograder scripts.")
 	nsjailPath = flag.String("nsjail_path", "/usr/local/bin/nsjail",
 		"The path to nsjail binary.")
+	sandbox = flag.String("sandbox", "nsjail",
+		"The sandbox to run the tests in: nsjail, bubblewrap (bwrap in PATH) or "+
+			"subprocess. subprocess only applies resource limits and does not "+
+			"isolate the tests, so it is only meant for development.")
 	pythonPath = flag.String("python_path", "/usr/bin/python3",
 		"The path to python binary.")
 	scratchDir = flag.String("scratch_dir", "/tmp/autograde",
@@ -36,8 +40,14 @@ var (
 	autoRemove = flag.Bool("auto_remove", false,
 		"If true, removes the scratch directory before creating a new one. "+
 			"This is useful together with --disable_cleanup.")
+	parallelism = flag.Int("parallelism", 1,
+		"The maximum number of tests to run at the same time. If greater than 1, "+
+			"the exercises and test files of the submission are graded concurrently.")
 	submissionID = flag.String("submission_id", "dummy",
 		"The submission id.")
+	userHash = flag.String("user_hash", "",
+		"If not empty, the user hash to grade the submission as. The submissions "+
+			"with a different variant_seed in the metadata are rejected.")
 )
 
 func main() {
@@ -48,7 +58,9 @@ func main() {
 	}
 }
 
-func setSubmissionID(b []byte, id string) ([]byte, error) {
+// setMetadata sets the submission id and, if not empty, the user hash
+// in the notebook metadata.
+func setMetadata(b []byte, id, userHash string) ([]byte, error) {
 	data := make(map[string]interface{})
 	err := json.Unmarshal(b, &data)
 	if err != nil {
@@ -64,6 +76,9 @@ func setSubmissionID(b []byte, id string) ([]byte, error) {
 		return nil, fmt.Errorf("metadata is not a map, but %s", reflect.TypeOf(v))
 	}
 	metadata["submission_id"] = id
+	if userHash != "" {
+		metadata["user_hash"] = userHash
+	}
 	return json.Marshal(data)
 }
 
@@ -83,17 +98,23 @@ func run() error {
 	ag := autograder.New(dir)
 	ag.ScratchDir = *scratchDir
 	ag.NSJailPath = *nsjailPath
+	var err error
+	ag.Sandbox, err = autograder.NewSandbox(*sandbox, *nsjailPath)
+	if err != nil {
+		return err
+	}
 	ag.PythonPath = *pythonPath
 	ag.DisableCleanup = *disableCleanup
 	ag.AutoRemove = *autoRemove
+	ag.Parallelism = *parallelism
 	for _, filename := range flag.Args() {
 		b, err := ioutil.ReadFile(filename)
 		if err != nil {
 			return fmt.Errorf("error reading %q: %s", filename, err)
 		}
-		b, err = setSubmissionID(b, *submissionID)
+		b, err = setMetadata(b, *submissionID, *userHash)
 		if err != nil {
-			return fmt.Errorf("error setting submission_id: %s", err)
+			return fmt.Errorf("error setting metadata: %s", err)
 		}
 		report, err := ag.Grade(b)
 		if err != nil {
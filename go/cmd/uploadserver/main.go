@@ -19,6 +19,7 @@ import (
 	"cloud.google.com/go/storage"
 	"github.com/golang/glog"
 	"github.com/google/prog-edu-assistant/autograder"
+	"github.com/google/prog-edu-assistant/notebook"
 	"github.com/google/prog-edu-assistant/queue"
 	"github.com/google/prog-edu-assistant/uploadserver"
 	"golang.org/x/oauth2"
@@ -64,8 +65,15 @@ var (
 		"The root directory of autograder scripts. Used with --grade_locally.")
 	nsjailPath = flag.String("nsjail_path", "/usr/local/bin/nsjail",
 		"The path to nsjail binary. Used with --grade_locally.")
+	sandbox = flag.String("sandbox", "nsjail",
+		"The sandbox to run the tests in: nsjail, bubblewrap (bwrap in PATH) or "+
+			"subprocess. Used with --grade_locally.")
 	pythonPath = flag.String("python_path", "/usr/bin/python3",
 		"The path to python binary. Used with --grade_locally.")
+	parallelism = flag.Int("parallelism", 1,
+		"The maximum number of tests to run at the same time, across all "+
+			"submissions. If greater than 1, the exercises and test files of a "+
+			"submission are graded concurrently. Used with --grade_locally.")
 	scratchDir = flag.String("scratch_dir", "/tmp/autograde",
 		"The base directory to create scratch directories for autograding. "+
 			"Used with --grade_locally.")
@@ -85,6 +93,19 @@ var (
 			"in the environment variable LOG_BUCKET, "+
 			"and the GCP project ID should be provided in "+
 			"the environment variable GCP_PROJECT")
+	validateSubmissions = flag.Bool("validate_submissions", false,
+		"If true, uploaded notebooks are checked against the nbformat schema "+
+			"and rejected with a list of problems if they are not valid.")
+	scrubMaxOutputSize = flag.Int("scrub_max_output_size", 0,
+		"If positive, the cell outputs larger than this many bytes are removed "+
+			"from the uploaded notebooks before storing and grading.")
+	scrubWidgetState = flag.Bool("scrub_widget_state", false,
+		"If true, the Jupyter widget state is removed from the uploaded notebooks.")
+	scrubMetadata = flag.Bool("scrub_metadata", false,
+		"If true, the notebook and cell metadata not used for grading is removed "+
+			"from the uploaded notebooks.")
+	scrubExerciseCellsOnly = flag.Bool("scrub_exercise_cells_only", false,
+		"If true, only the cells with exercise_id are kept in the uploaded notebooks.")
 	useJWT = flag.Bool("use_jwt", true,
 		"If true, configures the server to support bearer authorization with JWT, "+
 			"as well as server handler to issue authorization tokens. If this is enabled, "+
@@ -158,14 +179,20 @@ func run() error {
 	var ch <-chan []byte
 	var ag *autograder.Autograder
 	if *gradeLocally {
+		sb, err := autograder.NewSandbox(*sandbox, *nsjailPath)
+		if err != nil {
+			return err
+		}
 		ag = &autograder.Autograder{
 			Dir:            *autograderDir,
 			ScratchDir:     *scratchDir,
 			NSJailPath:     *nsjailPath,
+			Sandbox:        sb,
 			PythonPath:     *pythonPath,
 			DisableCleanup: *disableCleanup,
 			AutoRemove:     *autoRemove,
 			IncludeLogs:    *includeLogsToReport,
+			Parallelism:    *parallelism,
 		}
 	} else {
 		// Connect to message queue if not grading locally.
@@ -212,7 +239,7 @@ func run() error {
 	if os.Getenv("SERVER_URL") != "" {
 		// Allow override from the environment.
 		serverURL = os.Getenv("SERVER_URL")
-		glog.Info("Environment provided override SERVER_URL=%s", serverURL)
+		glog.Infof("Environment provided override SERVER_URL=%s", serverURL)
 	}
 	var rsaKey *rsa.PrivateKey
 	if *useJWT {
@@ -257,6 +284,15 @@ func run() error {
 			return fmt.Errorf("error parsing key from %q: %s", jwtKey, err)
 		}
 	}
+	var scrubPolicy *notebook.ScrubPolicy
+	if *scrubMaxOutputSize > 0 || *scrubWidgetState || *scrubMetadata || *scrubExerciseCellsOnly {
+		scrubPolicy = &notebook.ScrubPolicy{
+			MaxOutputSize:       *scrubMaxOutputSize,
+			DropWidgetState:     *scrubWidgetState,
+			DropUnknownMetadata: *scrubMetadata,
+			ExerciseCellsOnly:   *scrubExerciseCellsOnly,
+		}
+	}
 	s := uploadserver.New(uploadserver.Options{
 		AllowCORS:        *allowCORS,
 		GradeLocally:     *gradeLocally,
@@ -288,6 +324,9 @@ func run() error {
 		ProjectID:        os.Getenv("GCP_PROJECT"),
 		UseJWT:           *useJWT,
 		PrivateKey:       rsaKey,
+		// Reject malformed notebooks early with an actionable message.
+		ValidateSubmissions: *validateSubmissions,
+		ScrubPolicy:         scrubPolicy,
 	})
 	if *gradeLocally {
 		fmt.Printf("\n  Serving on %s (grading locally)\n\n", serverURL)
@@ -38,8 +38,15 @@ var (
 		"The scratch directory, where one can write files.")
 	nsjailPath = flag.String("nsjail_path", "/usr/local/bin/nsjail",
 		"The path to nsjail binary.")
+	sandbox = flag.String("sandbox", "nsjail",
+		"The sandbox to run the tests in: nsjail, bubblewrap (bwrap in PATH) or "+
+			"subprocess. subprocess only applies resource limits and does not "+
+			"isolate the tests, so it is only meant for development.")
 	pythonPath = flag.String("python_path", "/usr/bin/python3",
 		"The path to python binary.")
+	parallelism = flag.Int("parallelism", 1,
+		"The maximum number of tests to run at the same time. If greater than 1, "+
+			"the exercises and test files of a submission are graded concurrently.")
 	disableCleanup = flag.Bool("disable_cleanup", false,
 		"If true, autograder will not delete scratch directory on success.")
 	autoRemove = flag.Bool("auto_remove", false,
@@ -66,10 +73,16 @@ func run() error {
 	*autograderDir = filepath.Clean(*autograderDir)
 	ag := autograder.New(*autograderDir)
 	ag.NSJailPath = *nsjailPath
+	var err error
+	ag.Sandbox, err = autograder.NewSandbox(*sandbox, *nsjailPath)
+	if err != nil {
+		return err
+	}
 	ag.PythonPath = *pythonPath
 	ag.ScratchDir = *scratchDir
 	ag.DisableCleanup = *disableCleanup
 	ag.AutoRemove = *autoRemove
+	ag.Parallelism = *parallelism
 	// Exponential backoff on connecting to the message queue.
 	delay := 500 * time.Millisecond
 	retryUntil := time.Now().Add(60 * time.Second)
@@ -0,0 +1,428 @@
+package notebook
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// mimeV3 maps the short output data keys used by nbformat v3
+// to the MIME types used by nbformat v4.
+var mimeV3 = map[string]string{
+	"text":       "text/plain",
+	"html":       "text/html",
+	"svg":        "image/svg+xml",
+	"png":        "image/png",
+	"jpeg":       "image/jpeg",
+	"latex":      "text/latex",
+	"json":       "application/json",
+	"javascript": "application/javascript",
+	"pdf":        "application/pdf",
+}
+
+// headingRegex matches a single-line markdown heading, which is converted
+// into a v3 heading cell on downgrade.
+var headingRegex = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+
+// UpgradeV3 converts a notebook in nbformat v3 layout (parsed JSON
+// with "worksheets") into the nbformat v4 layout. Cells of all worksheets
+// are concatenated, "input" and "prompt_number" of code cells become
+// "source" and "execution_count", heading cells become markdown cells,
+// and outputs are converted to v4 output types with MIME bundles.
+// The input map is not modified.
+func UpgradeV3(data map[string]interface{}) (map[string]interface{}, error) {
+	if v, _ := data["nbformat"].(float64); int(v) != 3 {
+		return nil, fmt.Errorf("cannot upgrade nbformat %v, want 3", data["nbformat"])
+	}
+	ret := make(map[string]interface{})
+	metadata := make(map[string]interface{})
+	if v, ok := data["metadata"]; ok {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("metadata is not a map but %s", reflect.TypeOf(v))
+		}
+		for k, v := range m {
+			metadata[k] = v
+		}
+	}
+	// The notebook name is defined by the file name in v4.
+	delete(metadata, "name")
+	delete(metadata, "signature")
+	if _, ok := metadata["orig_nbformat"]; !ok {
+		metadata["orig_nbformat"] = float64(3)
+	}
+	cells := []interface{}{}
+	if v, ok := data["worksheets"]; ok {
+		worksheets, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf(".worksheets is not a list but %s", reflect.TypeOf(v))
+		}
+		for i, x := range worksheets {
+			ws, ok := x.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("worksheet %d is not a map but %s", i, reflect.TypeOf(x))
+			}
+			wsCells, ok := ws["cells"].([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("worksheet %d: .cells is not a list but %s",
+					i, reflect.TypeOf(ws["cells"]))
+			}
+			for _, c := range wsCells {
+				cell, err := upgradeCellV3(c)
+				if err != nil {
+					return nil, fmt.Errorf("cell %d: %s", len(cells), err)
+				}
+				cells = append(cells, cell)
+			}
+		}
+	}
+	// Numbers are float64 for consistency with encoding/json.
+	ret["nbformat"] = float64(4)
+	ret["nbformat_minor"] = float64(0)
+	ret["metadata"] = metadata
+	ret["cells"] = cells
+	return ret, nil
+}
+
+// upgradeCellV3 converts one v3 cell into the v4 layout.
+func upgradeCellV3(x interface{}) (map[string]interface{}, error) {
+	cell, ok := x.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cell is not a map but %s", reflect.TypeOf(x))
+	}
+	metadata := make(map[string]interface{})
+	if m, ok := cell["metadata"].(map[string]interface{}); ok {
+		for k, v := range m {
+			metadata[k] = v
+		}
+	}
+	ret := map[string]interface{}{
+		"metadata": metadata,
+	}
+	cellType, _ := cell["cell_type"].(string)
+	switch cellType {
+	case "code":
+		ret["cell_type"] = "code"
+		ret["source"] = ""
+		if v, ok := cell["input"]; ok {
+			source, err := parseText(v)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing input: %s", err)
+			}
+			ret["source"] = source
+		}
+		if v, ok := cell["collapsed"]; ok {
+			metadata["collapsed"] = v
+		}
+		ret["execution_count"] = cell["prompt_number"]
+		outputs := []interface{}{}
+		if v, ok := cell["outputs"]; ok {
+			list, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("outputs is not a list but %s", reflect.TypeOf(v))
+			}
+			for i, o := range list {
+				output, err := upgradeOutputV3(o)
+				if err != nil {
+					return nil, fmt.Errorf("output %d: %s", i, err)
+				}
+				outputs = append(outputs, output)
+			}
+		}
+		ret["outputs"] = outputs
+	case "heading":
+		ret["cell_type"] = "markdown"
+		source, err := parseText(cell["source"])
+		if err != nil {
+			return nil, err
+		}
+		level := 1
+		if v, ok := cell["level"].(float64); ok && v >= 1 {
+			level = int(v)
+		}
+		ret["source"] = strings.Repeat("#", level) + " " +
+			strings.Join(strings.Split(source, "\n"), " ")
+	case "markdown", "raw":
+		ret["cell_type"] = cellType
+		ret["source"] = cell["source"]
+		if ret["source"] == nil {
+			ret["source"] = ""
+		}
+	default:
+		return nil, fmt.Errorf("unknown v3 cell_type %q", cellType)
+	}
+	return ret, nil
+}
+
+// upgradeOutputV3 converts one v3 output into the v4 layout.
+func upgradeOutputV3(x interface{}) (map[string]interface{}, error) {
+	output, ok := x.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("output is not a map but %s", reflect.TypeOf(x))
+	}
+	outputType, _ := output["output_type"].(string)
+	switch outputType {
+	case "pyout", "display_data":
+		data := make(map[string]interface{})
+		metadata := make(map[string]interface{})
+		for k, v := range output {
+			switch k {
+			case "output_type", "prompt_number":
+				continue
+			case "metadata":
+				if m, ok := v.(map[string]interface{}); ok {
+					for mk, mv := range m {
+						if mime, ok := mimeV3[mk]; ok {
+							mk = mime
+						}
+						metadata[mk] = mv
+					}
+				}
+				continue
+			}
+			mime, ok := mimeV3[k]
+			if !ok {
+				mime = k
+			}
+			if mime == "application/json" {
+				// JSON data is stored as a string in v3.
+				if s, ok := v.(string); ok {
+					var parsed interface{}
+					if err := json.Unmarshal([]byte(s), &parsed); err == nil {
+						v = parsed
+					}
+				}
+			}
+			data[mime] = v
+		}
+		ret := map[string]interface{}{
+			"output_type": DisplayDataOutput,
+			"data":        data,
+			"metadata":    metadata,
+		}
+		if outputType == "pyout" {
+			ret["output_type"] = ExecuteResultOutput
+			ret["execution_count"] = output["prompt_number"]
+		}
+		return ret, nil
+	case "stream":
+		name, _ := output["stream"].(string)
+		if name == "" {
+			name = "stdout"
+		}
+		text := output["text"]
+		if text == nil {
+			text = ""
+		}
+		return map[string]interface{}{
+			"output_type": StreamOutput,
+			"name":        name,
+			"text":        text,
+		}, nil
+	case "pyerr":
+		traceback := output["traceback"]
+		if traceback == nil {
+			traceback = []interface{}{}
+		}
+		return map[string]interface{}{
+			"output_type": ErrorOutput,
+			"ename":       output["ename"],
+			"evalue":      output["evalue"],
+			"traceback":   traceback,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown v3 output_type %q", outputType)
+}
+
+// DowngradeV4 converts a notebook in nbformat v4 layout (parsed JSON)
+// into the nbformat v3 layout with a single worksheet. Single-line
+// markdown headings become heading cells. Information that cannot be
+// represented in v3 (e.g. cell ids and attachments) is dropped.
+// The input map is not modified.
+func DowngradeV4(data map[string]interface{}) (map[string]interface{}, error) {
+	if v, _ := data["nbformat"].(float64); int(v) != 4 {
+		return nil, fmt.Errorf("cannot downgrade nbformat %v, want 4", data["nbformat"])
+	}
+	metadata := make(map[string]interface{})
+	if m, ok := data["metadata"].(map[string]interface{}); ok {
+		for k, v := range m {
+			metadata[k] = v
+		}
+	}
+	delete(metadata, "orig_nbformat")
+	if _, ok := metadata["name"]; !ok {
+		metadata["name"] = ""
+	}
+	cells := []interface{}{}
+	list, ok := data["cells"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf(".cells is not a list but %s", reflect.TypeOf(data["cells"]))
+	}
+	for i, x := range list {
+		cell, err := downgradeCellV4(x)
+		if err != nil {
+			return nil, fmt.Errorf("cell %d: %s", i, err)
+		}
+		cells = append(cells, cell)
+	}
+	return map[string]interface{}{
+		"nbformat":       3,
+		"nbformat_minor": 0,
+		"metadata":       metadata,
+		"worksheets": []interface{}{
+			map[string]interface{}{
+				"cells":    cells,
+				"metadata": map[string]interface{}{},
+			},
+		},
+	}, nil
+}
+
+// downgradeCellV4 converts one v4 cell into the v3 layout.
+func downgradeCellV4(x interface{}) (map[string]interface{}, error) {
+	cell, ok := x.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cell is not a map but %s", reflect.TypeOf(x))
+	}
+	metadata := make(map[string]interface{})
+	if m, ok := cell["metadata"].(map[string]interface{}); ok {
+		for k, v := range m {
+			metadata[k] = v
+		}
+	}
+	source, err := parseText(cell["source"])
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]interface{}{
+		"metadata": metadata,
+	}
+	cellType, _ := cell["cell_type"].(string)
+	switch cellType {
+	case "code":
+		ret["cell_type"] = "code"
+		ret["language"] = "python"
+		ret["input"] = marshalText(source)
+		ret["collapsed"] = false
+		if v, ok := metadata["collapsed"]; ok {
+			ret["collapsed"] = v
+			delete(metadata, "collapsed")
+		}
+		if v := cell["execution_count"]; v != nil {
+			ret["prompt_number"] = v
+		}
+		outputs := []interface{}{}
+		if list, ok := cell["outputs"].([]interface{}); ok {
+			for i, o := range list {
+				output, err := downgradeOutputV4(o)
+				if err != nil {
+					return nil, fmt.Errorf("output %d: %s", i, err)
+				}
+				outputs = append(outputs, output)
+			}
+		}
+		ret["outputs"] = outputs
+	case "markdown":
+		if m := headingRegex.FindStringSubmatch(source); m != nil && !strings.Contains(source, "\n") {
+			ret["cell_type"] = "heading"
+			ret["level"] = len(m[1])
+			ret["source"] = marshalText(m[2])
+			break
+		}
+		ret["cell_type"] = "markdown"
+		ret["source"] = marshalText(source)
+	case "raw":
+		ret["cell_type"] = "raw"
+		ret["source"] = marshalText(source)
+	default:
+		return nil, fmt.Errorf("unknown cell_type %q", cellType)
+	}
+	return ret, nil
+}
+
+// downgradeOutputV4 converts one v4 output into the v3 layout.
+func downgradeOutputV4(x interface{}) (map[string]interface{}, error) {
+	output, ok := x.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("output is not a map but %s", reflect.TypeOf(x))
+	}
+	shortKeys := make(map[string]string)
+	for short, mime := range mimeV3 {
+		shortKeys[mime] = short
+	}
+	outputType, _ := output["output_type"].(string)
+	switch outputType {
+	case DisplayDataOutput, ExecuteResultOutput:
+		ret := make(map[string]interface{})
+		if data, ok := output["data"].(map[string]interface{}); ok {
+			for mime, v := range data {
+				key, ok := shortKeys[mime]
+				if !ok {
+					key = mime
+				}
+				if mime == "application/json" {
+					b, err := json.Marshal(v)
+					if err != nil {
+						return nil, err
+					}
+					v = string(b)
+				}
+				ret[key] = v
+			}
+		}
+		metadata := make(map[string]interface{})
+		if m, ok := output["metadata"].(map[string]interface{}); ok {
+			for mime, v := range m {
+				key, ok := shortKeys[mime]
+				if !ok {
+					key = mime
+				}
+				metadata[key] = v
+			}
+		}
+		ret["metadata"] = metadata
+		ret["output_type"] = "display_data"
+		if outputType == ExecuteResultOutput {
+			ret["output_type"] = "pyout"
+			if v := output["execution_count"]; v != nil {
+				ret["prompt_number"] = v
+			}
+		}
+		return ret, nil
+	case StreamOutput:
+		return map[string]interface{}{
+			"output_type": "stream",
+			"stream":      output["name"],
+			"text":        output["text"],
+		}, nil
+	case ErrorOutput:
+		return map[string]interface{}{
+			"output_type": "pyerr",
+			"ename":       output["ename"],
+			"evalue":      output["evalue"],
+			"traceback":   output["traceback"],
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown output_type %q", outputType)
+}
+
+// MarshalV3 produces a JSON content in nbformat v3 layout,
+// for tools that cannot read nbformat v4.
+func (n *Notebook) MarshalV3() ([]byte, error) {
+	b, err := n.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]interface{})
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, err
+	}
+	v3, err := DowngradeV4(data)
+	if err != nil {
+		return nil, err
+	}
+	return marshalJSON(v3)
+}
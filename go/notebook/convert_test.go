@@ -0,0 +1,127 @@
+package notebook
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const v3Notebook = `{
+ "metadata": {"name": "hello", "kernelspec": {"name": "python3", "display_name": "Python 3"}},
+ "nbformat": 3,
+ "nbformat_minor": 0,
+ "worksheets": [
+  {
+   "cells": [
+    {"cell_type": "heading", "level": 2, "metadata": {}, "source": ["Hello"]},
+    {"cell_type": "markdown", "metadata": {}, "source": ["Some *text*\n", "more"]},
+    {"cell_type": "markdown", "metadata": {}, "source": ["#hashtag"]},
+    {
+     "cell_type": "code", "collapsed": false, "language": "python", "metadata": {"exercise_id": "ex1"},
+     "input": ["%%solution\n", "print(1)\n", "1 + 1"],
+     "outputs": [
+      {"output_type": "stream", "stream": "stdout", "text": ["1\n"]},
+      {"output_type": "pyout", "prompt_number": 3, "metadata": {}, "text": ["2"], "html": ["<b>2</b>"]},
+      {"output_type": "display_data", "metadata": {}, "png": "iVBORw0KGgo="},
+      {"output_type": "pyerr", "ename": "E", "evalue": "v", "traceback": ["tb"]},
+      {"output_type": "stream", "stream": "stderr"}
+     ],
+     "prompt_number": 3
+    }
+   ],
+   "metadata": {}
+  },
+  {
+   "cells": [
+    {"cell_type": "raw", "metadata": {}, "source": "raw text"}
+   ],
+   "metadata": {}
+  }
+ ]
+}`
+
+func TestParseV3(t *testing.T) {
+	n, err := Parse([]byte(v3Notebook))
+	if err != nil {
+		t.Fatalf("Parse(v3) returned error %s, want success", err)
+	}
+	if n.NBFormat != 4 {
+		t.Errorf("got nbformat %d, want 4", n.NBFormat)
+	}
+	if _, ok := n.Metadata["name"]; ok {
+		t.Errorf("v3 notebook name was not removed from metadata: %v", n.Metadata)
+	}
+	var gotTypes, gotSources []string
+	for _, cell := range n.Cells {
+		gotTypes = append(gotTypes, cell.Type)
+		gotSources = append(gotSources, cell.Source)
+	}
+	wantTypes := []string{"markdown", "markdown", "markdown", "code", "raw"}
+	wantSources := []string{"## Hello", "Some *text*\nmore", "#hashtag", "%%solution\nprint(1)\n1 + 1", "raw text"}
+	if !reflect.DeepEqual(gotTypes, wantTypes) {
+		t.Errorf("got cell types %q, want %q", gotTypes, wantTypes)
+	}
+	if !reflect.DeepEqual(gotSources, wantSources) {
+		t.Errorf("got cell sources %q, want %q", gotSources, wantSources)
+	}
+	code := n.Cells[3]
+	if code.ExecutionCount == nil || *code.ExecutionCount != 3 {
+		t.Errorf("got execution count %v, want 3", code.ExecutionCount)
+	}
+	if code.Metadata["exercise_id"] != "ex1" {
+		t.Errorf("got cell metadata %v, want exercise_id", code.Metadata)
+	}
+	var gotOutputs []string
+	for _, o := range code.Outputs {
+		gotOutputs = append(gotOutputs, o.Type)
+	}
+	wantOutputs := []string{StreamOutput, ExecuteResultOutput, DisplayDataOutput, ErrorOutput, StreamOutput}
+	if !reflect.DeepEqual(gotOutputs, wantOutputs) {
+		t.Fatalf("got outputs %q, want %q", gotOutputs, wantOutputs)
+	}
+	if got := code.Outputs[1].Data["text/html"]; got != "<b>2</b>" {
+		t.Errorf("got text/html %q, want <b>2</b>", got)
+	}
+	if got := code.Outputs[2].Data["image/png"]; got != "iVBORw0KGgo=" {
+		t.Errorf("got image/png %q, want iVBORw0KGgo=", got)
+	}
+	if got := code.Outputs[4]; got.Name != "stderr" || got.Text != "" {
+		t.Errorf("got stream %q with text %q, want stderr with no text", got.Name, got.Text)
+	}
+}
+
+func TestDowngradeUpgrade(t *testing.T) {
+	n, err := Parse([]byte(v3Notebook))
+	if err != nil {
+		t.Fatalf("Parse(v3) returned error %s, want success", err)
+	}
+	want, err := n.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() returned error %s", err)
+	}
+	b, err := n.MarshalV3()
+	if err != nil {
+		t.Fatalf("MarshalV3() returned error %s", err)
+	}
+	if errs := Validate(b); len(errs) > 0 {
+		t.Errorf("MarshalV3() produced invalid notebook:\n%s", errs)
+	}
+	n2, err := Parse(b)
+	if err != nil {
+		t.Fatalf("Parse(MarshalV3()) returned error %s", err)
+	}
+	got, err := n2.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() returned error %s", err)
+	}
+	var wantData, gotData interface{}
+	if err := json.Unmarshal(want, &wantData); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(got, &gotData); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotData, wantData) {
+		t.Errorf("downgrade and upgrade changed the notebook:\ngot  %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,128 @@
+package notebook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A line "# INCLUDE path" in a code cell of the master notebook is replaced
+// with the contents of the file, so that the shared helper code does not need
+// to be copied into every master notebook. Relative paths are resolved
+// against the directory of the master notebook file, and the paths in the
+// included files against the directory of the including file. The included
+// lines keep the indentation of the # INCLUDE line.
+
+// includeRegex matches the # INCLUDE directive on a line.
+var includeRegex = regexp.MustCompile(`^([ \t]*)# INCLUDE[ \t]+(\S(?:.*\S)?)[ \t]*$`)
+
+// expandIncludes replaces the # INCLUDE lines in source with the contents of
+// the included files, resolved relative to dir. The stack holds the absolute
+// paths of the files being included, to detect include cycles.
+func expandIncludes(source, dir string, stack []string) (string, error) {
+	if !strings.Contains(source, "# INCLUDE") {
+		return source, nil
+	}
+	lines := strings.Split(source, "\n")
+	for i, line := range lines {
+		m := includeRegex.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		indent, filename := m[1], m[2]
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(dir, filename)
+		}
+		path, err := filepath.Abs(filename)
+		if err != nil {
+			return "", fmt.Errorf("error resolving # INCLUDE %s: %s", m[2], err)
+		}
+		for j, p := range stack {
+			if p == path {
+				return "", fmt.Errorf("# INCLUDE cycle: %s", strings.Join(append(stack[j:len(stack):len(stack)], path), " -> "))
+			}
+		}
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			if len(stack) > 0 {
+				return "", fmt.Errorf("# INCLUDE %s: file %q not found, included from %q", m[2], path, stack[len(stack)-1])
+			}
+			return "", fmt.Errorf("# INCLUDE %s: file %q not found", m[2], path)
+		}
+		if err != nil {
+			return "", fmt.Errorf("# INCLUDE %s: error reading %q: %s", m[2], path, err)
+		}
+		text, err := expandIncludes(strings.TrimRight(string(b), "\n"), filepath.Dir(path),
+			append(stack[:len(stack):len(stack)], path))
+		if err != nil {
+			return "", err
+		}
+		included := strings.Split(text, "\n")
+		for k, l := range included {
+			if l != "" {
+				included[k] = indent + l
+			}
+		}
+		lines[i] = strings.Join(included, "\n")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// includeDir returns the directory against which the # INCLUDE paths are
+// resolved: the directory of the notebook file, or the current directory
+// if the notebook was not read from a file.
+func (n *Notebook) includeDir() string {
+	if n.path == "" {
+		return ""
+	}
+	return filepath.Dir(n.path)
+}
+
+// withIncludes returns the notebook with the # INCLUDE directives in code
+// cells expanded. The cells are in one-to-one correspondence with the
+// original notebook.
+func (n *Notebook) withIncludes() (*Notebook, error) {
+	ret, errs := n.expandAllIncludes()
+	for i := range n.Cells {
+		if err, ok := errs[i]; ok {
+			return nil, fmt.Errorf("cell %d: %s", i, err)
+		}
+	}
+	return ret, nil
+}
+
+// expandAllIncludes is withIncludes that does not stop at the first error.
+// The cells with errors are kept as is, and the errors are returned keyed
+// by the cell index.
+func (n *Notebook) expandAllIncludes() (*Notebook, map[int]error) {
+	var ret *Notebook
+	errs := make(map[int]error)
+	for i, cell := range n.Cells {
+		if cell.Type != "code" {
+			continue
+		}
+		source, err := expandIncludes(cell.Source, n.includeDir(), nil)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if source == cell.Source {
+			continue
+		}
+		if ret == nil {
+			copied := *n
+			copied.Cells = append([]*Cell(nil), n.Cells...)
+			ret = &copied
+		}
+		c := *cell
+		c.Source = source
+		ret.Cells[i] = &c
+	}
+	if ret == nil {
+		return n, errs
+	}
+	return ret, errs
+}
@@ -0,0 +1,119 @@
+package notebook
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates the files with the given contents in a temporary
+// directory and returns the directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "include_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"shared/helpers.py": "# INCLUDE ../common.py\ndef helper():\n  return 1\n",
+		"common.py":         "import math\n",
+		"cycle/a.py":        "# INCLUDE b.py\n",
+		"cycle/b.py":        "# INCLUDE a.py\n",
+	})
+	defer os.RemoveAll(dir)
+	master := taggedNotebook([]string{
+		"```\n# ASSIGNMENT METADATA\nassignment_id: a1\n```",
+		"# GLOBAL CONTEXT\n# INCLUDE shared/helpers.py",
+		"```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+		"%%solution\nx = helper()",
+		"%%inlinetest Test1\nif True:\n  # INCLUDE common.py\nassert x == 1",
+	}, make([][]interface{}, 5))
+	master.path = filepath.Join(dir, "master.ipynb")
+	student, err := master.ToStudent(AnyLanguage, nil)
+	if err != nil {
+		t.Fatalf("ToStudent() returned error %s", err)
+	}
+	want := []string{"import math\ndef helper():\n  return 1", "..."}
+	if !reflect.DeepEqual(sources(student), want) {
+		t.Errorf("ToStudent() = %q, want %q", sources(student), want)
+	}
+	autograder, err := master.ToAutograder()
+	if err != nil {
+		t.Fatalf("ToAutograder() returned error %s", err)
+	}
+	for _, cell := range autograder.Cells {
+		switch cell.Metadata["filename"] {
+		case "Test1_context.py":
+			if want := "# GLOBAL CONTEXT\nimport math\ndef helper():\n  return 1\n"; cell.Source != want {
+				t.Errorf("Test1_context.py = %q, want %q", cell.Source, want)
+			}
+		case "Test1_inline.py":
+			if want := "if True:\n  import math\nassert x == 1\n"; cell.Source != want {
+				t.Errorf("Test1_inline.py = %q, want %q", cell.Source, want)
+			}
+		}
+	}
+	if master.Cells[1].Source != "# GLOBAL CONTEXT\n# INCLUDE shared/helpers.py" {
+		t.Errorf("ToStudent() modified the master cell: %q", master.Cells[1].Source)
+	}
+
+	tests := []struct {
+		name    string
+		include string
+		want    string
+	}{
+		{"Missing", "missing.py", "not found"},
+		{"MissingNested", "shared/nested.py", "included from"},
+		{"Cycle", "cycle/a.py", "a.py -> " + filepath.Join(dir, "cycle", "b.py") + " -> "},
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "shared/nested.py"), []byte("# INCLUDE nothing.py"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The problems inside the included code are found by Lint.
+	if err := ioutil.WriteFile(filepath.Join(dir, "shared/unbalanced.py"), []byte("# BEGIN SOLUTION\nx = 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	n := taggedNotebook([]string{
+		"```\n# ASSIGNMENT METADATA\nassignment_id: a1\n```",
+		"```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+		"%%solution\n# INCLUDE shared/unbalanced.py",
+	}, make([][]interface{}, 3))
+	n.path = filepath.Join(dir, "master.ipynb")
+	problems := n.Lint()
+	if len(problems) != 1 || problems[0].Cell != 2 || !strings.Contains(problems[0].Message, "SOLUTION") {
+		t.Errorf("Lint() of unbalanced included code = %v, want a SOLUTION error in cell 2", problems)
+	}
+	for _, tt := range tests {
+		n := taggedNotebook([]string{"# INCLUDE " + tt.include}, make([][]interface{}, 1))
+		n.path = filepath.Join(dir, "master.ipynb")
+		_, err := n.ToStudent(AnyLanguage, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: ToStudent() returned error %v, want error containing %q", tt.name, err, tt.want)
+		}
+		problems := n.Lint()
+		found := false
+		for _, p := range problems {
+			if p.Severity == Error && strings.Contains(p.Message, tt.want) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: Lint() = %v, want an error containing %q", tt.name, problems, tt.want)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package notebook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// This file implements the jupytext "percent" format, where a notebook is
+// represented as a plain Python file:
+//
+//   # ---
+//   # jupyter:
+//   #   kernelspec:
+//   #     name: python3
+//   # ---
+//
+//   # %% [markdown]
+//   # # Title
+//
+//   # %% tags=["solution"]
+//   x = 1
+//
+// Markdown and raw cells are commented out line by line, code cells are
+// written as is, except that IPython magics and shell commands (lines
+// starting with % or !) are commented out so that the file remains valid
+// Python. Only the cell magics, the known line magics and the known shell
+// commands are treated so, other comments like "# %s is the format" are kept.
+// The lines of any cell that would read as a cell marker, e.g. a "# %%"
+// comment in code, are escaped with one more comment prefix, as jupytext does.
+
+var (
+	// percentMarkerRegex matches the cell marker line. The capture group
+	// holds the cell options: title, cell type in brackets and metadata.
+	percentMarkerRegex = regexp.MustCompile(`^# %%(?:[ \t]+(.*?))?[ \t]*$`)
+	// percentTypeRegex matches the cell type in the marker options.
+	percentTypeRegex = regexp.MustCompile(`^(.*?)[ \t]*\[(markdown|md|raw)\][ \t]*(.*)$`)
+	// percentKeyRegex matches the beginning of a key=value metadata pair.
+	percentKeyRegex = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_.-]*)=`)
+	// magicRegex matches the lines that look like IPython magics or shell
+	// commands, possibly already escaped with comments. The groups are
+	// the indentation, the comment prefixes, the magic prefix and the name.
+	magicRegex = regexp.MustCompile(`^([ \t]*)((?:# ?)*)(%%|%|!)([a-zA-Z_][a-zA-Z0-9_-]*)(?:[ \t]|$)`)
+)
+
+// lineMagics are the names of IPython line magics, including the ones
+// defined by prog_edu_assistant_tools.
+var lineMagics = map[string]bool{
+	"aimport": true, "alias": true, "autoawait": true, "autocall": true,
+	"automagic": true, "autoreload": true, "autosave": true, "autotest": true,
+	"bookmark": true, "capture": true, "cd": true, "colors": true,
+	"conda": true, "config": true, "debug": true, "dhist": true, "dirs": true,
+	"doctest_mode": true, "edit": true, "env": true, "gui": true,
+	"history": true, "load": true, "load_ext": true, "loadpy": true,
+	"logstart": true, "logstop": true, "ls": true, "lsmagic": true,
+	"macro": true, "magic": true, "matplotlib": true, "mkdir": true,
+	"notebook": true, "page": true, "pdb": true, "pdef": true, "pdoc": true,
+	"pfile": true, "pinfo": true, "pinfo2": true, "pip": true, "popd": true,
+	"pprint": true, "precision": true, "prun": true, "psearch": true,
+	"psource": true, "pushd": true, "pwd": true, "pycat": true, "pylab": true,
+	"quickref": true, "recall": true, "rehashx": true, "reload_ext": true,
+	"rerun": true, "reset": true, "reset_selective": true, "rm": true,
+	"rmdir": true, "run": true, "save": true, "sc": true, "set_env": true,
+	"store": true, "sx": true, "system": true, "tb": true,
+	"tensorflow_version": true, "time": true, "timeit": true, "unalias": true,
+	"unload_ext": true, "who": true, "who_ls": true, "whos": true,
+	"xdel": true, "xmode": true,
+}
+
+// shellCommands are the commands commonly run with ! in notebooks.
+var shellCommands = map[string]bool{
+	"apt": true, "apt-get": true, "cat": true, "cd": true, "chmod": true,
+	"conda": true, "cp": true, "curl": true, "df": true, "du": true,
+	"echo": true, "find": true, "gdown": true, "git": true, "grep": true,
+	"gunzip": true, "head": true, "jupyter": true, "kaggle": true, "ls": true,
+	"mkdir": true, "mv": true, "nvidia-smi": true, "pip": true, "pip3": true,
+	"pwd": true, "python": true, "python3": true, "rm": true, "sed": true,
+	"sh": true, "tail": true, "tar": true, "unzip": true, "wc": true,
+	"wget": true, "which": true,
+}
+
+// magicPrefix returns the position of the comment prefixes in the line if the
+// line is an IPython magic or shell command, possibly escaped with comments,
+// and -1 otherwise.
+func magicPrefix(line string) int {
+	m := magicRegex.FindStringSubmatchIndex(line)
+	if m == nil {
+		return -1
+	}
+	name := line[m[8]:m[9]]
+	switch line[m[6]:m[7]] {
+	case "%%":
+		// Any cell magic, e.g. %%solution.
+	case "%":
+		if !lineMagics[name] {
+			return -1
+		}
+	case "!":
+		if !shellCommands[name] {
+			return -1
+		}
+	}
+	return m[4]
+}
+
+// markerDepth returns the number of comment prefixes "# " before a cell
+// marker in the line, or -1 if the line is not a cell marker, escaped or not.
+func markerDepth(line string) int {
+	for n := 0; ; n++ {
+		if percentMarkerRegex.MatchString(line) {
+			return n
+		}
+		if !strings.HasPrefix(line, "# ") {
+			return -1
+		}
+		line = line[2:]
+	}
+}
+
+// IsPercentFile returns true if the file name designates a notebook
+// in jupytext percent format.
+func IsPercentFile(filename string) bool {
+	return strings.HasSuffix(filename, ".py")
+}
+
+// yamlToJSON converts the values produced by yaml.Unmarshal into the
+// values that encoding/json would produce for the same data.
+func yamlToJSON(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{})
+		for k, v := range x {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("map key %v is not a string but %s, quote it in YAML", k, reflect.TypeOf(k))
+			}
+			val, err := yamlToJSON(v)
+			if err != nil {
+				return nil, err
+			}
+			ret[key] = val
+		}
+		return ret, nil
+	case []interface{}:
+		var ret []interface{}
+		for _, v := range x {
+			val, err := yamlToJSON(v)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, val)
+		}
+		return ret, nil
+	case int:
+		return float64(x), nil
+	}
+	return v, nil
+}
+
+// uncommentLine removes the comment prefix "# " or "#" from a line.
+func uncommentLine(line string) string {
+	if strings.HasPrefix(line, "# ") {
+		return line[2:]
+	}
+	return strings.TrimPrefix(line, "#")
+}
+
+// commentLine adds a comment prefix to a line.
+func commentLine(line string) string {
+	if line == "" {
+		return "#"
+	}
+	return "# " + line
+}
+
+// parsePercentOptions parses the part of the cell marker after "# %%",
+// which consists of an optional title, an optional cell type in brackets
+// and a list of key=value metadata pairs with JSON values.
+func parsePercentOptions(options string) (cellType string, metadata map[string]interface{}, err error) {
+	cellType = "code"
+	metadata = make(map[string]interface{})
+	var title string
+	if m := percentTypeRegex.FindStringSubmatch(options); m != nil {
+		title = m[1]
+		cellType = m[2]
+		if cellType == "md" {
+			cellType = "markdown"
+		}
+		options = m[3]
+	} else {
+		// Metadata starts with the first key=value pair, the rest is the title.
+		options = strings.TrimSpace(options)
+		pos := 0
+		for pos < len(options) && !percentKeyRegex.MatchString(options[pos:]) {
+			next := strings.IndexAny(options[pos:], " \t")
+			if next < 0 {
+				pos = len(options)
+				break
+			}
+			pos += next + 1
+		}
+		title = strings.TrimSpace(options[:pos])
+		options = options[pos:]
+	}
+	for options = strings.TrimSpace(options); options != ""; options = strings.TrimSpace(options) {
+		m := percentKeyRegex.FindStringSubmatch(options)
+		if m == nil {
+			return "", nil, fmt.Errorf("cannot parse cell metadata %q", options)
+		}
+		options = options[len(m[0]):]
+		dec := json.NewDecoder(strings.NewReader(options))
+		var value interface{}
+		err = dec.Decode(&value)
+		if err != nil {
+			return "", nil, fmt.Errorf("cannot parse the value of cell metadata %q: %s", m[1], err)
+		}
+		metadata[m[1]] = value
+		options = options[dec.InputOffset():]
+	}
+	if title != "" {
+		metadata["title"] = title
+	}
+	return cellType, metadata, nil
+}
+
+// newPercentCell creates a cell from the lines collected under one marker.
+func newPercentCell(cellType string, metadata map[string]interface{}, lines []string) *Cell {
+	// The blank line before the next cell marker is a separator.
+	if len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		if markerDepth(line) > 0 {
+			// Remove the escape added by the writer.
+			line = line[2:]
+		}
+		if cellType == "code" {
+			// Remove one level of comments added by the writer.
+			if pos := magicPrefix(line); pos >= 0 && strings.HasPrefix(line[pos:], "# ") {
+				line = line[:pos] + line[pos+2:]
+			}
+			lines[i] = line
+		} else {
+			lines[i] = uncommentLine(line)
+		}
+	}
+	cell := &Cell{
+		Type:   cellType,
+		Source: strings.Join(lines, "\n"),
+	}
+	if len(metadata) > 0 {
+		cell.Metadata = metadata
+	}
+	return cell
+}
+
+// ParsePercent parses a notebook in jupytext percent format.
+func ParsePercent(b []byte) (*Notebook, error) {
+	text := strings.ReplaceAll(string(b), "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+	ret := &Notebook{
+		NBFormat:      4,
+		NBFormatMinor: 4,
+		Metadata:      make(map[string]interface{}),
+	}
+	pos := 0
+	// Skip the leading blank lines.
+	for pos < len(lines) && strings.TrimSpace(lines[pos]) == "" {
+		pos++
+	}
+	if pos < len(lines) && lines[pos] == "# ---" {
+		end := pos + 1
+		for end < len(lines) && lines[end] != "# ---" {
+			end++
+		}
+		if end == len(lines) {
+			return nil, fmt.Errorf("line %d: header is not terminated with '# ---'", pos+1)
+		}
+		var header []string
+		for _, line := range lines[pos+1 : end] {
+			header = append(header, uncommentLine(line))
+		}
+		var data map[interface{}]interface{}
+		err := yaml.Unmarshal([]byte(strings.Join(header, "\n")), &data)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: error parsing header: %s", pos+1, err)
+		}
+		if v, ok := data["jupyter"]; ok {
+			jupyter, err := yamlToJSON(v)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing header: %s", err)
+			}
+			metadata, ok := jupyter.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("header jupyter is not a map but %s", reflect.TypeOf(jupyter))
+			}
+			if v, ok := metadata["nbformat"].(float64); ok {
+				ret.NBFormat = int(v)
+				delete(metadata, "nbformat")
+			}
+			if v, ok := metadata["nbformat_minor"].(float64); ok {
+				ret.NBFormatMinor = int(v)
+				delete(metadata, "nbformat_minor")
+			}
+			ret.Metadata = metadata
+		}
+		pos = end + 1
+	}
+	cellType := "code"
+	var metadata map[string]interface{}
+	var cellLines []string
+	started := false
+	for i := pos; i < len(lines); i++ {
+		line := lines[i]
+		m := percentMarkerRegex.FindStringSubmatch(line)
+		if m == nil {
+			cellLines = append(cellLines, line)
+			continue
+		}
+		if started || strings.TrimSpace(strings.Join(cellLines, "")) != "" {
+			// The text before the first marker forms a code cell, if not empty.
+			ret.Cells = append(ret.Cells, newPercentCell(cellType, metadata, cellLines))
+		}
+		var err error
+		cellType, metadata, err = parsePercentOptions(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		cellLines = nil
+		started = true
+	}
+	if started || strings.TrimSpace(strings.Join(cellLines, "")) != "" {
+		ret.Cells = append(ret.Cells, newPercentCell(cellType, metadata, cellLines))
+	}
+	return ret, nil
+}
+
+// formatPercentOptions formats the cell marker line for a cell.
+func formatPercentOptions(cell *Cell) (string, error) {
+	parts := []string{"# %%"}
+	if title, ok := cell.Metadata["title"].(string); ok && title != "" {
+		parts = append(parts, title)
+	}
+	switch cell.Type {
+	case "markdown", "raw":
+		parts = append(parts, "["+cell.Type+"]")
+	}
+	var keys []string
+	for k := range cell.Metadata {
+		if k == "title" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b, err := json.Marshal(cell.Metadata[k])
+		if err != nil {
+			return "", fmt.Errorf("error serializing cell metadata %q: %s", k, err)
+		}
+		parts = append(parts, k+"="+string(b))
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// MarshalPercent produces the notebook in jupytext percent format.
+// Cell outputs are not represented in this format and are dropped.
+func (n *Notebook) MarshalPercent() ([]byte, error) {
+	var buf bytes.Buffer
+	header := make(map[string]interface{})
+	for k, v := range n.Metadata {
+		header[k] = v
+	}
+	if n.NBFormat != 4 || n.NBFormatMinor != 4 {
+		header["nbformat"] = n.NBFormat
+		header["nbformat_minor"] = n.NBFormatMinor
+	}
+	if len(header) > 0 {
+		b, err := yaml.Marshal(map[string]interface{}{"jupyter": header})
+		if err != nil {
+			return nil, fmt.Errorf("error serializing header: %s", err)
+		}
+		buf.WriteString("# ---\n")
+		for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+			buf.WriteString(commentLine(line) + "\n")
+		}
+		buf.WriteString("# ---\n\n")
+	}
+	for i, cell := range n.Cells {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		marker, err := formatPercentOptions(cell)
+		if err != nil {
+			return nil, fmt.Errorf("cell %d: %s", i, err)
+		}
+		buf.WriteString(marker + "\n")
+		if cell.Source == "" {
+			continue
+		}
+		for _, line := range strings.Split(cell.Source, "\n") {
+			if cell.Type == "code" {
+				if pos := magicPrefix(line); pos >= 0 {
+					line = line[:pos] + "# " + line[pos:]
+				}
+			} else {
+				line = commentLine(line)
+			}
+			if markerDepth(line) >= 0 {
+				line = "# " + line
+			}
+			buf.WriteString(line + "\n")
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,187 @@
+package notebook
+
+import (
+	"reflect"
+	"testing"
+)
+
+const percentNotebook = `# ---
+# jupyter:
+#   kernelspec:
+#     display_name: Python 3
+#     name: python3
+# ---
+
+# %% [markdown]
+# # Title
+#
+# ` + "```" + `
+# exercise_id: ex1
+# ` + "```" + `
+
+# %% exercise_id="ex1" tags=["solution"]
+# %%solution
+def f(x):
+    """ # BEGIN PROMPT
+    pass
+    """ # END PROMPT
+    # BEGIN SOLUTION
+    return x
+    # END SOLUTION
+
+# %% Tests [raw]
+# raw text
+
+# %%
+# # %%inlinetest
+# !ls
+`
+
+func TestParsePercent(t *testing.T) {
+	n, err := ParsePercent([]byte(percentNotebook))
+	if err != nil {
+		t.Fatalf("ParsePercent() returned error %s, want success", err)
+	}
+	wantMetadata := map[string]interface{}{
+		"kernelspec": map[string]interface{}{
+			"display_name": "Python 3",
+			"name":         "python3",
+		},
+	}
+	if !reflect.DeepEqual(n.Metadata, wantMetadata) {
+		t.Errorf("got metadata %v, want %v", n.Metadata, wantMetadata)
+	}
+	want := []*Cell{
+		{
+			Type:   "markdown",
+			Source: "# Title\n\n```\nexercise_id: ex1\n```",
+		},
+		{
+			Type: "code",
+			Metadata: map[string]interface{}{
+				"exercise_id": "ex1",
+				"tags":        []interface{}{"solution"},
+			},
+			Source: "%%solution\ndef f(x):\n    \"\"\" # BEGIN PROMPT\n    pass\n    \"\"\" # END PROMPT\n" +
+				"    # BEGIN SOLUTION\n    return x\n    # END SOLUTION",
+		},
+		{
+			Type:     "raw",
+			Metadata: map[string]interface{}{"title": "Tests"},
+			Source:   "raw text",
+		},
+		{
+			Type:   "code",
+			Source: "# %%inlinetest\n!ls",
+		},
+	}
+	if len(n.Cells) != len(want) {
+		t.Fatalf("got %d cells, want %d", len(n.Cells), len(want))
+	}
+	for i, cell := range n.Cells {
+		if !reflect.DeepEqual(cell, want[i]) {
+			t.Errorf("cell %d: got %#v, want %#v", i, cell, want[i])
+		}
+	}
+	// The student notebook can be produced from the parsed master.
+	if _, err := n.ToStudent(AnyLanguage, nil); err != nil {
+		t.Errorf("ToStudent() returned error %s", err)
+	}
+}
+
+func TestMarshalPercent(t *testing.T) {
+	n, err := ParsePercent([]byte(percentNotebook))
+	if err != nil {
+		t.Fatalf("ParsePercent() returned error %s, want success", err)
+	}
+	b, err := n.MarshalPercent()
+	if err != nil {
+		t.Fatalf("MarshalPercent() returned error %s", err)
+	}
+	if string(b) != percentNotebook {
+		t.Errorf("MarshalPercent() changed the notebook:\ngot\n%s\nwant\n%s", b, percentNotebook)
+	}
+}
+
+func TestParsePercentErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"UnterminatedHeader", "# ---\n# jupyter:\n\n# %%\nx = 1\n"},
+		{"BadMetadata", "# %% tags=[\"a\"\nx = 1\n"},
+		{"NotKeyValue", "# %% [markdown] tags=[] stray\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePercent([]byte(tt.input))
+			if err == nil {
+				t.Errorf("ParsePercent(%q) returned success, want error", tt.input)
+			}
+		})
+	}
+}
+
+func TestPercentComments(t *testing.T) {
+	// Comments that only look like magics must stay comments.
+	input := `# %%
+# %s is the format
+# !important
+# %matplotlib inline
+# !pip install numpy
+print("%d" % 1)
+`
+	wantSource := `# %s is the format
+# !important
+%matplotlib inline
+!pip install numpy
+print("%d" % 1)`
+	n, err := ParsePercent([]byte(input))
+	if err != nil {
+		t.Fatalf("ParsePercent() returned error %s, want success", err)
+	}
+	if len(n.Cells) != 1 {
+		t.Fatalf("ParsePercent() returned %d cells, want 1", len(n.Cells))
+	}
+	if n.Cells[0].Source != wantSource {
+		t.Errorf("ParsePercent() cell source\n%s\nwant\n%s", n.Cells[0].Source, wantSource)
+	}
+	b, err := n.MarshalPercent()
+	if err != nil {
+		t.Fatalf("MarshalPercent() returned error %s", err)
+	}
+	if string(b) != input {
+		t.Errorf("MarshalPercent() changed the notebook:\ngot\n%s\nwant\n%s", b, input)
+	}
+}
+
+func TestPercentRoundTrip(t *testing.T) {
+	n := &Notebook{
+		NBFormat:      4,
+		NBFormatMinor: 4,
+		Metadata:      map[string]interface{}{},
+		Cells: []*Cell{
+			{Type: "markdown", Source: "%% is not a magic here\n# %% [markdown]\n\n"},
+			{Type: "code", Source: "x = 1\n# %%\ny = 2\n# # %% [markdown]\n\n"},
+			{Type: "code", Source: ""},
+			{Type: "code", Source: "\n"},
+			{Type: "raw", Source: "%%\ntext\n"},
+		},
+	}
+	b, err := n.MarshalPercent()
+	if err != nil {
+		t.Fatalf("MarshalPercent() returned error %s", err)
+	}
+	got, err := ParsePercent(b)
+	if err != nil {
+		t.Fatalf("ParsePercent() returned error %s, want success", err)
+	}
+	if len(got.Cells) != len(n.Cells) {
+		t.Fatalf("ParsePercent(MarshalPercent()) returned %d cells, want %d:\n%s", len(got.Cells), len(n.Cells), b)
+	}
+	for i, cell := range got.Cells {
+		if cell.Type != n.Cells[i].Type || cell.Source != n.Cells[i].Source {
+			t.Errorf("cell %d: got %s %q, want %s %q", i, cell.Type, cell.Source, n.Cells[i].Type, n.Cells[i].Source)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package notebook
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// LimitsFilename is the name of the file with the resource limits of tests
+// in the autograder directory of an exercise.
+const LimitsFilename = "limits.json"
+
+// LimitsKey is the exercise metadata key with the resource limits of the
+// tests of the exercise, e.g.
+//
+//	limits:
+//	  wall_time: 60      # seconds
+//	  cpu_time: 30       # seconds
+//	  memory: 2000       # megabytes
+//	  cpus: 2
+//	  output_size: 65536 # bytes
+//	  processes: 16
+//
+// The limits that are not given keep the autograder defaults.
+const LimitsKey = "limits"
+
+// limitNames maps the names of the limits to whether the value must be
+// a whole number.
+var limitNames = map[string]bool{
+	"wall_time":   false,
+	"cpu_time":    false,
+	"memory":      true,
+	"cpus":        true,
+	"output_size": true,
+	"processes":   true,
+}
+
+// parseLimits returns the resource limits from the exercise metadata,
+// or nil if the metadata does not specify them.
+func parseLimits(exerciseMetadata map[string]interface{}) (map[string]float64, error) {
+	v, ok := exerciseMetadata[LimitsKey]
+	if !ok {
+		return nil, nil
+	}
+	data, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not a map, but %s", LimitsKey, reflect.TypeOf(v))
+	}
+	ret := make(map[string]float64)
+	for name, v := range data {
+		whole, ok := limitNames[name]
+		if !ok {
+			var names []string
+			for name := range limitNames {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown limit %q, want one of %s", name, strings.Join(names, ", "))
+		}
+		limit, ok := number(v)
+		if !ok {
+			return nil, fmt.Errorf("limit %s is not a number, but %s", name, reflect.TypeOf(v))
+		}
+		if limit <= 0 {
+			return nil, fmt.Errorf("limit %s is not positive: %v", name, limit)
+		}
+		if whole && limit != math.Trunc(limit) {
+			return nil, fmt.Errorf("limit %s is not a whole number: %v", name, limit)
+		}
+		ret[name] = limit
+	}
+	return ret, nil
+}
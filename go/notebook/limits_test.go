@@ -0,0 +1,59 @@
+package notebook
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	n := taggedNotebook([]string{
+		"```\n# ASSIGNMENT METADATA\nassignment_id: a1\n```",
+		"```\n# EXERCISE METADATA\nexercise_id: ex1\nlimits:\n  wall_time: 60\n  cpu_time: 2.5\n  memory: 2000\n  cpus: 2\n```",
+		"%%solution\nx = 1",
+		"%%inlinetest Test1\nassert x == 1",
+	}, make([][]interface{}, 4))
+	autograder, err := n.ToAutograder()
+	if err != nil {
+		t.Fatalf("ToAutograder() returned error %s", err)
+	}
+	var source string
+	for _, cell := range autograder.Cells {
+		if cell.Metadata["filename"] == LimitsFilename {
+			source = cell.Source
+		}
+	}
+	var got map[string]float64
+	if err := json.Unmarshal([]byte(source), &got); err != nil {
+		t.Fatalf("error parsing %s %q: %s", LimitsFilename, source, err)
+	}
+	want := map[string]float64{"wall_time": 60, "cpu_time": 2.5, "memory": 2000, "cpus": 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %v, want %v", LimitsFilename, got, want)
+	}
+	if problems := n.Lint(); problems.HasErrors() {
+		t.Errorf("Lint() = %v, want no errors", problems)
+	}
+}
+
+func TestParseLimitsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]interface{}
+	}{
+		{"not a map", map[string]interface{}{"limits": 5.0}},
+		{"unknown", map[string]interface{}{"limits": map[string]interface{}{"disk": 1.0}}},
+		{"not a number", map[string]interface{}{"limits": map[string]interface{}{"memory": "1G"}}},
+		{"zero", map[string]interface{}{"limits": map[string]interface{}{"wall_time": 0.0}}},
+		{"fraction", map[string]interface{}{"limits": map[string]interface{}{"processes": 1.5}}},
+		{"fractional cpus", map[string]interface{}{"limits": map[string]interface{}{"cpus": 0.5}}},
+	}
+	for _, tt := range tests {
+		if got, err := parseLimits(tt.metadata); err == nil {
+			t.Errorf("%s: parseLimits(%v) = %v, want error", tt.name, tt.metadata, got)
+		}
+	}
+	if got, err := parseLimits(map[string]interface{}{"exercise_id": "ex1"}); got != nil || err != nil {
+		t.Errorf("parseLimits() without limits = %v, %v, want nil, nil", got, err)
+	}
+}
@@ -0,0 +1,313 @@
+package notebook
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Severity is the severity of a problem found in a master notebook.
+type Severity int
+
+const (
+	// Warning is a problem that does not prevent the generation of student
+	// notebook and autograder scripts, but likely produces unintended results.
+	Warning Severity = iota
+	// Error is a problem that breaks the student notebook or autograder scripts.
+	Error
+)
+
+// String returns the name of the severity.
+func (s Severity) String() string {
+	switch s {
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// MarshalText implements encoding.TextMarshaler, so that the severity is
+// written as a string in JSON.
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Problem describes a single problem found by Lint.
+type Problem struct {
+	// Cell is the index of the cell with the problem,
+	// or -1 if the problem is not specific to a cell.
+	Cell     int      `json:"cell"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+// String formats the problem for human consumption.
+func (p *Problem) String() string {
+	if p.Cell < 0 {
+		return fmt.Sprintf("%s: %s", p.Severity, p.Message)
+	}
+	return fmt.Sprintf("cell %d: %s: %s", p.Cell, p.Severity, p.Message)
+}
+
+// Problems is a list of problems sorted by cell index.
+type Problems []*Problem
+
+// HasErrors returns true if any of the problems has Error severity.
+func (ps Problems) HasErrors() bool {
+	for _, p := range ps {
+		if p.Severity == Error {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// anyInlineTestRegex matches %%inlinetest magic with or without the test name.
+	anyInlineTestRegex   = regexp.MustCompile("(?m)^[ \t]*#? ?%%inlinetest")
+	anyTemplateRegex     = regexp.MustCompile("(?m)^[ \t]*%%template")
+	promptBeginLineRegex = regexp.MustCompile("(?m)^[ \t]*(?:\"\"\"[ \t]*)?# BEGIN PROMPT *$")
+	promptEndLineRegex   = regexp.MustCompile("(?m)^[ \t]*(?:\"\"\"[ \t]*)?# END PROMPT *$")
+)
+
+// linter keeps the state of the master notebook traversal.
+type linter struct {
+	problems     Problems
+	cell         int
+	assignmentID string
+	// exerciseID is the ID of the current exercise.
+	exerciseID string
+	// exerciseCell is the index of the cell with the current exercise metadata.
+	exerciseCell int
+	// hasSolution is true if the current exercise has a solution cell.
+	hasSolution bool
+	// exercises maps exercise IDs to the index of the cell where they are defined.
+	exercises map[string]int
+	// files maps the names of autograder files of the current exercise
+	// to the cell that produces them.
+	files map[string]int
+	// values are the default values of the parameters of the current exercise.
+	values map[string]interface{}
+}
+
+func (l *linter) report(severity Severity, format string, args ...interface{}) {
+	l.problems = append(l.problems, &Problem{
+		Cell:     l.cell,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// checkPairs checks that begin and end markers are balanced and properly ordered.
+func (l *linter) checkPairs(begin, end *regexp.Regexp, source, name string) {
+	mbeg := begin.FindAllStringIndex(source, -1)
+	mend := end.FindAllStringIndex(source, -1)
+	if len(mbeg) != len(mend) {
+		l.report(Error, "mismatched number of BEGIN %s and END %s, %d != %d",
+			name, name, len(mbeg), len(mend))
+		return
+	}
+	for i := range mbeg {
+		if mend[i][0] < mbeg[i][1] || (i > 0 && mbeg[i][0] < mend[i-1][1]) {
+			l.report(Error, "BEGIN %s and END %s are not properly nested", name, name)
+			return
+		}
+	}
+}
+
+// addFile records the autograder file produced by the current cell
+// and reports clashes with the files produced by other cells.
+func (l *linter) addFile(filename string) {
+	if prev, ok := l.files[filename]; ok {
+		l.report(Error, "autograder file %q of exercise %q is also produced by cell %d",
+			filename, l.exerciseID, prev)
+		return
+	}
+	l.files[filename] = l.cell
+}
+
+// endExercise checks the exercise that has just ended.
+func (l *linter) endExercise() {
+	if l.exerciseID != "" && !l.hasSolution {
+		l.problems = append(l.problems, &Problem{
+			Cell:     l.exerciseCell,
+			Severity: Warning,
+			Message:  fmt.Sprintf("exercise %q has no %%%%solution cell", l.exerciseID),
+		})
+	}
+}
+
+func (l *linter) lintMarkdown(source string) {
+	if hasMetadata(assignmentMetadataRegex, source) {
+		metadata, _, err := extractMetadata(assignmentMetadataRegex, source)
+		if err != nil {
+			l.report(Error, "assignment metadata: %s", err)
+		} else if v, ok := metadata["assignment_id"]; ok {
+			id, ok := v.(string)
+			if !ok {
+				l.report(Error, "assignment_id is not a string, but %s", reflect.TypeOf(v))
+			} else if l.assignmentID != "" && l.assignmentID != id {
+				l.report(Warning, "assignment_id %q overrides the earlier assignment_id %q", id, l.assignmentID)
+				l.assignmentID = id
+			} else {
+				l.assignmentID = id
+			}
+		}
+	}
+	if hasMetadata(exerciseMetadataRegex, source) {
+		l.endExercise()
+		l.exerciseID = ""
+		l.exerciseCell = l.cell
+		l.hasSolution = false
+		l.files = make(map[string]int)
+		l.values = nil
+		metadata, _, err := extractMetadata(exerciseMetadataRegex, source)
+		if err != nil {
+			l.report(Error, "exercise metadata: %s", err)
+			return
+		}
+		v, ok := metadata["exercise_id"]
+		if !ok {
+			l.report(Error, "exercise metadata has no exercise_id")
+			return
+		}
+		id, ok := v.(string)
+		if !ok {
+			l.report(Error, "exercise_id is not a string, but %s", reflect.TypeOf(v))
+			return
+		}
+		if prev, ok := l.exercises[id]; ok {
+			l.report(Error, "duplicate exercise_id %q, first defined in cell %d", id, prev)
+		} else {
+			l.exercises[id] = l.cell
+		}
+		l.exerciseID = id
+		if _, err := stubMode(metadata); err != nil {
+			l.report(Error, "%s", err)
+		}
+		if _, err := parsePoints(metadata); err != nil {
+			l.report(Error, "%s", err)
+		}
+		if _, err := parseLimits(metadata); err != nil {
+			l.report(Error, "%s", err)
+		}
+		parameters, err := parseParameters(metadata)
+		if err != nil {
+			l.report(Error, "%s", err)
+		}
+		l.values = VariantValues(parameters, "", l.exerciseID)
+	}
+}
+
+func (l *linter) lintCode(source string) {
+	if _, err := applyParameters(source, l.values, true); err != nil {
+		l.report(Error, "%s", err)
+	}
+	isSolution := solutionMagicRegex.MatchString(source)
+	if !isSolution {
+		if promptBeginLineRegex.MatchString(source) || promptEndLineRegex.MatchString(source) {
+			l.report(Warning, "PROMPT markers have no effect outside of %%%%solution cell")
+		}
+		if solutionBeginRegex.MatchString(source) || solutionEndRegex.MatchString(source) {
+			l.report(Warning, "SOLUTION markers have no effect outside of %%%%solution cell")
+		}
+	}
+	switch {
+	case studentTestRegex.MatchString(source):
+		// Student tests are passed through to the student notebook.
+	case anyInlineTestRegex.MatchString(source):
+		m := inlineTestRegex.FindStringSubmatch(source)
+		if m == nil {
+			l.report(Error, "%%%%inlinetest has no test name")
+			return
+		}
+		if l.exerciseID == "" {
+			l.report(Error, "inline test %q is not in an exercise", m[1])
+			return
+		}
+		if !l.hasSolution {
+			l.report(Error, "inline test %q has no preceding %%%%solution cell in exercise %q", m[1], l.exerciseID)
+		}
+		l.addFile(m[1] + "_inline.py")
+	case unittestBeginRegex.MatchString(source):
+		l.checkPairs(unittestBeginRegex, unittestEndRegex, source, "UNITTEST")
+		text, err := cutText(unittestBeginRegex, unittestEndRegex, source)
+		if err != nil {
+			return
+		}
+		m := testClassRegex.FindStringSubmatch(text)
+		if m == nil {
+			l.report(Error, "could not detect the unittest.TestCase class name in unit test")
+			return
+		}
+		if l.exerciseID == "" {
+			l.report(Error, "unit test %q is not in an exercise", m[1])
+			return
+		}
+		l.addFile(m[1] + ".py")
+	case isSolution:
+		if l.exerciseID == "" {
+			l.report(Error, "%%%%solution cell is not in an exercise, add exercise metadata before it")
+		} else if l.hasSolution {
+			l.report(Warning, "exercise %q has more than one %%%%solution cell", l.exerciseID)
+		}
+		l.hasSolution = true
+		l.checkPairs(promptBeginLineRegex, promptEndLineRegex, source, "PROMPT")
+		l.checkPairs(solutionBeginRegex, solutionEndRegex, source, "SOLUTION")
+	}
+	if anyTemplateRegex.MatchString(source) {
+		m := templateRegex.FindStringSubmatch(source)
+		if m == nil {
+			l.report(Error, "%%%%template has no template name")
+			return
+		}
+		if l.exerciseID == "" {
+			l.report(Error, "template %q is not in an exercise", m[1])
+			return
+		}
+		l.addFile(m[1] + ".py")
+	}
+}
+
+// Lint checks the master notebook for problems that would otherwise only
+// surface when generating the student notebook or the autograder scripts,
+// or at grading time. It reports all the problems found, ordered by cell.
+func (n *Notebook) Lint() Problems {
+	l := &linter{
+		exercises: make(map[string]int),
+		files:     make(map[string]int),
+	}
+	// Lint the notebook as seen by ToStudent and ToAutograder.
+	n, tagErrs := n.applyAllTags()
+	n, errs := n.expandAllIncludes()
+	for i, cell := range n.Cells {
+		l.cell = i
+		if err, ok := tagErrs[i]; ok {
+			l.report(Error, "%s", err)
+		}
+		if err, ok := errs[i]; ok {
+			l.report(Error, "%s", err)
+		}
+		switch cell.Type {
+		case "markdown":
+			l.lintMarkdown(cell.Source)
+		case "code":
+			if strings.TrimSpace(cell.Source) != "" {
+				l.lintCode(cell.Source)
+			}
+		}
+	}
+	l.endExercise()
+	l.cell = -1
+	if l.assignmentID == "" {
+		l.report(Error, "assignment metadata with assignment_id is missing")
+	}
+	sort.SliceStable(l.problems, func(i, j int) bool {
+		return l.problems[i].Cell < l.problems[j].Cell
+	})
+	return l.problems
+}
@@ -0,0 +1,107 @@
+package notebook
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	type want struct {
+		cell     int
+		severity Severity
+	}
+	const assignment = "```\n# ASSIGNMENT METADATA\nassignment_id: a1\n```"
+	tests := []struct {
+		name  string
+		cells []string
+		want  []want
+	}{
+		{
+			name: "Clean",
+			cells: []string{
+				assignment,
+				"```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+				"%%solution\n\"\"\" # BEGIN PROMPT\npass\n\"\"\" # END PROMPT\n# BEGIN SOLUTION\nx = 1\n# END SOLUTION",
+				"%%inlinetest Test1\nassert x == 1",
+				"# BEGIN UNITTEST\nclass XTest(unittest.TestCase):\n  pass\n# END UNITTEST",
+			},
+		},
+		{
+			name:  "MissingAssignmentID",
+			cells: []string{"```\n# ASSIGNMENT METADATA\nlanguage: en\n```"},
+			want:  []want{{-1, Error}},
+		},
+		{
+			name: "UnmatchedPrompt",
+			cells: []string{
+				assignment,
+				"```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+				"%%solution\n\"\"\" # BEGIN PROMPT\npass\n# BEGIN SOLUTION\nx = 1\n# END SOLUTION",
+			},
+			want: []want{{2, Error}},
+		},
+		{
+			name: "InlineTestWithoutSolution",
+			cells: []string{
+				assignment,
+				"```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+				"%%inlinetest Test1\nassert x == 1",
+			},
+			// The missing solution is reported both for the test and the exercise.
+			want: []want{{1, Warning}, {2, Error}},
+		},
+		{
+			name: "DuplicateExerciseAndTests",
+			cells: []string{
+				assignment,
+				"```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+				"%%solution\nx = 1",
+				"# BEGIN UNITTEST\nclass XTest(unittest.TestCase):\n  pass\n# END UNITTEST",
+				"# BEGIN UNITTEST\nclass XTest(unittest.TestCase):\n  pass\n# END UNITTEST",
+				"```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+				"%%solution\nx = 2",
+			},
+			want: []want{{4, Error}, {5, Error}},
+		},
+		{
+			name: "NotInExercise",
+			cells: []string{
+				assignment,
+				"%%solution\nx = 1",
+				"%%inlinetest\nassert x == 1",
+				"x = 1\n# END SOLUTION",
+			},
+			want: []want{{1, Error}, {2, Error}, {3, Warning}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := createNotebook(tt.cells)
+			for _, cell := range n.Cells {
+				if hasMetadata(assignmentMetadataRegex, cell.Source) || hasMetadata(exerciseMetadataRegex, cell.Source) {
+					cell.Type = "markdown"
+				}
+			}
+			got := n.Lint()
+			if len(got) != len(tt.want) {
+				t.Fatalf("Lint() returned %d problems, want %d: %v", len(got), len(tt.want), got)
+			}
+			for i, p := range got {
+				if p.Cell != tt.want[i].cell || p.Severity != tt.want[i].severity {
+					t.Errorf("got problem %q, want %s in cell %d", p, tt.want[i].severity, tt.want[i].cell)
+				}
+			}
+		})
+	}
+}
+
+func TestProblemJSON(t *testing.T) {
+	b, err := json.Marshal(&Problem{Cell: 3, Severity: Warning, Message: "msg"})
+	if err != nil {
+		t.Fatalf("json.Marshal(Problem) returned error %s", err)
+	}
+	want := `{"cell":3,"severity":"warning","message":"msg"}`
+	if string(b) != want {
+		t.Errorf("json.Marshal(Problem) returned %s, want %s", string(b), want)
+	}
+}
@@ -0,0 +1,131 @@
+package notebook
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ManifestFilename is the name of the assignment manifest file
+// in the autograder directory of the assignment.
+const ManifestFilename = "manifest.json"
+
+// Manifest describes the autograder files generated for an assignment.
+// It is produced by ToAutograder as a cell with filename ManifestFilename
+// and no exercise_id.
+type Manifest struct {
+	AssignmentID string `json:"assignment_id"`
+	// Languages lists the natural languages of the assignment, taken either
+	// from the language field of assignment metadata or from the language
+	// markers of the master notebook.
+	Languages []string            `json:"languages,omitempty"`
+	Exercises []*ExerciseManifest `json:"exercises"`
+	// Hash is the hash of all generated files, so that it changes when any of
+	// the autograder files changes.
+	Hash string `json:"hash"`
+}
+
+// ExerciseManifest describes the autograder files of a single exercise.
+type ExerciseManifest struct {
+	ExerciseID string `json:"exercise_id"`
+	// Title is the title field of exercise metadata, or the first heading
+	// of the markdown cell with exercise metadata.
+	Title string `json:"title,omitempty"`
+	// UnitTests lists the names of the unittest.TestCase classes.
+	UnitTests []string `json:"unit_tests"`
+	// InlineTests lists the names of the inline tests.
+	InlineTests []string `json:"inline_tests"`
+	// ContextFiles lists the files with the context code for inline tests.
+	ContextFiles []string `json:"context_files"`
+	// Templates lists the names of the report templates.
+	Templates []string `json:"templates,omitempty"`
+	// Metadata is the exercise metadata from the master notebook.
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	// Files maps the names of all generated files of the exercise
+	// to the hashes of their contents.
+	Files map[string]string `json:"files"`
+}
+
+// titleRegex matches a markdown heading line anywhere in the cell.
+var titleRegex = regexp.MustCompile(`(?m)^#{1,6}[ \t]+(.*?)[ \t#]*$`)
+
+// exerciseTitle returns the title of the exercise from its metadata or
+// the markdown cell source.
+func exerciseTitle(metadata map[string]interface{}, source string) string {
+	if title, ok := metadata["title"].(string); ok {
+		return title
+	}
+	// Skip the fenced blocks, where # starts a comment.
+	source = tripleBacktickedRegex.ReplaceAllString(source, "")
+	if m := titleRegex.FindStringSubmatch(source); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// manifestBuilder collects the information for the manifest
+// while converting the master notebook.
+type manifestBuilder struct {
+	exercises []*ExerciseManifest
+	byID      map[string]*ExerciseManifest
+}
+
+func newManifestBuilder() *manifestBuilder {
+	return &manifestBuilder{byID: make(map[string]*ExerciseManifest)}
+}
+
+// exercise returns the manifest of the exercise, creating it if needed.
+func (b *manifestBuilder) exercise(id string) *ExerciseManifest {
+	e, ok := b.byID[id]
+	if !ok {
+		e = &ExerciseManifest{
+			ExerciseID:   id,
+			UnitTests:    []string{},
+			InlineTests:  []string{},
+			ContextFiles: []string{},
+			Files:        make(map[string]string),
+		}
+		b.byID[id] = e
+		b.exercises = append(b.exercises, e)
+	}
+	return e
+}
+
+// build creates the manifest cell for the assignment from the generated
+// autograder cells.
+func (b *manifestBuilder) build(assignmentID string, languages []string, cells []*Cell) (*Cell, error) {
+	var entries []string
+	for _, cell := range cells {
+		exerciseID, _ := cell.Metadata["exercise_id"].(string)
+		filename, _ := cell.Metadata["filename"].(string)
+		if exerciseID == "" || filename == "" {
+			continue
+		}
+		hash := sourceHash(cell.Source)
+		b.exercise(exerciseID).Files[filename] = hash
+		entries = append(entries, exerciseID+"/"+filename+" "+hash+"\n")
+	}
+	sort.Strings(entries)
+	m := &Manifest{
+		AssignmentID: assignmentID,
+		Languages:    languages,
+		Exercises:    b.exercises,
+		Hash:         sourceHash(strings.Join(entries, "")),
+	}
+	if m.Exercises == nil {
+		m.Exercises = []*ExerciseManifest{}
+	}
+	data, err := marshalJSON(m)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing manifest: %s", err)
+	}
+	return &Cell{
+		Type: "code",
+		Metadata: map[string]interface{}{
+			"filename":      ManifestFilename,
+			"assignment_id": assignmentID,
+		},
+		Source: string(data),
+	}, nil
+}
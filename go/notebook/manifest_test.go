@@ -0,0 +1,82 @@
+package notebook
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	n := taggedNotebook([]string{
+		"```\n# ASSIGNMENT METADATA\nassignment_id: a1\nlanguage: en\n```",
+		"## Sum of numbers\n```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+		"# GLOBAL CONTEXT\nimport math",
+		"%%solution\nx = 1",
+		"%%inlinetest Test1\nassert x == 1",
+		"# BEGIN UNITTEST\nclass XTest(unittest.TestCase):\n  pass\n# END UNITTEST",
+		"```\n# EXERCISE METADATA\nexercise_id: ex2\ntitle: Second\n```",
+		"%%solution\ny = 2",
+	}, make([][]interface{}, 8))
+	autograder, err := n.ToAutograder()
+	if err != nil {
+		t.Fatalf("ToAutograder() returned error %s", err)
+	}
+	var manifestCell *Cell
+	for _, cell := range autograder.Cells {
+		if cell.Metadata["filename"] == ManifestFilename {
+			manifestCell = cell
+		}
+	}
+	if manifestCell == nil {
+		t.Fatalf("ToAutograder() did not produce %s", ManifestFilename)
+	}
+	if _, ok := manifestCell.Metadata["exercise_id"]; ok {
+		t.Errorf("manifest has exercise_id %v, want none", manifestCell.Metadata["exercise_id"])
+	}
+	var m Manifest
+	if err := json.Unmarshal([]byte(manifestCell.Source), &m); err != nil {
+		t.Fatalf("error parsing manifest %q: %s", manifestCell.Source, err)
+	}
+	if m.AssignmentID != "a1" || !reflect.DeepEqual(m.Languages, []string{"en"}) || m.Hash == "" {
+		t.Errorf("manifest = %+v, want assignment a1 in en with a hash", m)
+	}
+	if len(m.Exercises) != 2 {
+		t.Fatalf("manifest has %d exercises, want 2", len(m.Exercises))
+	}
+	ex1 := m.Exercises[0]
+	if ex1.ExerciseID != "ex1" || ex1.Title != "Sum of numbers" {
+		t.Errorf("exercise 1 = %q %q, want ex1 \"Sum of numbers\"", ex1.ExerciseID, ex1.Title)
+	}
+	if !reflect.DeepEqual(ex1.UnitTests, []string{"XTest"}) {
+		t.Errorf("exercise 1 unit tests = %q, want [XTest]", ex1.UnitTests)
+	}
+	if !reflect.DeepEqual(ex1.InlineTests, []string{"Test1"}) {
+		t.Errorf("exercise 1 inline tests = %q, want [Test1]", ex1.InlineTests)
+	}
+	if !reflect.DeepEqual(ex1.ContextFiles, []string{"Test1_context.py"}) {
+		t.Errorf("exercise 1 context files = %q, want [Test1_context.py]", ex1.ContextFiles)
+	}
+	for _, filename := range []string{"XTest.py", "Test1_inline.py", "Test1_context.py", "empty_source.py"} {
+		if ex1.Files[filename] == "" {
+			t.Errorf("exercise 1 files %v has no hash for %s", ex1.Files, filename)
+		}
+	}
+	if m.Exercises[1].ExerciseID != "ex2" || m.Exercises[1].Title != "Second" {
+		t.Errorf("exercise 2 = %q %q, want ex2 \"Second\"", m.Exercises[1].ExerciseID, m.Exercises[1].Title)
+	}
+
+	// The hash changes when any of the generated files change.
+	n.Cells[5].Source = "# BEGIN UNITTEST\nclass XTest(unittest.TestCase):\n  pass # changed\n# END UNITTEST"
+	changed, err := n.ToAutograder()
+	if err != nil {
+		t.Fatalf("ToAutograder() returned error %s", err)
+	}
+	last := changed.Cells[len(changed.Cells)-1]
+	var m2 Manifest
+	if err := json.Unmarshal([]byte(last.Source), &m2); err != nil {
+		t.Fatalf("error parsing manifest %q: %s", last.Source, err)
+	}
+	if m2.Hash == m.Hash {
+		t.Errorf("manifest hash did not change after changing the unit test")
+	}
+}
@@ -4,12 +4,15 @@ package notebook
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/golang/glog"
@@ -22,12 +25,21 @@ type Notebook struct {
 	NBFormat int `json:"nbformat"`
 	// NBFormatMinor is the nbformat_minor field.
 	NBFormatMinor int `json:"nbformat_minor"`
-	// Data is the raw parsed JSON data. It is not written back on serialization.
+	// Data is the raw parsed JSON data. It is only written back on
+	// serialization with MarshalOptions.PreserveUnknown, and only for the fields
+	// that are not represented by other fields of Notebook.
 	Data map[string]interface{} `json:"-"`
 	// Metadat is the map of metadata.
 	Metadata map[string]interface{} `json:"metadata"`
 	// Cells is the list of cells.
 	Cells []*Cell `json:"cells"`
+	// origins holds the index of the source cell for each cell of the notebook
+	// produced by MapCells, or nil if the notebook was not produced by MapCells.
+	// Cells added without a source cell, e.g. the preamble, have origin -1.
+	origins []int
+	// path is the file name the notebook was read from by ParseFile,
+	// used to resolve # INCLUDE directives.
+	path string
 }
 
 // Cell represents one cell of a Jupyter notebook. It is limited in
@@ -36,27 +48,40 @@ type Cell struct {
 	// Type is "code" or "markdown".
 	Type string
 	// Data is the raw parsed JSON contents of the cell.
-	// When serializing cell back to JSON, Data is ignored.
+	// When serializing cell back to JSON, Data is ignored unless
+	// MarshalOptions.PreserveUnknown is set, in which case the fields that are
+	// not represented by other fields of Cell (e.g. "id") are written back.
 	Data map[string]interface{}
 	// Metadata is the "metadata" field of the cell.
 	Metadata map[string]interface{}
-	// Outputs are the recorded outputs of the cell.
-	Outputs map[string]string
+	// ExecutionCount is the execution_count of a code cell, nil if null.
+	ExecutionCount *int
+	// Outputs are the recorded outputs of the cell in the original order.
+	Outputs []*Output
+	// Attachments are the files attached to a markdown or raw cell,
+	// keyed by the attachment name.
+	Attachments map[string]MIMEBundle
 	// Source is the raw source of the cell.
 	Source string
 }
 
 // ParseFile loads a notebook file from the specified file and parses it
-// into a Notebook structure.
+// into a Notebook structure. Files with .py extension are parsed
+// in jupytext percent format.
 func ParseFile(filename string) (*Notebook, error) {
 	b, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("error reading %q: %s", filename, err)
 	}
-	n, err := Parse(b)
+	parse := Parse
+	if IsPercentFile(filename) {
+		parse = ParsePercent
+	}
+	n, err := parse(b)
 	if err != nil {
 		return nil, fmt.Errorf("error reading notebook from %q: %s", filename, err)
 	}
+	n.path = filename
 	return n, nil
 }
 
@@ -87,14 +112,73 @@ func parseText(v interface{}) (text string, err error) {
 	return
 }
 
+// parseCell parses one element of the notebook "cells" list.
+func parseCell(x interface{}) (*Cell, error) {
+	celldata, ok := x.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cell is not a map but %s", reflect.TypeOf(x))
+	}
+	cell := &Cell{
+		Data: celldata,
+	}
+	if v, ok := celldata["cell_type"]; ok {
+		cell.Type, _ = v.(string)
+	}
+	if v, ok := celldata["metadata"]; ok {
+		cell.Metadata, _ = v.(map[string]interface{})
+	}
+	var err error
+	if v, ok := celldata["source"]; ok {
+		cell.Source, err = parseText(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := celldata["execution_count"]; ok {
+		cell.ExecutionCount, err = parseExecutionCount(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := celldata["outputs"]; ok {
+		ss, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cell.outputs is not a list but %s",
+				reflect.TypeOf(v))
+		}
+		for i, s := range ss {
+			output, err := parseOutput(s)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse output %d: %s", i, err)
+			}
+			cell.Outputs = append(cell.Outputs, output)
+		}
+	}
+	if v, ok := celldata["attachments"]; ok {
+		cell.Attachments, err = parseAttachments(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cell, nil
+}
+
 // Parse parses a byte slice into a Notebook structure. The input data
-// must be a notebook in JSON encoding.
+// must be a notebook in JSON encoding. Notebooks in nbformat v3 are upgraded
+// to nbformat v4 with UpgradeV3.
 func Parse(b []byte) (*Notebook, error) {
 	data := make(map[string]interface{})
 	err := json.Unmarshal(b, &data)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing JSON: %s", err)
 	}
+	if v, _ := data["nbformat"].(float64); int(v) == 3 {
+		// Transparently upgrade the old notebook format.
+		data, err = UpgradeV3(data)
+		if err != nil {
+			return nil, fmt.Errorf("error upgrading nbformat v3 notebook: %s", err)
+		}
+	}
 	ret := &Notebook{
 		Data: data,
 	}
@@ -113,46 +197,10 @@ func Parse(b []byte) (*Notebook, error) {
 		if !ok {
 			return nil, fmt.Errorf(".cells is not a list but %s", reflect.TypeOf(cells))
 		}
-		for _, x := range cellsList {
-			celldata, ok := x.(map[string]interface{})
-			if !ok {
-				return nil, fmt.Errorf("cell is not a map but %s", reflect.TypeOf(x))
-			}
-			cell := &Cell{}
-			if v, ok := celldata["cell_type"]; ok {
-				cell.Type, _ = v.(string)
-			}
-			if v, ok := celldata["metadata"]; ok {
-				cell.Metadata, ok = v.(map[string]interface{})
-			}
-			cell.Source, err = parseText(celldata["source"])
-			if v, ok := celldata["outputs"]; ok {
-				ss, ok := v.([]interface{})
-				if !ok {
-					return nil, fmt.Errorf("cell.outputs is not a list but %s",
-						reflect.TypeOf(v))
-				}
-				outputs := make(map[string]string)
-				for _, s := range ss {
-					m, ok := s.(map[string]interface{})
-					if !ok {
-						continue
-					}
-					nameVal, ok := m["name"]
-					if !ok {
-						continue
-					}
-					name, ok := nameVal.(string)
-					if !ok {
-						return nil, fmt.Errorf("output name is not a string but %s",
-							reflect.TypeOf(nameVal))
-					}
-					outputs[name], err = parseText(m["text"])
-					if err != nil {
-						return nil, fmt.Errorf("could not parse text: %s", err)
-					}
-				}
-				cell.Outputs = outputs
+		for i, x := range cellsList {
+			cell, err := parseCell(x)
+			if err != nil {
+				return nil, fmt.Errorf("cell %d: %s", i, err)
 			}
 			ret.Cells = append(ret.Cells, cell)
 		}
@@ -162,12 +210,16 @@ func Parse(b []byte) (*Notebook, error) {
 
 // marshalText serializes a multi-line text string
 // into a format that is compatible with JSON encoder.
+// Similarly to Jupyter, each line keeps its newline character,
+// and no empty string is produced after the trailing newline.
 func marshalText(text string) []interface{} {
-	var ret []interface{}
+	ret := []interface{}{}
 	lines := strings.Split(text, "\n")
 	for i, line := range lines {
 		if i == len(lines)-1 {
-			ret = append(ret, line)
+			if line != "" {
+				ret = append(ret, line)
+			}
 			break
 		}
 		ret = append(ret, line+"\n")
@@ -176,17 +228,15 @@ func marshalText(text string) []interface{} {
 }
 
 // json returns a JSON-like map representing a cell.
-func (cell *Cell) json() map[string]interface{} {
+func (cell *Cell) json(opts *MarshalOptions) map[string]interface{} {
 	emptyMap := make(map[string]interface{})
 	ret := make(map[string]interface{})
-	var outputs []interface{}
-	// TODO(salikh): Do we need to handle any other kind of output?
-	for name, output := range cell.Outputs {
-		o := make(map[string]interface{})
-		o["name"] = name
-		o["output_type"] = "stream"
-		o["text"] = marshalText(output)
-		outputs = append(outputs, o)
+	if opts != nil && opts.PreserveUnknown {
+		copyUnknown(ret, cell.Data, cellFields)
+	}
+	outputs := []interface{}{}
+	for _, output := range cell.Outputs {
+		outputs = append(outputs, output.json(opts))
 	}
 	if cell.Metadata != nil {
 		ret["metadata"] = cell.Metadata
@@ -195,61 +245,197 @@ func (cell *Cell) json() map[string]interface{} {
 	}
 	ret["cell_type"] = cell.Type
 	if cell.Type == "code" {
-		ret["execution_count"] = nil
-		if len(outputs) > 0 {
-			ret["outputs"] = outputs
+		if cell.ExecutionCount != nil {
+			ret["execution_count"] = *cell.ExecutionCount
 		} else {
-			// Empty slice.
-			ret["outputs"] = []interface{}{}
+			ret["execution_count"] = nil
 		}
+		ret["outputs"] = outputs
+	}
+	if len(cell.Attachments) > 0 {
+		attachments := make(map[string]interface{})
+		for name, bundle := range cell.Attachments {
+			attachments[name] = bundle.json()
+		}
+		ret["attachments"] = attachments
 	}
 	ret["source"] = marshalText(cell.Source)
 	return ret
 }
 
+// MarshalOptions configures the notebook serialization.
+type MarshalOptions struct {
+	// PreserveUnknown instructs Marshal to write back the fields of the notebook,
+	// the cells and the outputs that are not modelled by Notebook, Cell and
+	// Output, taking them from the raw parsed JSON in Data (Raw for outputs). For nbformat 4.5 and later it also assigns
+	// deterministic ids to the cells that do not have one, as cell ids are
+	// mandatory since that version.
+	PreserveUnknown bool
+}
+
+// Fields of the notebook and of the cell that are modelled explicitly,
+// and are never copied from the raw JSON.
+var (
+	notebookFields = map[string]bool{
+		"nbformat":       true,
+		"nbformat_minor": true,
+		"metadata":       true,
+		"cells":          true,
+	}
+	cellFields = map[string]bool{
+		"cell_type":       true,
+		"metadata":        true,
+		"source":          true,
+		"outputs":         true,
+		"execution_count": true,
+		"attachments":     true,
+	}
+)
+
+// copyUnknown copies the fields of src that are not in known into dst.
+func copyUnknown(dst, src map[string]interface{}, known map[string]bool) {
+	for k, v := range src {
+		if !known[k] {
+			dst[k] = v
+		}
+	}
+}
+
+// ID returns the cell id (nbformat 4.5 and later), or empty string
+// if the cell does not have an id.
+func (cell *Cell) ID() string {
+	id, _ := cell.Data["id"].(string)
+	return id
+}
+
+// hasCellIDs returns true if the notebook format version requires cell ids.
+func (n *Notebook) hasCellIDs() bool {
+	return n.NBFormat > 4 || (n.NBFormat == 4 && n.NBFormatMinor >= 5)
+}
+
+// fillCellIDs sets the "id" field in the cell JSON maps that lack one or
+// have a duplicate id. The generated ids are derived from the id of the
+// preceding cell, so regenerating a notebook produces the same ids.
+func fillCellIDs(cells []interface{}) {
+	seen := make(map[string]bool)
+	prev := ""
+	for i, x := range cells {
+		m := x.(map[string]interface{})
+		id, _ := m["id"].(string)
+		if id == "" || seen[id] {
+			h := sha1.Sum([]byte(fmt.Sprintf("%s/%d", prev, i)))
+			id = hex.EncodeToString(h[:])[:8]
+			for seen[id] {
+				h = sha1.Sum(h[:])
+				id = hex.EncodeToString(h[:])[:8]
+			}
+			m["id"] = id
+		}
+		seen[id] = true
+		prev = id
+	}
+}
+
+// marshalJSON serializes the notebook JSON the same way Jupyter does
+// (json.dumps with sort_keys=True, indent=1, ensure_ascii=False), i.e. with
+// sorted keys, 1-space indentation, no HTML escaping and a trailing newline.
+// This keeps the diffs of regenerated notebooks limited to the actual changes.
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", " ")
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // Marshal produces a JSON content suitable for writing to .ipynb file.
+// Only the modelled fields are written, see MarshalWithOptions for
+// the lossless mode. As the cell ids are not written, nbformat 4.5 and
+// later minor versions are written as 4.4. The output is formatted as Jupyter does, so it
+// is stable across regenerations.
 func (n *Notebook) Marshal() ([]byte, error) {
+	return n.MarshalWithOptions(nil)
+}
+
+// MarshalWithOptions produces a JSON content suitable for writing to .ipynb file,
+// with serialization controlled by opts. A nil opts is equivalent to Marshal.
+func (n *Notebook) MarshalWithOptions(opts *MarshalOptions) ([]byte, error) {
 	output := make(map[string]interface{})
-	var cells []interface{}
+	if opts != nil && opts.PreserveUnknown {
+		copyUnknown(output, n.Data, notebookFields)
+	}
+	cells := []interface{}{}
 	for _, cell := range n.Cells {
-		cells = append(cells, cell.json())
+		cells = append(cells, cell.json(opts))
+	}
+	minor := n.NBFormatMinor
+	if n.hasCellIDs() {
+		if opts != nil && opts.PreserveUnknown {
+			fillCellIDs(cells)
+		} else if n.NBFormat == 4 {
+			// The cell ids are dropped, so write the last version without them.
+			minor = 4
+		}
 	}
 	output["nbformat"] = n.NBFormat
-	output["nbformat_minor"] = n.NBFormatMinor
-	output["metadata"] = n.Metadata
+	output["nbformat_minor"] = minor
+	if n.Metadata != nil {
+		output["metadata"] = n.Metadata
+	} else {
+		output["metadata"] = make(map[string]interface{})
+	}
 	output["cells"] = cells
-	return json.Marshal(output)
+	return marshalJSON(output)
 }
 
 // MapCells runs a function on each cell and replaces the cell with the returned values.
 // If mapFunc returns error, the function terminates the iteration and returns the error.
+// The first of the returned cells is considered to be the rewritten version of the
+// original cell, so it inherits the raw JSON data of the original cell if it does
+// not have its own. This keeps the unmodelled fields (e.g. cell id) in lossless mode.
 func (n *Notebook) MapCells(mapFunc func(c *Cell) ([]*Cell, error)) (*Notebook, error) {
 	var out []*Cell
-	for _, cell := range n.Cells {
+	var origins []int
+	for i, cell := range n.Cells {
 		ncell, err := mapFunc(cell)
 		if err != nil {
 			return nil, err
 		}
 		if len(ncell) > 0 {
+			if ncell[0] != nil && ncell[0] != cell && ncell[0].Data == nil {
+				ncell[0].Data = cell.Data
+			}
 			out = append(out, ncell...)
+			// Keep track of the original cells across repeated mapping.
+			origin := i
+			if n.origins != nil {
+				origin = n.origins[i]
+			}
+			for range ncell {
+				origins = append(origins, origin)
+			}
 		}
 	}
 	return &Notebook{
 		NBFormat:      n.NBFormat,
 		NBFormatMinor: n.NBFormatMinor,
+		Data:          n.Data,
 		Metadata:      n.Metadata,
 		Cells:         out,
+		origins:       origins,
 	}, nil
 }
 
-// TODO(salikh): Implement smarter replacement strategies similar to jassign, e.g.
-// x = 1 # SOLUTION   ===>   x = ...
 var (
 	assignmentMetadataRegex     = regexp.MustCompile("(?m)^[ \t]*# ASSIGNMENT METADATA")
 	exerciseMetadataRegex       = regexp.MustCompile("(?m)^[ \t]*# EXERCISE METADATA")
 	globalContextRegex          = regexp.MustCompile("(?ms)^[ \t]*# *GLOBAL CONTEXT[ \t]*[\n]*")
 	exerciseContextRegex        = regexp.MustCompile("(?ms)^[ \t]*# *EXERCISE CONTEXT[ \t]*[\n]*")
-	languageMetadataRegex       = regexp.MustCompile("\\*\\*lang:([a-z]{2})\\*\\*")
+	languageMetadataRegex       = regexp.MustCompile("\\*\\*lang:([a-zA-Z]{2,8}(?:-[a-zA-Z0-9]{1,8})*)\\*\\*")
 	tripleBacktickedRegex       = regexp.MustCompile("(?ms)^```([^`]|`[^`]|``[^`])*^```")
 	testMarkerRegex             = regexp.MustCompile("(?ms)^[ \t]*# TEST[^\n]*[\n]*")
 	studentTestRegex            = regexp.MustCompile("(?ms)^[ \t]*#? ?%%studenttest(?:[ \t]+([a-zA-Z][a-zA-Z0-9_]*))[ \t]*[\n]*")
@@ -259,6 +445,7 @@ var (
 	solutionMagicRegex          = regexp.MustCompile("^[ \t]*%%solution[^\n]*\n")
 	solutionBeginRegex          = regexp.MustCompile("(?m)^([ \t]*)# BEGIN SOLUTION *\n")
 	solutionEndRegex            = regexp.MustCompile("(?m)^[ \t]*# END SOLUTION *")
+	solutionLineRegex           = regexp.MustCompile("^([ \t]*)(.*?)[ \t]*# SOLUTION( NO PROMPT)?[ \t]*$")
 	promptBeginRegex            = regexp.MustCompile("(?m)^[ \t]*\"\"\" # BEGIN PROMPT *\n|^[ \t]*# BEGIN PROMPT *\n")
 	promptEndRegex              = regexp.MustCompile("(?m)\n[ \t]*\"\"\" # END PROMPT *\n?|\n[ \t]*# END PROMPT *\n?")
 	unittestBeginRegex          = regexp.MustCompile("(?m)^[ \t]*# BEGIN UNITTEST *\n")
@@ -322,6 +509,15 @@ func extractMetadata(re *regexp.Regexp, source string) (metadata map[string]inte
 				err = fmt.Errorf("error parsing metadata: %s\n--\n%s\n--", err, text)
 				return
 			}
+			// The metadata is stored in the notebook, so nested values
+			// must have the types that can be serialized to JSON.
+			for k, v := range metadata {
+				metadata[k], err = yamlToJSON(v)
+				if err != nil {
+					err = fmt.Errorf("error in metadata %q: %s", k, err)
+					return
+				}
+			}
 		} else {
 			outputs = append(outputs, source[m[0]:m[1]])
 		}
@@ -335,45 +531,197 @@ func extractMetadata(re *regexp.Regexp, source string) (metadata map[string]inte
 	return
 }
 
-// Language represents a type of natural languages in which a cell is written.
-type Language int
+// Language is a natural language in which a cell is written, identified by
+// a BCP 47 language tag, e.g. "en", "ja", "ko" or "es-MX". Use ParseLanguage
+// to validate and canonicalize a tag.
+type Language string
 
 const (
-	English Language = iota
-	Japanese
-	AnyLanguage
+	// AnyLanguage matches text in all languages.
+	AnyLanguage Language = ""
+	English     Language = "en"
+	Japanese    Language = "ja"
 )
 
+// languageTagRegex matches the BCP 47 language tags: the primary language
+// subtag, optionally followed by script, region and variant subtags.
+var languageTagRegex = regexp.MustCompile(`^([a-zA-Z]{2,3}|[a-zA-Z]{5,8})(-[a-zA-Z]{4})?(-[a-zA-Z]{2}|-[0-9]{3})?((?:-[a-zA-Z0-9]{5,8}|-[0-9][a-zA-Z0-9]{3})*)$`)
+
+// ParseLanguage parses a BCP 47 language tag, and returns it in the canonical
+// case (e.g. "zh-Hant-TW"). Empty string is parsed as AnyLanguage.
+func ParseLanguage(tag string) (Language, error) {
+	if tag == "" {
+		return AnyLanguage, nil
+	}
+	m := languageTagRegex.FindStringSubmatch(tag)
+	if m == nil {
+		return AnyLanguage, fmt.Errorf("invalid language tag %q", tag)
+	}
+	parts := []string{strings.ToLower(m[1])}
+	if m[2] != "" {
+		script := strings.ToLower(m[2][1:])
+		parts = append(parts, strings.ToUpper(script[:1])+script[1:])
+	}
+	if m[3] != "" {
+		parts = append(parts, strings.ToUpper(m[3][1:]))
+	}
+	if m[4] != "" {
+		parts = append(parts, strings.ToLower(m[4][1:]))
+	}
+	return Language(strings.Join(parts, "-")), nil
+}
+
 func (l Language) String() string {
-	switch l {
-	case English:
-		return "en"
-	case Japanese:
-		return "ja"
-	default:
-		return ""
+	return string(l)
+}
+
+// Matches returns true if the text written in language other should be
+// included in the notebook for language l. AnyLanguage matches everything,
+// and a tag matches the more specific tags, e.g. "en" matches "en-US"
+// and vice versa.
+func (l Language) Matches(other Language) bool {
+	if l == AnyLanguage || other == AnyLanguage {
+		return true
 	}
+	a, b := strings.ToLower(string(l)), strings.ToLower(string(other))
+	return a == b || strings.HasPrefix(a, b+"-") || strings.HasPrefix(b, a+"-")
 }
 
+// filterText keeps the parts of s written in language l. A cell with a single
+// language marker **lang:xx** is entirely in language xx. A cell may have
+// several language sections: each subsequent marker starts a new section that
+// extends to the next marker or to the end of the cell, while the first
+// section starts at the beginning of the cell. Returns empty string if no text
+// remains for language l.
 func (l Language) filterText(s string) string {
 	// If no language is specified, use s by removing language metadata.
 	if l == AnyLanguage {
 		return languageMetadataRegex.ReplaceAllString(s, "")
 	}
-
-	var ms [][]byte
-	if ms = languageMetadataRegex.FindSubmatch([]byte(s)); len(ms) == 0 {
+	mm := languageMetadataRegex.FindAllStringSubmatchIndex(s, -1)
+	if len(mm) == 0 {
 		// We always use a cell as is where no language is specified.
 		return s
 	}
+	var sections []string
+	for i, m := range mm {
+		if !l.Matches(Language(s[m[2]:m[3]])) {
+			continue
+		}
+		begin := m[0]
+		if i == 0 {
+			begin = 0
+		}
+		section := s[begin:m[0]] + s[m[1]:]
+		if i < len(mm)-1 {
+			// Drop the separator before the next section.
+			section = strings.TrimRight(s[begin:m[0]]+s[m[1]:mm[i+1][0]], " \t\n")
+		}
+		sections = append(sections, section)
+	}
+	return strings.Join(sections, "\n\n")
+}
 
-	// If the language used in the cell is different from l, return the empty string.
-	if string(ms[1]) != l.String() {
-		return ""
+// Languages returns the sorted list of languages used in the language markers
+// of markdown cells.
+func (n *Notebook) Languages() []Language {
+	seen := make(map[Language]bool)
+	var ret []Language
+	for _, cell := range n.Cells {
+		if cell.Type != "markdown" {
+			continue
+		}
+		for _, m := range languageMetadataRegex.FindAllStringSubmatch(cell.Source, -1) {
+			l, err := ParseLanguage(m[1])
+			if err != nil || seen[l] {
+				continue
+			}
+			seen[l] = true
+			ret = append(ret, l)
+		}
 	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
 
-	// Use s by removing language metadata.
-	return languageMetadataRegex.ReplaceAllString(s, "")
+// assignmentPrefix returns the length of the left-hand side of the assignment
+// statement in the code line, including the assignment operator, or -1 if the
+// line is not an assignment. For chained assignments (a = b = 1) the last
+// assignment operator is used.
+func assignmentPrefix(code string) int {
+	pos := -1
+	depth := 0
+	var quote byte
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '\'', '"':
+			quote = c
+		case '#':
+			return pos
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case '=':
+			if depth != 0 {
+				continue
+			}
+			if i+1 < len(code) && code[i+1] == '=' {
+				// Comparison ==.
+				i++
+				continue
+			}
+			if i > 0 && strings.IndexByte("=!<>:", code[i-1]) >= 0 &&
+				!(i > 1 && (code[i-2:i] == "<<" || code[i-2:i] == ">>")) {
+				// Comparison !=, <=, >= or := (walrus), but not <<= or >>=.
+				continue
+			}
+			pos = i + 1
+		}
+	}
+	return pos
+}
+
+// replaceSolutionLines replaces the lines marked with # SOLUTION with a
+// placeholder in the style of jassign:
+//
+//	x = 1 # SOLUTION             ===>   x = ...
+//	print(x) # SOLUTION          ===>   ...
+//	x = 1 # SOLUTION NO PROMPT   ===>   (line removed)
+//
+// It returns the rewritten source and whether any lines were marked.
+func replaceSolutionLines(source string) (string, bool) {
+	lines := strings.Split(source, "\n")
+	var out []string
+	replaced := false
+	for _, line := range lines {
+		m := solutionLineRegex.FindStringSubmatch(line)
+		if m == nil {
+			out = append(out, line)
+			continue
+		}
+		replaced = true
+		if m[3] != "" {
+			// # SOLUTION NO PROMPT
+			continue
+		}
+		indent, code := m[1], m[2]
+		if pos := assignmentPrefix(code); pos >= 0 {
+			out = append(out, indent+strings.TrimRight(code[:pos], " \t")+" ...")
+		} else {
+			out = append(out, indent+"...")
+		}
+	}
+	return strings.Join(out, "\n"), replaced
 }
 
 // CleanForStudent takes a code cell and produces a clean student version,
@@ -450,10 +798,34 @@ func CleanForStudent(cell *Cell, assignmentMetadata, exerciseMetadata map[string
 			source = strings.Join([]string{source[:mbeg[0]], source[mend[1]:]}, "")
 			glog.V(3).Infof("stripped source = %q", source)
 		}
+		// Replace the lines marked with # SOLUTION.
+		var replaced bool
+		source, replaced = replaceSolutionLines(source)
 		// Remove the solution.
 		mbeg := solutionBeginRegex.FindAllStringSubmatchIndex(source, -1)
+		if mbeg == nil && replaced {
+			return &Cell{
+				Type:     "code",
+				Metadata: exerciseMetadata,
+				Source:   source,
+			}, nil
+		}
 		if mbeg == nil {
-			// No BEGIN/END SOLUTION markers. Just return "..."
+			// No BEGIN/END SOLUTION markers. Stub the function bodies
+			// if enabled in exercise metadata, or just return "..."
+			stub, err := stubMode(exerciseMetadata)
+			if err != nil {
+				return nil, err
+			}
+			if stub != "" {
+				if stubbed, ok := stubDefinitions(source, stub); ok {
+					return &Cell{
+						Type:     "code",
+						Metadata: exerciseMetadata,
+						Source:   stubbed,
+					}, nil
+				}
+			}
 			return &Cell{
 				Type:     "code",
 				Metadata: exerciseMetadata,
@@ -505,24 +877,55 @@ func CleanForStudent(cell *Cell, assignmentMetadata, exerciseMetadata map[string
 		Type:   "code",
 		Source: source,
 	}, nil
-	return &Cell{
-		Type:   cell.Type,
-		Source: source,
-	}, nil
 }
 
 type StudentOptions struct {
 	InsertCheckCell   bool
 	CheckCellTemplate string
+	// Profile adds the preamble, check cells and notebook metadata for
+	// the target platform, see Profile. The check cells of the profile are
+	// only used if InsertCheckCell is false.
+	Profile *Profile
+	// RecordProvenance instructs ToStudent to record the master cell
+	// of each student cell in the cell metadata, see Provenance.
+	RecordProvenance bool
+	// Seed chooses the variant of the exercise parameters, see VariantValues.
+	// The seed is recorded in the notebook metadata as variant_seed.
+	Seed string
 }
 
 // ToStudent converts a master notebook into the student notebook.
 func (n *Notebook) ToStudent(lang Language, options *StudentOptions) (*Notebook, error) {
+	master := n
+	// Cell tags are equivalent to the magic markers.
+	n, err := n.withTagsApplied()
+	if err != nil {
+		return nil, err
+	}
+	n, err = n.withIncludes()
+	if err != nil {
+		return nil, err
+	}
 	// Assignment metadata is global for the notebook.
 	assignmentMetadata := make(map[string]interface{})
 	// Exercise metadata only applies to the next code block,
 	// and is nil otherwise.
 	var exerciseMetadata map[string]interface{}
+	// The values of the exercise parameters in the variant.
+	var values map[string]interface{}
+	seed := ""
+	insertCheckCell, checkCellTemplate := false, ""
+	var profile *Profile
+	if options != nil {
+		seed = options.Seed
+		insertCheckCell, checkCellTemplate = options.InsertCheckCell, options.CheckCellTemplate
+		profile = options.Profile
+	}
+	if profile != nil && !insertCheckCell && profile.CheckCellTemplate != "" {
+		insertCheckCell, checkCellTemplate = true, profile.CheckCellTemplate
+	}
+	// The check cells inserted after the solution cells.
+	checkCells := make(map[*Cell]bool)
 	transformed, err := n.MapCells(func(cell *Cell) ([]*Cell, error) {
 		source := cell.Source
 		if cell.Type == "markdown" {
@@ -544,8 +947,25 @@ func (n *Notebook) ToStudent(lang Language, options *StudentOptions) (*Notebook,
 				if err != nil {
 					return nil, err
 				}
+				parameters, err := parseParameters(exerciseMetadata)
+				if err != nil {
+					return nil, err
+				}
+				exerciseID, _ := exerciseMetadata["exercise_id"].(string)
+				values = VariantValues(parameters, seed, exerciseID)
 			}
 		}
+		// Render the variant of the exercise.
+		rendered, err := renderVariant(cell.Type, source, values)
+		if err != nil {
+			return nil, err
+		}
+		if cell.Type == "code" && rendered != cell.Source {
+			c := *cell
+			c.Source = rendered
+			cell = &c
+		}
+		source = rendered
 		if cell.Type == "markdown" {
 			if masterOnlyMarkerRegex.MatchString(source) {
 				// Skip # MASTER ONLY
@@ -556,7 +976,16 @@ func (n *Notebook) ToStudent(lang Language, options *StudentOptions) (*Notebook,
 			}
 		}
 		if cell.Type != "code" {
-			return []*Cell{&Cell{Type: cell.Type, Source: source}}, nil
+			ret := &Cell{
+				Type:        cell.Type,
+				Source:      source,
+				Attachments: cell.Attachments,
+			}
+			if cell.Type == "raw" {
+				// Raw cells keep the target format in metadata.
+				ret.Metadata = cell.Metadata
+			}
+			return []*Cell{ret}, nil
 		}
 		if m := testMarkerRegex.FindStringIndex(source); m != nil {
 			// Remove the # TEST marker.
@@ -581,11 +1010,11 @@ func (n *Notebook) ToStudent(lang Language, options *StudentOptions) (*Notebook,
 				return nil, err
 			}
 			retCells := []*Cell{clean}
-			if options != nil && options.InsertCheckCell {
-				tmpl, err := template.New("check_cell").Parse(options.CheckCellTemplate)
+			if insertCheckCell {
+				tmpl, err := template.New("check_cell").Parse(checkCellTemplate)
 				if err != nil {
 					return nil, fmt.Errorf("error parsing check cell template %q: %s",
-						options.CheckCellTemplate, err)
+						checkCellTemplate, err)
 				}
 				exercise_id, ok := exerciseMetadata["exercise_id"].(string)
 				if !ok {
@@ -597,12 +1026,13 @@ func (n *Notebook) ToStudent(lang Language, options *StudentOptions) (*Notebook,
 				err = tmpl.Execute(b, m)
 				if err != nil {
 					return nil, fmt.Errorf("error renderng check template %q: %s",
-						options.CheckCellTemplate, err)
+						checkCellTemplate, err)
 				}
 				checkCell := &Cell{
 					Type:   "code",
 					Source: b.String(),
 				}
+				checkCells[checkCell] = true
 				retCells = append(retCells, checkCell)
 			}
 			return retCells, nil
@@ -629,9 +1059,29 @@ func (n *Notebook) ToStudent(lang Language, options *StudentOptions) (*Notebook,
 	if err != nil {
 		return nil, err
 	}
+	if profile != nil && profile.CheckCellPlacement == CheckAfterExercise {
+		var starts []int
+		for i, cell := range n.Cells {
+			if cell.Type == "markdown" && hasMetadata(exerciseMetadataRegex, cell.Source) {
+				starts = append(starts, i)
+			}
+		}
+		transformed.moveCheckCells(checkCells, starts)
+	}
+	// Do not modify the metadata of the master notebook.
+	transformed.Metadata = cloneMetadata(transformed.Metadata)
+	if profile != nil {
+		profile.apply(transformed)
+	}
 	for k, v := range assignmentMetadata {
 		transformed.Metadata[k] = v
 	}
+	if seed != "" {
+		transformed.Metadata[VariantSeedKey] = seed
+	}
+	if options != nil && options.RecordProvenance {
+		transformed.recordProvenance(master)
+	}
 	return transformed, nil
 }
 
@@ -653,6 +1103,7 @@ var (
 	// testClassRegex detects the test cases that need to be written down into a separate file.
 	// The name of the file is derived from the name of the test class.
 	testClassRegex       = regexp.MustCompile(`(?m)^[ \t]*class ([a-zA-Z_0-9]*)\(unittest\.TestCase\):`)
+	testMethodRegex      = regexp.MustCompile(`(?m)^[ \t]+def (test[a-zA-Z_0-9]*)\(`)
 	commentedImportRegex = regexp.MustCompile(`(?m)^([ \t]*)#[ \t]*(import[ \t]+[a-zA-Z][a-zA-Z0-9_.]*)[ \t]*(\r?\n?)$`)
 )
 
@@ -685,6 +1136,31 @@ func uncommentImports(source string) string {
 // Note: the autograder notebooks do not exist in the form of notebook files, it is only a convenience
 // representation that it actually saved in the directory autograder format.
 func (n *Notebook) ToAutograder() (*Notebook, error) {
+	return n.ToAutograderWithOptions(nil)
+}
+
+// AutograderOptions configures the conversion of the master notebook
+// into the autograder notebook.
+type AutograderOptions struct {
+	// RecordProvenance instructs ToAutograderWithOptions to record the master
+	// cell of each autograder cell in the cell metadata, see Provenance.
+	RecordProvenance bool
+}
+
+// ToAutograderWithOptions is ToAutograder with the conversion configured
+// by options. A nil options is equivalent to ToAutograder.
+func (n *Notebook) ToAutograderWithOptions(options *AutograderOptions) (*Notebook, error) {
+	master := n
+	// Cell tags are equivalent to the magic markers.
+	n, err := n.withTagsApplied()
+	if err != nil {
+		return nil, err
+	}
+	n, err = n.withIncludes()
+	if err != nil {
+		return nil, err
+	}
+	manifest := newManifestBuilder()
 	// Assignment metadata is global for the notebook.
 	assignmentMetadata := make(map[string]interface{})
 	var assignmentID string
@@ -697,6 +1173,22 @@ func (n *Notebook) ToAutograder() (*Notebook, error) {
 	// Exercise context cells are code cells marked with # EXERCISE CONTEXT.
 	// They are removed from the student notebook.
 	var exerciseContext []*Cell
+	// points maps exercise IDs to the points of all their tests, keyed by
+	// Class.method for unit test methods and by the name for inline tests.
+	// Recording all tests keeps the possible points of an exercise the same
+	// for all submissions, even if some tests crash.
+	points := make(map[string]map[string]float64)
+	// pointsCells are the cells of the points files, filled in when all tests
+	// are known.
+	pointsCells := make(map[string]*Cell)
+	addPoints := func(name string) {
+		if exerciseID == "" {
+			return
+		}
+		if _, ok := points[exerciseID][name]; !ok {
+			points[exerciseID][name] = 1
+		}
+	}
 	transformed, err := n.MapCells(func(cell *Cell) ([]*Cell, error) {
 		source := cell.Source
 		if cell.Type == "markdown" {
@@ -731,10 +1223,64 @@ func (n *Notebook) ToAutograder() (*Notebook, error) {
 						return nil, fmt.Errorf("exercise_id is not a string, but %s", reflect.TypeOf(v))
 					}
 					exerciseID = id
+					e := manifest.exercise(id)
+					e.Title = exerciseTitle(exerciseMetadata, cell.Source)
+					e.Metadata = exerciseMetadata
 				}
 				glog.V(3).Infof("parsed metadata: %s", exerciseMetadata)
 				// Reset the exercise context.
 				exerciseContext = nil
+				weights, err := parsePoints(exerciseMetadata)
+				if err != nil {
+					return nil, err
+				}
+				parameters, err := parseParameters(exerciseMetadata)
+				if err != nil {
+					return nil, err
+				}
+				limits, err := parseLimits(exerciseMetadata)
+				if err != nil {
+					return nil, err
+				}
+				// Store the points of the tests, the parameter declarations
+				// and the resource limits for the autograder.
+				var files []*Cell
+				addFile := func(filename string, v interface{}) error {
+					data, err := marshalJSON(v)
+					if err != nil {
+						return fmt.Errorf("error serializing %s: %s", filename, err)
+					}
+					files = append(files, &Cell{
+						Type:     "code",
+						Metadata: cloneMetadata(exerciseMetadata, "filename", filename, "assignment_id", assignmentID),
+						Source:   string(data),
+					})
+					return nil
+				}
+				if _, ok := pointsCells[exerciseID]; exerciseID != "" && !ok {
+					points[exerciseID] = make(map[string]float64)
+					if err := addFile(PointsFilename, nil); err != nil {
+						return nil, err
+					}
+					pointsCells[exerciseID] = files[len(files)-1]
+				}
+				if exerciseID != "" {
+					// The weighted tests are scored even if they do not exist.
+					for name, weight := range weights {
+						points[exerciseID][name] = weight
+					}
+				}
+				if parameters != nil {
+					if err := addFile(ParametersFilename, parameters); err != nil {
+						return nil, err
+					}
+				}
+				if limits != nil {
+					if err := addFile(LimitsFilename, limits); err != nil {
+						return nil, err
+					}
+				}
+				return files, nil
 			}
 		}
 		if cell.Type != "code" {
@@ -778,6 +1324,12 @@ func (n *Notebook) ToAutograder() (*Notebook, error) {
 				}
 			}
 			glog.V(3).Infof("parts: %q", parts)
+			addPoints(name)
+			if exerciseID != "" {
+				e := manifest.exercise(exerciseID)
+				e.InlineTests = append(e.InlineTests, name)
+				e.ContextFiles = append(e.ContextFiles, name+"_context.py")
+			}
 			return []*Cell{
 				// Store the context and the inline test itself into separate files,
 				// which will be used by the autograder to synthesize a complete inline test.
@@ -810,6 +1362,13 @@ func (n *Notebook) ToAutograder() (*Notebook, error) {
 				imports = append(imports, "import "+m[1]+"\n")
 			}
 			text = strings.Join(imports, "") + text
+			for _, m := range testMethodRegex.FindAllStringSubmatch(text, -1) {
+				addPoints(strings.TrimSuffix(filename, ".py") + "." + m[1])
+			}
+			if exerciseID != "" {
+				e := manifest.exercise(exerciseID)
+				e.UnitTests = append(e.UnitTests, strings.TrimSuffix(filename, ".py"))
+			}
 			glog.V(3).Infof("metadata: %v, exercise_id: %q", exerciseMetadata, exerciseID)
 			glog.V(3).Infof("parsed unit test: %s\n", text)
 			return []*Cell{&Cell{
@@ -858,6 +1417,10 @@ func (n *Notebook) ToAutograder() (*Notebook, error) {
 			filename := name + ".py"
 			// Cut the magic string.
 			source = source[m[1]:]
+			if exerciseID != "" {
+				e := manifest.exercise(exerciseID)
+				e.Templates = append(e.Templates, name)
+			}
 			return []*Cell{&Cell{
 				Type:     "code",
 				Metadata: cloneMetadata(exerciseMetadata, "filename", filename, "assignment_id", assignmentID),
@@ -878,7 +1441,7 @@ if __name__ == '__main__':
   source = submission_source.source
   formatted_source = pygments.highlight(source, lexers.PythonLexer(), formatters.HtmlFormatter())
   tmpl = jinja2.Template(template)
-  sys.stdout.write(tmpl.render(results=data['results'], formatted_source=formatted_source, logs=data['logs']))
+  sys.stdout.write(tmpl.render(results=data['results'], formatted_source=formatted_source, logs=data['logs'], points=data.get('points'), tests=data.get('tests')))
 `,
 			}}, nil
 		}
@@ -888,6 +1451,32 @@ if __name__ == '__main__':
 	if err != nil {
 		return nil, err
 	}
+	for id, cell := range pointsCells {
+		data, err := marshalJSON(points[id])
+		if err != nil {
+			return nil, fmt.Errorf("error serializing %s: %s", PointsFilename, err)
+		}
+		cell.Source = string(data)
+	}
+	if options != nil && options.RecordProvenance {
+		transformed.recordProvenance(master)
+	}
+	if assignmentID != "" {
+		// Describe the generated files in the assignment manifest.
+		var languages []string
+		if l, ok := assignmentMetadata["language"].(string); ok {
+			languages = []string{l}
+		} else {
+			for _, l := range n.Languages() {
+				languages = append(languages, l.String())
+			}
+		}
+		cell, err := manifest.build(assignmentID, languages, transformed.Cells)
+		if err != nil {
+			return nil, err
+		}
+		transformed.Cells = append(transformed.Cells, cell)
+	}
 	transformed.Metadata = assignmentMetadata
 	return transformed, nil
 }
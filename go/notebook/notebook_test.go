@@ -1,6 +1,8 @@
 package notebook
 
 import (
+	"encoding/json"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
@@ -150,6 +152,31 @@ x = 1
 	# Your solution here
 	# Junk2`},
 		},
+		{
+			name:  "SolutionLine1",
+			input: []string{"%%solution\nx = 1 # SOLUTION\nprint(x)"},
+			want:  []string{"x = ...\nprint(x)"},
+		},
+		{
+			name:  "SolutionLine2_NotAssignment",
+			input: []string{"%%solution\ndef f(x):\n    print(x == 1, sep='=') # SOLUTION\n    return x"},
+			want:  []string{"def f(x):\n    ...\n    return x"},
+		},
+		{
+			name:  "SolutionLine3_Operators",
+			input: []string{"%%solution\nx += f(a=1) # SOLUTION\ny: int = 2 # SOLUTION\nz <<= 1 # SOLUTION\na = b = 3 # SOLUTION"},
+			want:  []string{"x += ...\ny: int = ...\nz <<= ...\na = b = ..."},
+		},
+		{
+			name:  "SolutionLine4_NoPrompt",
+			input: []string{"%%solution\nimport math # SOLUTION NO PROMPT\nx = math.pi # SOLUTION"},
+			want:  []string{"x = ..."},
+		},
+		{
+			name:  "SolutionLine5_WithBlock",
+			input: []string{"%%solution\nx = 1 # SOLUTION\n# BEGIN SOLUTION\ny = 2\n# END SOLUTION\nprint(x, y)"},
+			want:  []string{"x = ...\n...\nprint(x, y)"},
+		},
 		{
 			name:  "Unittest1",
 			input: []string{"# BEGIN UNITTEST\nx = 1\n# END UNITTEST"},
@@ -478,3 +505,205 @@ cde`,
 		}
 	}
 }
+
+func TestPreserveUnknown(t *testing.T) {
+	input := `{"nbformat": 4, "nbformat_minor": 5, "metadata": {}, "extension": {"a": 1}, "cells": [
+{"id": "abc", "cell_type": "markdown", "metadata": {}, "source": ["## Title"]},
+{"id": "def", "cell_type": "raw", "metadata": {"format": "text/x-python"}, "source": ["raw"]},
+{"id": "ghi", "cell_type": "code", "execution_count": 1, "metadata": {}, "outputs": [
+ {"output_type": "display_data", "data": {"text/plain": ["x"]}, "metadata": {}, "transient": {"display_id": "d1"}}],
+ "source": ["x = 1"]}]}`
+	n, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("Parse() returned error %s, want success", err)
+	}
+	var want map[string]interface{}
+	err = json.Unmarshal([]byte(input), &want)
+	if err != nil {
+		t.Fatalf("error parsing input JSON: %s", err)
+	}
+	b, err := n.MarshalWithOptions(&MarshalOptions{PreserveUnknown: true})
+	if err != nil {
+		t.Fatalf("MarshalWithOptions() returned error %s, want success", err)
+	}
+	var got map[string]interface{}
+	err = json.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatalf("error parsing output JSON: %s", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lossless round trip changed the notebook:\ngot  %v\nwant %v", got, want)
+	}
+	// The default mode drops the unknown fields.
+	b, err = n.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() returned error %s, want success", err)
+	}
+	got = nil
+	err = json.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatalf("error parsing output JSON: %s", err)
+	}
+	if _, ok := got["extension"]; ok {
+		t.Errorf("Marshal() preserved unknown field, want dropped: %s", string(b))
+	}
+	if strings.Contains(string(b), "transient") {
+		t.Errorf("Marshal() preserved unknown output field, want dropped: %s", string(b))
+	}
+	// Without the cell ids, the notebook is still valid.
+	if errs := Validate(b); len(errs) > 0 {
+		t.Errorf("Validate(Marshal()) returned errors:\n%s\nfor\n%s", errs, b)
+	}
+}
+
+func TestPreserveUnknownStudent(t *testing.T) {
+	input := `{"nbformat": 4, "nbformat_minor": 5, "metadata": {}, "cells": [
+{"id": "abc", "cell_type": "markdown", "metadata": {}, "source": ["## Title\n", "` + "```" + `\n", "# EXERCISE METADATA\n", "exercise_id: ex1\n", "` + "```" + `"]},
+{"id": "def", "cell_type": "code", "execution_count": null, "metadata": {}, "outputs": [], "source": ["# MASTER ONLY\nx = 1"]},
+{"id": "ghi", "cell_type": "code", "execution_count": null, "metadata": {}, "outputs": [], "source": ["%%solution\nx = 1"]}]}`
+	n, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("Parse() returned error %s, want success", err)
+	}
+	n, err = n.ToStudent(AnyLanguage, &StudentOptions{
+		InsertCheckCell:   true,
+		CheckCellTemplate: "Check()",
+	})
+	if err != nil {
+		t.Fatalf("ToStudent() returned error %s, want success", err)
+	}
+	b, err := n.MarshalWithOptions(&MarshalOptions{PreserveUnknown: true})
+	if err != nil {
+		t.Fatalf("MarshalWithOptions() returned error %s, want success", err)
+	}
+	out, err := Parse(b)
+	if err != nil {
+		t.Fatalf("Parse() returned error %s, want success", err)
+	}
+	var ids []string
+	for _, cell := range out.Cells {
+		ids = append(ids, cell.ID())
+	}
+	if len(ids) != 3 || ids[0] != "abc" || ids[1] != "ghi" || ids[2] == "" || ids[2] == "abc" || ids[2] == "ghi" {
+		t.Errorf("got cell ids %q, want [abc ghi <generated>]", ids)
+	}
+}
+
+func TestMarshalFormat(t *testing.T) {
+	input := `{"nbformat": 4, "nbformat_minor": 2, "metadata": {"z": 1, "a": "<b>"}, "cells": [
+{"cell_type": "markdown", "metadata": {}, "source": "こんにちは\n& more"},
+{"cell_type": "code", "execution_count": null, "metadata": {}, "outputs": [], "source": ""}]}`
+	want := `{
+ "cells": [
+  {
+   "cell_type": "markdown",
+   "metadata": {},
+   "source": [
+    "こんにちは\n",
+    "& more"
+   ]
+  },
+  {
+   "cell_type": "code",
+   "execution_count": null,
+   "metadata": {},
+   "outputs": [],
+   "source": []
+  }
+ ],
+ "metadata": {
+  "a": "<b>",
+  "z": 1
+ },
+ "nbformat": 4,
+ "nbformat_minor": 2
+}
+`
+	n, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("Parse() returned error %s, want success", err)
+	}
+	b, err := n.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() returned error %s, want success", err)
+	}
+	if string(b) != want {
+		t.Errorf("Marshal() returned\n%s\nwant\n%s", string(b), want)
+	}
+	// Serialization is stable.
+	n, err = Parse(b)
+	if err != nil {
+		t.Fatalf("Parse() returned error %s, want success", err)
+	}
+	b, err = n.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() returned error %s, want success", err)
+	}
+	if string(b) != want {
+		t.Errorf("second Marshal() returned\n%s\nwant\n%s", string(b), want)
+	}
+}
+
+func TestParseLanguage(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Language
+	}{
+		{"", AnyLanguage},
+		{"en", English},
+		{"JA", Japanese},
+		{"ko", "ko"},
+		{"es-mx", "es-MX"},
+		{"zh-hant-tw", "zh-Hant-TW"},
+		{"es-419", "es-419"},
+	}
+	for _, tt := range tests {
+		got, err := ParseLanguage(tt.input)
+		if err != nil {
+			t.Errorf("ParseLanguage(%q) returned error %s, want success", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseLanguage(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+	for _, input := range []string{"e", "en_US", "english-language-tag", "en-"} {
+		if _, err := ParseLanguage(input); err == nil {
+			t.Errorf("ParseLanguage(%q) returned success, want error", input)
+		}
+	}
+}
+
+func TestFilterText(t *testing.T) {
+	tests := []struct {
+		name  string
+		lang  Language
+		input string
+		want  string
+	}{
+		{"NoMarker", "ko", "text", "text"},
+		{"Any", AnyLanguage, "**lang:en**a\n**lang:ko**b", "a\nb"},
+		{"Single", "ko", "## Title\n**lang:ko**텍스트", "## Title\n텍스트"},
+		{"SingleOther", "es", "## Title\n**lang:ko**텍스트", ""},
+		{"Sections", "es", "# Title **lang:en**\nText\n\n**lang:es**\nTexto\n\n**lang:ko**\n텍스트", "\nTexto"},
+		{"FirstSection", "en", "# Title **lang:en**\nText\n\n**lang:es**\nTexto", "# Title \nText"},
+		{"Region", "es-MX", "**lang:es**Texto\n\n**lang:en**Text", "Texto"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.lang.filterText(tt.input)
+			if got != tt.want {
+				t.Errorf("filterText(%q) in %q = %q, want %q", tt.input, tt.lang, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLanguages(t *testing.T) {
+	n := createNotebook([]string{"## **lang:ko**a\n**lang:es-mx**b", "## **lang:en**c", "**lang:fr**code"})
+	got := n.Languages()
+	want := []Language{"en", "es-MX", "ko"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Languages() = %q, want %q", got, want)
+	}
+}
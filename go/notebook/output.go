@@ -0,0 +1,245 @@
+package notebook
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Output types as defined by nbformat v4.
+const (
+	StreamOutput        = "stream"
+	DisplayDataOutput   = "display_data"
+	ExecuteResultOutput = "execute_result"
+	ErrorOutput         = "error"
+)
+
+// MIMEBundle maps a MIME type to the data of that type, e.g. "text/plain",
+// "text/html" or "image/png". Textual values are stored as a single string
+// (multi-line strings are joined on parsing and split on serialization),
+// JSON values ("application/json" and "application/*+json") are stored as
+// parsed JSON, and binary values (e.g. images) are stored as base64 strings.
+type MIMEBundle map[string]interface{}
+
+// Output represents one entry of the "outputs" list of a code cell.
+type Output struct {
+	// Type is the output_type: "stream", "display_data", "execute_result" or "error".
+	Type string
+	// Name is the name of the stream ("stdout" or "stderr"). Only used in stream outputs.
+	Name string
+	// Text is the text written to the stream. Only used in stream outputs.
+	Text string
+	// Data is the MIME bundle of display_data and execute_result outputs.
+	Data MIMEBundle
+	// Metadata is the metadata of display_data and execute_result outputs.
+	Metadata map[string]interface{}
+	// ExecutionCount is the execution_count of execute_result outputs.
+	// nil means the execution count is null.
+	ExecutionCount *int
+	// EName is the name of the exception. Only used in error outputs.
+	EName string
+	// EValue is the string value of the exception. Only used in error outputs.
+	EValue string
+	// Traceback is the list of traceback lines. Only used in error outputs.
+	Traceback []string
+	// Raw is the raw parsed JSON of the output. It is only written back on
+	// serialization with MarshalOptions.PreserveUnknown, and only for the fields
+	// that are not represented by other fields of Output (e.g. "transient").
+	Raw map[string]interface{}
+}
+
+// modelledOutputFields are the fields of the output that are modelled explicitly,
+// and are never copied from the raw JSON.
+var modelledOutputFields = map[string]bool{
+	"output_type":     true,
+	"name":            true,
+	"text":            true,
+	"data":            true,
+	"metadata":        true,
+	"execution_count": true,
+	"ename":           true,
+	"evalue":          true,
+	"traceback":       true,
+}
+
+// isJSONMIME returns true for MIME types that carry JSON values
+// rather than text.
+func isJSONMIME(mime string) bool {
+	return mime == "application/json" ||
+		(strings.HasPrefix(mime, "application/") && strings.HasSuffix(mime, "+json"))
+}
+
+// isSplitMIME returns true for MIME types that Jupyter stores
+// as a list of lines.
+func isSplitMIME(mime string) bool {
+	if isJSONMIME(mime) {
+		return false
+	}
+	return strings.HasPrefix(mime, "text/") ||
+		mime == "application/javascript" ||
+		mime == "image/svg+xml"
+}
+
+// parseMIMEBundle parses the "data" field of an output or a cell attachment.
+func parseMIMEBundle(v interface{}) (MIMEBundle, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("MIME bundle is not a map but %s", reflect.TypeOf(v))
+	}
+	ret := make(MIMEBundle)
+	for mime, value := range m {
+		if isJSONMIME(mime) {
+			ret[mime] = value
+			continue
+		}
+		text, err := parseText(value)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing %s data: %s", mime, err)
+		}
+		ret[mime] = text
+	}
+	return ret, nil
+}
+
+// json returns a JSON-like map representing a MIME bundle.
+func (b MIMEBundle) json() map[string]interface{} {
+	ret := make(map[string]interface{})
+	for mime, value := range b {
+		if text, ok := value.(string); ok && isSplitMIME(mime) {
+			ret[mime] = marshalText(text)
+			continue
+		}
+		ret[mime] = value
+	}
+	return ret
+}
+
+// parseExecutionCount parses an execution_count value, which is either
+// null or an integer.
+func parseExecutionCount(v interface{}) (*int, error) {
+	if v == nil {
+		return nil, nil
+	}
+	val, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("execution_count is not a number but %s", reflect.TypeOf(v))
+	}
+	count := int(val)
+	return &count, nil
+}
+
+// parseOutput parses one element of the cell "outputs" list.
+func parseOutput(v interface{}) (*Output, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("output is not a map but %s", reflect.TypeOf(v))
+	}
+	ret := &Output{Raw: m}
+	ret.Type, ok = m["output_type"].(string)
+	if !ok {
+		return nil, fmt.Errorf("output_type is not a string but %s",
+			reflect.TypeOf(m["output_type"]))
+	}
+	var err error
+	switch ret.Type {
+	case StreamOutput:
+		ret.Name, ok = m["name"].(string)
+		if !ok {
+			return nil, fmt.Errorf("output name is not a string but %s",
+				reflect.TypeOf(m["name"]))
+		}
+		ret.Text, err = parseText(m["text"])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse text: %s", err)
+		}
+	case DisplayDataOutput, ExecuteResultOutput:
+		ret.Data, err = parseMIMEBundle(m["data"])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s data: %s", ret.Type, err)
+		}
+		if v, ok := m["metadata"]; ok {
+			ret.Metadata, ok = v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("output metadata is not a map but %s", reflect.TypeOf(v))
+			}
+		}
+		if ret.Type == ExecuteResultOutput {
+			ret.ExecutionCount, err = parseExecutionCount(m["execution_count"])
+			if err != nil {
+				return nil, err
+			}
+		}
+	case ErrorOutput:
+		ret.EName, _ = m["ename"].(string)
+		ret.EValue, _ = m["evalue"].(string)
+		tb, ok := m["traceback"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("traceback is not a list but %s", reflect.TypeOf(m["traceback"]))
+		}
+		for _, x := range tb {
+			line, ok := x.(string)
+			if !ok {
+				return nil, fmt.Errorf("traceback has not a string but %s", reflect.TypeOf(x))
+			}
+			ret.Traceback = append(ret.Traceback, line)
+		}
+	default:
+		return nil, fmt.Errorf("unknown output_type %q", ret.Type)
+	}
+	return ret, nil
+}
+
+// json returns a JSON-like map representing an output.
+func (o *Output) json(opts *MarshalOptions) map[string]interface{} {
+	ret := make(map[string]interface{})
+	if opts != nil && opts.PreserveUnknown {
+		copyUnknown(ret, o.Raw, modelledOutputFields)
+	}
+	ret["output_type"] = o.Type
+	switch o.Type {
+	case StreamOutput:
+		ret["name"] = o.Name
+		ret["text"] = marshalText(o.Text)
+	case DisplayDataOutput, ExecuteResultOutput:
+		ret["data"] = o.Data.json()
+		if o.Metadata != nil {
+			ret["metadata"] = o.Metadata
+		} else {
+			ret["metadata"] = make(map[string]interface{})
+		}
+		if o.Type == ExecuteResultOutput {
+			if o.ExecutionCount != nil {
+				ret["execution_count"] = *o.ExecutionCount
+			} else {
+				ret["execution_count"] = nil
+			}
+		}
+	case ErrorOutput:
+		ret["ename"] = o.EName
+		ret["evalue"] = o.EValue
+		traceback := []interface{}{}
+		for _, line := range o.Traceback {
+			traceback = append(traceback, line)
+		}
+		ret["traceback"] = traceback
+	}
+	return ret
+}
+
+// parseAttachments parses the "attachments" field of a markdown or raw cell,
+// which maps attachment file names to MIME bundles.
+func parseAttachments(v interface{}) (map[string]MIMEBundle, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cell.attachments is not a map but %s", reflect.TypeOf(v))
+	}
+	ret := make(map[string]MIMEBundle)
+	for name, x := range m {
+		bundle, err := parseMIMEBundle(x)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing attachment %q: %s", name, err)
+		}
+		ret[name] = bundle
+	}
+	return ret, nil
+}
@@ -0,0 +1,127 @@
+package notebook
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// roundTrip parses the notebook, serializes it back and returns both
+// the original and the serialized JSON in the parsed form.
+func roundTrip(t *testing.T, input string) (want, got map[string]interface{}) {
+	t.Helper()
+	n, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("Parse(%s) returned error %s, want success", input, err)
+	}
+	b, err := n.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() returned error %s, want success", err)
+	}
+	err = json.Unmarshal([]byte(input), &want)
+	if err != nil {
+		t.Fatalf("error parsing input JSON: %s", err)
+	}
+	err = json.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatalf("error parsing output JSON: %s\n%s", err, string(b))
+	}
+	return want, got
+}
+
+func TestOutputRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{
+			name: "Stream",
+			input: `{"nbformat": 4, "nbformat_minor": 2, "metadata": {}, "cells": [
+{"cell_type": "code", "execution_count": 3, "metadata": {}, "source": ["print(1)\n", "print(2)"],
+ "outputs": [
+  {"output_type": "stream", "name": "stdout", "text": ["1\n", "2\n"]},
+  {"output_type": "stream", "name": "stderr", "text": ["warning\n"]},
+  {"output_type": "stream", "name": "stdout", "text": ["3\n"]}
+ ]}]}`,
+		},
+		{
+			name: "DisplayData",
+			input: `{"nbformat": 4, "nbformat_minor": 2, "metadata": {}, "cells": [
+{"cell_type": "code", "execution_count": 1, "metadata": {}, "source": ["plot()"],
+ "outputs": [
+  {"output_type": "display_data", "metadata": {"needs_background": "light"},
+   "data": {"image/png": "iVBORw0KGgo=\n", "text/plain": ["<Figure size 432x288 with 1 Axes>"]}}
+ ]}]}`,
+		},
+		{
+			name: "ExecuteResult",
+			input: `{"nbformat": 4, "nbformat_minor": 2, "metadata": {}, "cells": [
+{"cell_type": "code", "execution_count": 7, "metadata": {}, "source": ["df"],
+ "outputs": [
+  {"output_type": "execute_result", "execution_count": 7, "metadata": {},
+   "data": {"text/html": ["<table>\n", "</table>"], "text/plain": ["   a\n", "0  1"],
+            "application/json": {"a": [1, 2]}}}
+ ]}]}`,
+		},
+		{
+			name: "Error",
+			input: `{"nbformat": 4, "nbformat_minor": 2, "metadata": {}, "cells": [
+{"cell_type": "code", "execution_count": null, "metadata": {}, "source": ["1/0"],
+ "outputs": [
+  {"output_type": "error", "ename": "ZeroDivisionError", "evalue": "division by zero",
+   "traceback": ["Traceback", "ZeroDivisionError: division by zero"]}
+ ]}]}`,
+		},
+		{
+			name: "Attachments",
+			input: `{"nbformat": 4, "nbformat_minor": 2, "metadata": {}, "cells": [
+{"cell_type": "markdown", "metadata": {}, "source": ["![img](attachment:a.png)"],
+ "attachments": {"a.png": {"image/png": "iVBORw0KGgo="}}}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, got := roundTrip(t, tt.input)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip changed the notebook:\ngot  %v\nwant %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseOutputErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{
+			name:  "UnknownType",
+			input: `{"output_type": "bogus"}`,
+		},
+		{
+			name:  "StreamWithoutName",
+			input: `{"output_type": "stream", "text": "x"}`,
+		},
+		{
+			name:  "DataNotMap",
+			input: `{"output_type": "display_data", "data": [], "metadata": {}}`,
+		},
+		{
+			name:  "BadExecutionCount",
+			input: `{"output_type": "execute_result", "data": {}, "metadata": {}, "execution_count": "1"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v interface{}
+			err := json.Unmarshal([]byte(tt.input), &v)
+			if err != nil {
+				t.Fatalf("error parsing test input: %s", err)
+			}
+			_, err = parseOutput(v)
+			if err == nil {
+				t.Errorf("parseOutput(%s) returned success, want error", tt.input)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package notebook
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// PointsFilename is the name of the file with the points of all tests
+// in the autograder directory of an exercise.
+const PointsFilename = "points.json"
+
+// PointsKey is the exercise metadata key with the point weights of tests.
+// It maps the test names to the number of points, e.g.
+//
+//	points:
+//	  HelloTest.test_hello: 2
+//	  HelloInline: 0.5
+//
+// Unit test methods are named as Class.method, inline tests by their name.
+// The tests that are not listed are worth one point.
+const PointsKey = "points"
+
+// parsePoints returns the point weights from the exercise metadata,
+// or nil if the metadata does not specify them.
+func parsePoints(exerciseMetadata map[string]interface{}) (map[string]float64, error) {
+	v, ok := exerciseMetadata[PointsKey]
+	if !ok {
+		return nil, nil
+	}
+	data, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not a map, but %s", PointsKey, reflect.TypeOf(v))
+	}
+	ret := make(map[string]float64)
+	for name, v := range data {
+		var points float64
+		switch x := v.(type) {
+		case float64:
+			points = x
+		case int:
+			points = float64(x)
+		default:
+			return nil, fmt.Errorf("%s of %q is not a number, but %s", PointsKey, name, reflect.TypeOf(v))
+		}
+		if points < 0 {
+			return nil, fmt.Errorf("%s of %q is negative: %v", PointsKey, name, points)
+		}
+		ret[name] = points
+	}
+	return ret, nil
+}
@@ -0,0 +1,67 @@
+package notebook
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPoints(t *testing.T) {
+	n := taggedNotebook([]string{
+		"```\n# ASSIGNMENT METADATA\nassignment_id: a1\n```",
+		"```\n# EXERCISE METADATA\nexercise_id: ex1\npoints:\n  XTest.test_x: 2\n  Test1: 0.5\n```",
+		"%%solution\nx = 1",
+		"%%inlinetest Test1\nassert x == 1",
+		"# BEGIN UNITTEST\nclass XTest(unittest.TestCase):\n  def test_x(self):\n    pass\n  def test_y(self):\n    pass\n# END UNITTEST",
+	}, make([][]interface{}, 5))
+	autograder, err := n.ToAutograder()
+	if err != nil {
+		t.Fatalf("ToAutograder() returned error %s", err)
+	}
+	var source string
+	for _, cell := range autograder.Cells {
+		if cell.Metadata["filename"] == PointsFilename {
+			if cell.Metadata["exercise_id"] != "ex1" {
+				t.Errorf("%s has exercise_id %v, want ex1", PointsFilename, cell.Metadata["exercise_id"])
+			}
+			source = cell.Source
+		}
+	}
+	var got map[string]float64
+	if err := json.Unmarshal([]byte(source), &got); err != nil {
+		t.Fatalf("error parsing %s %q: %s", PointsFilename, source, err)
+	}
+	// All tests are listed, with one point for the tests without weight.
+	want := map[string]float64{"XTest.test_x": 2, "XTest.test_y": 1, "Test1": 0.5}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %v, want %v", PointsFilename, got, want)
+	}
+	// The points are kept in the solution cell metadata of the student notebook,
+	// which must be serializable.
+	student, err := n.ToStudent(AnyLanguage, nil)
+	if err != nil {
+		t.Fatalf("ToStudent() returned error %s", err)
+	}
+	if _, err := student.Marshal(); err != nil {
+		t.Errorf("student.Marshal() returned error %s", err)
+	}
+}
+
+func TestParsePointsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]interface{}
+	}{
+		{"not a map", map[string]interface{}{"points": 5.0}},
+		{"not a number", map[string]interface{}{"points": map[string]interface{}{"Test1": "a"}}},
+		{"negative", map[string]interface{}{"points": map[string]interface{}{"Test1": -1.0}}},
+	}
+	for _, tt := range tests {
+		if got, err := parsePoints(tt.metadata); err == nil {
+			t.Errorf("%s: parsePoints(%v) = %v, want error", tt.name, tt.metadata, got)
+		}
+	}
+	if got, err := parsePoints(map[string]interface{}{"exercise_id": "ex1"}); got != nil || err != nil {
+		t.Errorf("parsePoints() without points = %v, %v, want nil, nil", got, err)
+	}
+}
@@ -0,0 +1,290 @@
+package notebook
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Profiles bundle the platform-specific parts of the student notebook, so that
+// one master notebook produces consistent student notebooks for Colab, Jupyter
+// with the upload_it extension, JupyterLab and offline use. A profile is applied
+// by ToStudent when set in StudentOptions.
+
+// PreamblePlacement tells where the preamble cell is inserted.
+type PreamblePlacement int
+
+const (
+	// PreambleFirst inserts the preamble as the first cell of the notebook.
+	PreambleFirst PreamblePlacement = iota
+	// PreambleAfterTitle inserts the preamble after the first cell
+	// if it is a markdown cell, e.g. the title of the assignment.
+	PreambleAfterTitle
+)
+
+// CheckCellPlacement tells where the check cell of an exercise is inserted.
+type CheckCellPlacement int
+
+const (
+	// CheckAfterSolution inserts the check cell right after the solution cell.
+	CheckAfterSolution CheckCellPlacement = iota
+	// CheckAfterExercise inserts the check cell after the last cell of the
+	// exercise, so that the student tests come before it.
+	CheckAfterExercise
+)
+
+// DefaultServerURL is the URL of the upload server used by the profiles
+// if ServerURL is not set.
+const DefaultServerURL = "http://localhost:8000"
+
+// Profile describes the student notebook for a particular platform.
+type Profile struct {
+	// Name is the name of the profile, e.g. "colab".
+	Name string
+	// Preamble is the source of the cell inserted into the student notebook,
+	// or empty if no preamble is needed. {{.ServerURL}} is replaced with
+	// the server URL.
+	Preamble string
+	// PreambleType is the cell type of the preamble, "code" or "markdown".
+	PreambleType string
+	// PreambleMetadata is stored into the metadata of the preamble cell.
+	PreambleMetadata map[string]interface{}
+	// PreamblePlacement tells where to insert the preamble.
+	PreamblePlacement PreamblePlacement
+	// CheckCellTemplate is the template of the check cell inserted for each
+	// exercise, see StudentOptions. Empty means no check cells.
+	CheckCellTemplate string
+	// CheckCellPlacement tells where to insert the check cells.
+	CheckCellPlacement CheckCellPlacement
+	// Metadata is merged into the notebook metadata. The keys with nil
+	// values are removed from the notebook metadata.
+	Metadata map[string]interface{}
+	// ServerURL is the URL of the upload server. DefaultServerURL is used
+	// if empty.
+	ServerURL string
+}
+
+// pythonKernelspec is the kernelspec of the student notebooks.
+var pythonKernelspec = map[string]interface{}{
+	"name":         "python3",
+	"display_name": "Python 3",
+	"language":     "python",
+}
+
+const colabPreamble = `#@title Submission snippet
+#@markdown Please [login to server]({{.ServerURL}}/login) to get a JWT token and paste it here.
+SERVER_URL = '{{.ServerURL}}'
+JWT_TOKEN = "" #@param
+
+import json
+import requests
+
+from google.colab import _message as google_message
+from IPython.core import display
+
+def Submit(exercise_id=None):
+  if JWT_TOKEN == "":
+    display.display(display.HTML("Please get JWT_TOKEN by visiting " +
+                                 "<a href='" + SERVER_URL + "/login'>Login page</a>"))
+    raise Exception("Please set JWT_TOKEN")
+  notebook = google_message.blocking_request(
+    "get_ipynb", request="", timeout_sec=120)["ipynb"]
+  params = {}
+  if exercise_id:
+    params["exercise_id"] = exercise_id
+  r = requests.post(SERVER_URL + "/upload", files={"notebook": json.dumps(notebook)},
+                    headers={"Authorization": "Bearer " + JWT_TOKEN},
+                    params=params)
+  if r.status_code == 401:
+    display.display(display.HTML("Not authorized: is your JWT_TOKEN correct? " +
+                                 "Please get JWT_TOKEN by visiting " +
+                                 "<a target='_blank' href='" + SERVER_URL + "/login'>Login page</a>"))
+  display.display(display.HTML(r.content.decode('utf-8')))
+`
+
+const jupyterLabPreamble = `# Submission snippet: please login to {{.ServerURL}}/login
+# to get a JWT token and paste it here.
+SERVER_URL = '{{.ServerURL}}'
+JWT_TOKEN = ""
+# The file name of this notebook. Save the notebook before submitting.
+NOTEBOOK_PATH = ""
+
+import json
+import requests
+
+from IPython.core import display
+
+def Submit(exercise_id=None):
+  if JWT_TOKEN == "":
+    display.display(display.HTML("Please get JWT_TOKEN by visiting " +
+                                 "<a href='" + SERVER_URL + "/login'>Login page</a>"))
+    raise Exception("Please set JWT_TOKEN")
+  if NOTEBOOK_PATH == "":
+    raise Exception("Please set NOTEBOOK_PATH to the file name of this notebook")
+  with open(NOTEBOOK_PATH) as f:
+    notebook = json.load(f)
+  params = {}
+  if exercise_id:
+    params["exercise_id"] = exercise_id
+  r = requests.post(SERVER_URL + "/upload", files={"notebook": json.dumps(notebook)},
+                    headers={"Authorization": "Bearer " + JWT_TOKEN},
+                    params=params)
+  if r.status_code == 401:
+    display.display(display.HTML("Not authorized: is your JWT_TOKEN correct?"))
+  display.display(display.HTML(r.content.decode('utf-8')))
+`
+
+const nbextensionPreamble = `To submit the notebook for checking, save it and press the
+**Upload it** button on the toolbar.`
+
+var profiles = map[string]*Profile{
+	"colab": &Profile{
+		Name:              "colab",
+		Preamble:          colabPreamble,
+		PreambleType:      "code",
+		PreambleMetadata:  map[string]interface{}{"cellView": "form"},
+		PreamblePlacement: PreambleFirst,
+		CheckCellTemplate: `Submit("{{.exercise_id}}")`,
+		Metadata: map[string]interface{}{
+			"kernelspec": pythonKernelspec,
+			"colab": map[string]interface{}{
+				"provenance":         []interface{}{},
+				"collapsed_sections": []interface{}{},
+			},
+		},
+	},
+	"jupyter-nbextension": &Profile{
+		Name:              "jupyter-nbextension",
+		Preamble:          nbextensionPreamble,
+		PreambleType:      "markdown",
+		PreamblePlacement: PreambleAfterTitle,
+		Metadata: map[string]interface{}{
+			"kernelspec": pythonKernelspec,
+			"colab":      nil,
+		},
+	},
+	"jupyterlab": &Profile{
+		Name:               "jupyterlab",
+		Preamble:           jupyterLabPreamble,
+		PreambleType:       "code",
+		PreamblePlacement:  PreambleAfterTitle,
+		CheckCellTemplate:  "# Save the notebook and run this cell to submit the exercise.\nSubmit(\"{{.exercise_id}}\")",
+		CheckCellPlacement: CheckAfterExercise,
+		Metadata: map[string]interface{}{
+			"kernelspec": pythonKernelspec,
+			"colab":      nil,
+		},
+	},
+	"offline": &Profile{
+		Name: "offline",
+		Metadata: map[string]interface{}{
+			"kernelspec": pythonKernelspec,
+			"colab":      nil,
+		},
+	},
+}
+
+// ProfileNames returns the sorted names of the predefined profiles.
+func ProfileNames() []string {
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupProfile returns a copy of the predefined profile with the given name,
+// which the caller may modify.
+func LookupProfile(name string) (*Profile, error) {
+	p, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q, want one of %s",
+			name, strings.Join(ProfileNames(), ", "))
+	}
+	ret := *p
+	return &ret, nil
+}
+
+// preambleCell returns the preamble cell of the profile, or nil if the profile
+// has no preamble.
+func (p *Profile) preambleCell() *Cell {
+	if p.Preamble == "" {
+		return nil
+	}
+	url := p.ServerURL
+	if url == "" {
+		url = DefaultServerURL
+	}
+	cellType := p.PreambleType
+	if cellType == "" {
+		cellType = "code"
+	}
+	return &Cell{
+		Type:     cellType,
+		Source:   strings.Replace(p.Preamble, "{{.ServerURL}}", url, -1),
+		Metadata: cloneMetadata(p.PreambleMetadata),
+	}
+}
+
+// apply inserts the preamble into the student notebook and merges the
+// profile metadata. The preamble has no master cell, so its origin is -1.
+func (p *Profile) apply(n *Notebook) {
+	for k, v := range p.Metadata {
+		if v == nil {
+			delete(n.Metadata, k)
+		} else {
+			n.Metadata[k] = v
+		}
+	}
+	cell := p.preambleCell()
+	if cell == nil {
+		return
+	}
+	pos := 0
+	if p.PreamblePlacement == PreambleAfterTitle && len(n.Cells) > 0 && n.Cells[0].Type == "markdown" {
+		pos = 1
+	}
+	n.Cells = append(n.Cells[:pos], append([]*Cell{cell}, n.Cells[pos:]...)...)
+	if n.origins != nil {
+		n.origins = append(n.origins[:pos], append([]int{-1}, n.origins[pos:]...)...)
+	}
+}
+
+// moveCheckCells moves the check cells to the end of their exercises, i.e.
+// before the first cell generated from the next exercise metadata cell.
+// starts holds the sorted indices of the source cells with exercise metadata.
+func (n *Notebook) moveCheckCells(checks map[*Cell]bool, starts []int) {
+	var cells []*Cell
+	var origins []int
+	var pending []*Cell
+	var pendingOrigins []int
+	// next is the start of the exercise following the pending check cells.
+	next := -1
+	flush := func() {
+		cells = append(cells, pending...)
+		origins = append(origins, pendingOrigins...)
+		pending, pendingOrigins, next = nil, nil, -1
+	}
+	for i, cell := range n.Cells {
+		origin := n.origins[i]
+		if next >= 0 && origin >= next {
+			flush()
+		}
+		if !checks[cell] {
+			cells = append(cells, cell)
+			origins = append(origins, origin)
+			continue
+		}
+		pending = append(pending, cell)
+		pendingOrigins = append(pendingOrigins, origin)
+		// The check cells of the last exercise go to the end of the notebook.
+		next = math.MaxInt32
+		if j := sort.SearchInts(starts, origin+1); j < len(starts) {
+			next = starts[j]
+		}
+	}
+	flush()
+	n.Cells, n.origins = cells, origins
+}
@@ -0,0 +1,84 @@
+package notebook
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func profileMaster() *Notebook {
+	n := taggedNotebook([]string{
+		"# Title",
+		"```\n# ASSIGNMENT METADATA\nassignment_id: a1\n```",
+		"```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+		"%%solution\n# BEGIN SOLUTION\nx = 1\n# END SOLUTION",
+		"%%studenttest Test1\nassert x == 1",
+		"```\n# EXERCISE METADATA\nexercise_id: ex2\n```",
+		"%%solution\n# BEGIN SOLUTION\ny = 2\n# END SOLUTION",
+	}, make([][]interface{}, 7))
+	n.Cells[0].Type = "markdown"
+	n.Metadata["colab"] = map[string]interface{}{"name": "master.ipynb"}
+	return n
+}
+
+func TestProfiles(t *testing.T) {
+	tests := []struct {
+		profile string
+		want    []string
+	}{
+		{"colab", []string{"preamble", "# Title", "...", "check ex1", "assert x == 1", "...", "check ex2"}},
+		{"jupyter-nbextension", []string{"# Title", "preamble", "...", "assert x == 1", "..."}},
+		{"jupyterlab", []string{"# Title", "preamble", "...", "assert x == 1", "check ex1", "...", "check ex2"}},
+		{"offline", []string{"# Title", "...", "assert x == 1", "..."}},
+	}
+	for _, tt := range tests {
+		profile, err := LookupProfile(tt.profile)
+		if err != nil {
+			t.Fatalf("LookupProfile(%q) returned error %s", tt.profile, err)
+		}
+		profile.ServerURL = "https://example.com"
+		n := profileMaster()
+		student, err := n.ToStudent(AnyLanguage, &StudentOptions{Profile: profile, RecordProvenance: true})
+		if err != nil {
+			t.Fatalf("%s: ToStudent() returned error %s", tt.profile, err)
+		}
+		var got []string
+		for _, cell := range student.Cells {
+			source := strings.TrimSpace(cell.Source)
+			switch {
+			case profile.Preamble != "" && cell.Source == profile.preambleCell().Source:
+				got = append(got, "preamble")
+				if strings.Contains(cell.Source, "{{.ServerURL}}") {
+					t.Errorf("%s: preamble has unreplaced {{.ServerURL}}", tt.profile)
+				}
+				if _, ok := cell.Metadata[ProvenanceKey]; ok {
+					t.Errorf("%s: preamble has provenance %v", tt.profile, cell.Metadata)
+				}
+			case strings.Contains(source, "Submit(\"ex1\")"):
+				got = append(got, "check ex1")
+			case strings.Contains(source, "Submit(\"ex2\")"):
+				got = append(got, "check ex2")
+			default:
+				got = append(got, strings.Split(source, "\n")[0])
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ToStudent() = %q, want %q", tt.profile, got, tt.want)
+		}
+		if !reflect.DeepEqual(student.Metadata["kernelspec"], pythonKernelspec) {
+			t.Errorf("%s: kernelspec = %v, want %v", tt.profile, student.Metadata["kernelspec"], pythonKernelspec)
+		}
+		if _, ok := student.Metadata["colab"]; ok != (tt.profile == "colab") {
+			t.Errorf("%s: colab metadata = %v", tt.profile, student.Metadata["colab"])
+		}
+		if student.Metadata["assignment_id"] != "a1" {
+			t.Errorf("%s: assignment_id = %v, want a1", tt.profile, student.Metadata["assignment_id"])
+		}
+		if _, ok := n.Metadata["kernelspec"]; ok {
+			t.Errorf("%s: ToStudent() modified the master notebook metadata", tt.profile)
+		}
+	}
+	if _, err := LookupProfile("unknown"); err == nil {
+		t.Errorf("LookupProfile(\"unknown\") returned success, want error")
+	}
+}
@@ -0,0 +1,140 @@
+package notebook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+)
+
+// ProvenanceKey is the cell metadata key under which ToStudent and
+// ToAutograderWithOptions record the provenance of the generated cells.
+const ProvenanceKey = "provenance"
+
+// Provenance links a cell of a generated (student or autograder) notebook
+// to the master notebook cell it was produced from.
+type Provenance struct {
+	// Cell is the index of the master cell.
+	Cell int
+	// ID is the id of the master cell (nbformat 4.5 and later), if any.
+	ID string
+	// Hash is the hash of the master cell source, used to detect whether
+	// the master cell has changed since the notebook was generated.
+	Hash string
+	// SourceHash is the hash of the generated cell source, used to detect
+	// whether the cell has been edited, e.g. by a student, since.
+	SourceHash string
+}
+
+// sourceHash computes the hash of the cell source for Provenance.
+func sourceHash(source string) string {
+	h := sha256.Sum256([]byte(source))
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// json returns the representation of the provenance in cell metadata.
+func (p *Provenance) json() map[string]interface{} {
+	ret := map[string]interface{}{
+		"cell": p.Cell,
+		"hash": p.Hash,
+	}
+	if p.ID != "" {
+		ret["id"] = p.ID
+	}
+	if p.SourceHash != "" {
+		ret["source_hash"] = p.SourceHash
+	}
+	return ret
+}
+
+// CellProvenance returns the provenance recorded in the cell metadata,
+// or nil if the cell has no provenance.
+func CellProvenance(cell *Cell) (*Provenance, error) {
+	v, ok := cell.Metadata[ProvenanceKey]
+	if !ok {
+		return nil, nil
+	}
+	data, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("provenance is not a map, but %s", reflect.TypeOf(v))
+	}
+	ret := &Provenance{}
+	switch x := data["cell"].(type) {
+	case float64:
+		ret.Cell = int(x)
+	case int:
+		ret.Cell = x
+	default:
+		return nil, fmt.Errorf("provenance cell is not a number, but %s", reflect.TypeOf(data["cell"]))
+	}
+	if ret.Hash, ok = data["hash"].(string); !ok {
+		return nil, fmt.Errorf("provenance hash is not a string, but %s", reflect.TypeOf(data["hash"]))
+	}
+	if id, ok := data["id"]; ok {
+		if ret.ID, ok = id.(string); !ok {
+			return nil, fmt.Errorf("provenance id is not a string, but %s", reflect.TypeOf(id))
+		}
+	}
+	if h, ok := data["source_hash"]; ok {
+		if ret.SourceHash, ok = h.(string); !ok {
+			return nil, fmt.Errorf("provenance source_hash is not a string, but %s", reflect.TypeOf(h))
+		}
+	}
+	return ret, nil
+}
+
+// recordProvenance stores the provenance of each cell into the cell metadata.
+// The cells and their metadata are copied, as they may be shared with master.
+func (n *Notebook) recordProvenance(master *Notebook) {
+	for i, cell := range n.Cells {
+		if i >= len(n.origins) {
+			break
+		}
+		if n.origins[i] < 0 {
+			// The cell was not generated from the master notebook.
+			continue
+		}
+		origin := master.Cells[n.origins[i]]
+		p := &Provenance{
+			Cell:       n.origins[i],
+			ID:         origin.ID(),
+			Hash:       sourceHash(origin.Source),
+			SourceHash: sourceHash(cell.Source),
+		}
+		c := *cell
+		c.Metadata = cloneMetadata(cell.Metadata, ProvenanceKey, p.json())
+		n.Cells[i] = &c
+	}
+}
+
+// ResolveProvenance finds the master cell that the given cell of a student
+// or autograder notebook was generated from, using the provenance recorded
+// in the cell metadata. The master cell is looked up by id, by index, and
+// finally by the content hash, in case the master notebook has been edited
+// since. It returns the index of the master cell, or an error if the cell
+// has no provenance or the master cell cannot be found.
+func (n *Notebook) ResolveProvenance(cell *Cell) (int, error) {
+	p, err := CellProvenance(cell)
+	if err != nil {
+		return -1, err
+	}
+	if p == nil {
+		return -1, fmt.Errorf("cell has no %s metadata", ProvenanceKey)
+	}
+	if p.ID != "" {
+		for i, c := range n.Cells {
+			if c.ID() == p.ID && sourceHash(c.Source) == p.Hash {
+				return i, nil
+			}
+		}
+	}
+	if p.Cell >= 0 && p.Cell < len(n.Cells) && sourceHash(n.Cells[p.Cell].Source) == p.Hash {
+		return p.Cell, nil
+	}
+	for i, c := range n.Cells {
+		if sourceHash(c.Source) == p.Hash {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("master cell %d (id %q) not found, it may have been changed", p.Cell, p.ID)
+}
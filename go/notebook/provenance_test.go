@@ -0,0 +1,89 @@
+package notebook
+
+import (
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	master := taggedNotebook([]string{
+		"```\n# ASSIGNMENT METADATA\nassignment_id: a1\n```",
+		"# MASTER ONLY\nx = 0",
+		"```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+		"%%solution\nx = 1",
+		"%%inlinetest Test1\nassert x == 1",
+		"print(x)",
+	}, make([][]interface{}, 6))
+	master.Cells[5].Data = map[string]interface{}{"id": "print-cell"}
+	student, err := master.ToStudent(AnyLanguage, &StudentOptions{
+		InsertCheckCell:   true,
+		CheckCellTemplate: "Check()",
+		RecordProvenance:  true,
+	})
+	if err != nil {
+		t.Fatalf("ToStudent() returned error %s", err)
+	}
+	// The student notebook has the solution, the check cell and the print cell.
+	// The metadata cells become empty and are dropped.
+	want := []int{3, 3, 5}
+	if len(student.Cells) != len(want) {
+		t.Fatalf("got %d student cells %q, want %d", len(student.Cells), sources(student), len(want))
+	}
+	for i, cell := range student.Cells {
+		got, err := master.ResolveProvenance(cell)
+		if err != nil {
+			t.Errorf("ResolveProvenance(student cell %d) returned error %s", i, err)
+			continue
+		}
+		if got != want[i] {
+			t.Errorf("ResolveProvenance(student cell %d) = %d, want %d", i, got, want[i])
+		}
+	}
+	if _, ok := master.Cells[3].Metadata[ProvenanceKey]; ok {
+		t.Errorf("ToStudent() modified the master cell metadata")
+	}
+	// Insert a cell into the master, so that indices change.
+	edited := &Notebook{Cells: append([]*Cell{{Type: "code", Source: "import os"}}, master.Cells...)}
+	got, err := edited.ResolveProvenance(student.Cells[2])
+	if err != nil || got != 6 {
+		t.Errorf("ResolveProvenance() in edited master = %d, %v, want 6", got, err)
+	}
+	got, err = edited.ResolveProvenance(student.Cells[0])
+	if err != nil || got != 4 {
+		t.Errorf("ResolveProvenance() in edited master = %d, %v, want 4", got, err)
+	}
+	// Change the cell content.
+	edited.Cells[4] = &Cell{Type: "code", Source: "%%solution\nx = 2"}
+	if got, err := edited.ResolveProvenance(student.Cells[0]); err == nil {
+		t.Errorf("ResolveProvenance() of a changed cell = %d, want error", got)
+	}
+
+	autograder, err := master.ToAutograderWithOptions(&AutograderOptions{RecordProvenance: true})
+	if err != nil {
+		t.Fatalf("ToAutograderWithOptions() returned error %s", err)
+	}
+	for _, cell := range autograder.Cells {
+		if cell.Metadata["filename"] == ManifestFilename {
+			// The manifest is not generated from a master cell.
+			continue
+		}
+		got, err := master.ResolveProvenance(cell)
+		if err != nil {
+			t.Errorf("ResolveProvenance(%s) returned error %s", cell.Metadata["filename"], err)
+			continue
+		}
+		want := 3
+		switch cell.Metadata["filename"] {
+		case "Test1_inline.py", "Test1_context.py":
+			want = 4
+		case PointsFilename:
+			// The points file comes from the exercise metadata.
+			want = 2
+		}
+		if got != want {
+			t.Errorf("ResolveProvenance(%s) = %d, want %d", cell.Metadata["filename"], got, want)
+		}
+	}
+	if _, err := master.ResolveProvenance(&Cell{Type: "code"}); err == nil {
+		t.Errorf("ResolveProvenance() of a cell without provenance returned success, want error")
+	}
+}
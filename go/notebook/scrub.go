@@ -0,0 +1,178 @@
+package notebook
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// ScrubPolicy configures Scrub. The zero value keeps the notebook unchanged.
+type ScrubPolicy struct {
+	// MaxOutputSize is the maximum size in bytes of a single cell output
+	// in JSON. The larger outputs, typically images, are removed.
+	// Zero means no limit.
+	MaxOutputSize int
+	// DropWidgetState removes the state of Jupyter widgets from the notebook
+	// metadata and the widget views from the cell outputs.
+	DropWidgetState bool
+	// DropUnknownMetadata removes the notebook and cell metadata keys that
+	// are not used for grading, except for the keys listed in KeepMetadata.
+	DropUnknownMetadata bool
+	// KeepMetadata lists additional metadata keys to keep
+	// with DropUnknownMetadata.
+	KeepMetadata []string
+	// ExerciseCellsOnly removes the cells without exercise_id in metadata.
+	ExerciseCellsOnly bool
+}
+
+var (
+	// knownNotebookMetadata lists the notebook metadata keys
+	// kept by DropUnknownMetadata.
+	knownNotebookMetadata = []string{
+		"kernelspec",
+		"language_info",
+		"assignment_id",
+		VariantSeedKey,
+		"submission_id",
+		"user_hash",
+		"timestamp",
+		"requested_exercise_id",
+	}
+	// knownCellMetadata lists the cell metadata keys kept by DropUnknownMetadata.
+	knownCellMetadata = []string{
+		"exercise_id",
+		ProvenanceKey,
+	}
+	// widgetMimeTypes are the output types of Jupyter widgets.
+	widgetMimeTypes = []string{
+		"application/vnd.jupyter.widget-view+json",
+		"application/vnd.jupyter.widget-state+json",
+	}
+)
+
+// Scrub removes the parts of the submitted notebook that should not be stored
+// or graded according to the policy, and returns the resulting notebook JSON.
+// It works on both nbformat v3 and v4 and keeps the fields it does not know.
+func Scrub(b []byte, policy *ScrubPolicy) ([]byte, error) {
+	data := make(map[string]interface{})
+	err := json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse notebook as JSON: %s", err)
+	}
+	if metadata, ok := data["metadata"].(map[string]interface{}); ok {
+		if policy.DropWidgetState {
+			delete(metadata, "widgets")
+		}
+		if policy.DropUnknownMetadata {
+			policy.dropUnknown(metadata, knownNotebookMetadata)
+		}
+	}
+	if v, ok := data["cells"]; ok {
+		data["cells"], err = policy.scrubCells(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// nbformat v3 keeps the cells in worksheets.
+	if worksheets, ok := data["worksheets"].([]interface{}); ok {
+		for i, v := range worksheets {
+			worksheet, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("worksheet %d is not a map, but %s", i, reflect.TypeOf(v))
+			}
+			if v, ok := worksheet["cells"]; ok {
+				worksheet["cells"], err = policy.scrubCells(v)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return marshalJSON(data)
+}
+
+// dropUnknown removes the keys from the metadata that are neither known
+// nor listed in KeepMetadata.
+func (policy *ScrubPolicy) dropUnknown(metadata map[string]interface{}, known []string) {
+	keep := make(map[string]bool)
+	for _, k := range known {
+		keep[k] = true
+	}
+	for _, k := range policy.KeepMetadata {
+		keep[k] = true
+	}
+	for k := range metadata {
+		if !keep[k] {
+			delete(metadata, k)
+		}
+	}
+}
+
+// scrubCells applies the policy to the list of cells in JSON.
+func (policy *ScrubPolicy) scrubCells(v interface{}) ([]interface{}, error) {
+	cells, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cells is not a list, but %s", reflect.TypeOf(v))
+	}
+	var ret []interface{}
+	for i, v := range cells {
+		cell, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cell %d is not a map, but %s", i, reflect.TypeOf(v))
+		}
+		metadata, _ := cell["metadata"].(map[string]interface{})
+		if policy.ExerciseCellsOnly {
+			if _, ok := metadata["exercise_id"]; !ok {
+				continue
+			}
+		}
+		if metadata != nil && policy.DropUnknownMetadata {
+			policy.dropUnknown(metadata, knownCellMetadata)
+		}
+		if outputs, ok := cell["outputs"].([]interface{}); ok {
+			scrubbed, err := policy.scrubOutputs(outputs)
+			if err != nil {
+				return nil, fmt.Errorf("cell %d: %s", i, err)
+			}
+			cell["outputs"] = scrubbed
+		}
+		ret = append(ret, cell)
+	}
+	if ret == nil {
+		// Keep the list of cells in JSON.
+		ret = []interface{}{}
+	}
+	return ret, nil
+}
+
+// scrubOutputs removes the widget views and the outputs that are too large.
+func (policy *ScrubPolicy) scrubOutputs(outputs []interface{}) ([]interface{}, error) {
+	ret := []interface{}{}
+	for _, v := range outputs {
+		output, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("output is not a map, but %s", reflect.TypeOf(v))
+		}
+		if policy.DropWidgetState {
+			if data, ok := output["data"].(map[string]interface{}); ok {
+				for _, mimeType := range widgetMimeTypes {
+					delete(data, mimeType)
+				}
+				if len(data) == 0 {
+					continue
+				}
+			}
+		}
+		if policy.MaxOutputSize > 0 {
+			b, err := json.Marshal(output)
+			if err != nil {
+				return nil, err
+			}
+			if len(b) > policy.MaxOutputSize {
+				continue
+			}
+		}
+		ret = append(ret, output)
+	}
+	return ret, nil
+}
@@ -0,0 +1,85 @@
+package notebook
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const scrubInput = `{
+ "nbformat": 4,
+ "nbformat_minor": 2,
+ "metadata": {
+  "assignment_id": "a1",
+  "kernelspec": {"name": "python3", "display_name": "Python 3"},
+  "colab": {"name": "alice-homework.ipynb"},
+  "widgets": {"application/vnd.jupyter.widget-state+json": {}}
+ },
+ "cells": [
+  {"cell_type": "markdown", "metadata": {}, "source": "# Title"},
+  {"cell_type": "code", "metadata": {"exercise_id": "ex1", "colab": {"id": "x"}},
+   "source": "x = 1", "execution_count": 1, "outputs": [
+    {"output_type": "stream", "name": "stdout", "text": "ok"},
+    {"output_type": "display_data", "metadata": {}, "data": {"image/png": "IMAGEIMAGEIMAGEIMAGEIMAGEIMAGEIMAGEIMAGEIMAGEIMAGEIMAGEIMAGEIMAGEIMAGEIMAGEIMAGE"}},
+    {"output_type": "display_data", "metadata": {}, "data": {"application/vnd.jupyter.widget-view+json": {"model_id": "m1"}}}
+   ]}
+ ]
+}`
+
+func TestScrub(t *testing.T) {
+	b, err := Scrub([]byte(scrubInput), &ScrubPolicy{
+		MaxOutputSize:       100,
+		DropWidgetState:     true,
+		DropUnknownMetadata: true,
+		ExerciseCellsOnly:   true,
+	})
+	if err != nil {
+		t.Fatalf("Scrub() returned error %s", err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Scrub() returned invalid JSON: %s\n%s", err, b)
+	}
+	want := map[string]interface{}{
+		"nbformat":       4.0,
+		"nbformat_minor": 2.0,
+		"metadata": map[string]interface{}{
+			"assignment_id": "a1",
+			"kernelspec":    map[string]interface{}{"name": "python3", "display_name": "Python 3"},
+		},
+		"cells": []interface{}{
+			map[string]interface{}{
+				"cell_type":       "code",
+				"metadata":        map[string]interface{}{"exercise_id": "ex1"},
+				"source":          "x = 1",
+				"execution_count": 1.0,
+				"outputs": []interface{}{
+					map[string]interface{}{"output_type": "stream", "name": "stdout", "text": "ok"},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Scrub() = %s, want %v", b, want)
+	}
+	// The scrubbed notebook is still a valid notebook.
+	if errs := Validate(b); len(errs) > 0 {
+		t.Errorf("Scrub() returned invalid notebook: %v", errs)
+	}
+}
+
+func TestScrubZeroPolicy(t *testing.T) {
+	b, err := Scrub([]byte(scrubInput), &ScrubPolicy{KeepMetadata: []string{"colab"}})
+	if err != nil {
+		t.Fatalf("Scrub() returned error %s", err)
+	}
+	for _, s := range []string{"alice-homework.ipynb", "IMAGEIMAGE", "model_id", "# Title"} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("Scrub() with zero policy removed %q: %s", s, b)
+		}
+	}
+	if _, err := Scrub([]byte("not json"), &ScrubPolicy{}); err == nil {
+		t.Errorf("Scrub(\"not json\") returned success, want error")
+	}
+}
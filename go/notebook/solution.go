@@ -0,0 +1,149 @@
+package notebook
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// cleanSolution removes the solution markers from the source of a %%solution
+// cell, keeping the solution code: the %%solution magic, the BEGIN SOLUTION
+// and END SOLUTION lines and the # SOLUTION line markers are removed, and
+// the prompts between BEGIN PROMPT and END PROMPT are dropped.
+func cleanSolution(source string) (string, error) {
+	if m := solutionMagicRegex.FindStringIndex(source); m != nil {
+		source = source[m[1]:]
+	}
+	for {
+		mbeg := promptBeginRegex.FindStringIndex(source)
+		if mbeg == nil {
+			break
+		}
+		mend := promptEndRegex.FindStringIndex(source[mbeg[1]:])
+		if mend == nil {
+			return "", fmt.Errorf("BEGIN PROMPT has no matching END PROMPT")
+		}
+		// The END PROMPT match includes the preceding newline.
+		source = source[:mbeg[0]] + strings.TrimPrefix(source[mbeg[1]+mend[1]:], "\n")
+	}
+	mbeg := solutionBeginRegex.FindAllStringIndex(source, -1)
+	mend := solutionEndRegex.FindAllStringIndex(source, -1)
+	if len(mbeg) != len(mend) {
+		return "", fmt.Errorf("cell has mismatched number of BEGIN SOLUTION and END SOLUTION, %d != %d", len(mbeg), len(mend))
+	}
+	source = solutionBeginRegex.ReplaceAllString(source, "")
+	var out []string
+	for _, line := range strings.Split(source, "\n") {
+		if solutionEndRegex.MatchString(line) {
+			continue
+		}
+		if m := solutionLineRegex.FindStringSubmatch(line); m != nil {
+			// Keep the code, but not the marker.
+			line = m[1] + m[2]
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+// ToSolution converts a master notebook into the solution notebook, i.e.
+// the answer key for instructors and teaching assistants. The solution
+// notebook is the student notebook with the solutions in place: it keeps
+// the solution code and the student tests, but drops the metadata, the unit
+// tests, inline tests, report templates, exercise context and MASTER ONLY cells.
+func (n *Notebook) ToSolution(lang Language) (*Notebook, error) {
+	// Cell tags are equivalent to the magic markers.
+	n, err := n.withTagsApplied()
+	if err != nil {
+		return nil, err
+	}
+	n, err = n.withIncludes()
+	if err != nil {
+		return nil, err
+	}
+	// Assignment metadata is global for the notebook.
+	assignmentMetadata := make(map[string]interface{})
+	// Exercise metadata only applies to the next code block.
+	var exerciseMetadata map[string]interface{}
+	transformed, err := n.MapCells(func(cell *Cell) ([]*Cell, error) {
+		source := cell.Source
+		if cell.Type == "markdown" {
+			var err error
+			if hasMetadata(assignmentMetadataRegex, source) {
+				var metadata map[string]interface{}
+				metadata, source, err = extractMetadata(assignmentMetadataRegex, source)
+				if err != nil {
+					return nil, err
+				}
+				for k, v := range metadata {
+					assignmentMetadata[k] = v
+				}
+			}
+			if hasMetadata(exerciseMetadataRegex, source) {
+				exerciseMetadata, source, err = extractMetadata(exerciseMetadataRegex, source)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if masterOnlyMarkerRegex.MatchString(source) {
+				return nil, nil
+			}
+			if source = lang.filterText(source); len(source) == 0 {
+				return nil, nil
+			}
+		}
+		if cell.Type != "code" {
+			ret := &Cell{
+				Type:        cell.Type,
+				Source:      source,
+				Attachments: cell.Attachments,
+			}
+			if cell.Type == "raw" {
+				// Raw cells keep the target format in metadata.
+				ret.Metadata = cell.Metadata
+			}
+			return []*Cell{ret}, nil
+		}
+		var metadata map[string]interface{}
+		if solutionMagicRegex.MatchString(source) {
+			var err error
+			source, err = cleanSolution(source)
+			if err != nil {
+				return nil, err
+			}
+			metadata = exerciseMetadata
+		} else if inlineTestRegex.MatchString(source) ||
+			exerciseContextRegex.MatchString(source) ||
+			unittestBeginRegex.MatchString(source) ||
+			autotestMarkerRegex.MatchString(source) ||
+			submissionMarkerRegex.MatchString(source) ||
+			templateOrReportMarkerRegex.MatchString(source) ||
+			masterOnlyMarkerRegex.MatchString(source) {
+			// Skip the tests, templates, context and master-only cells.
+			return nil, nil
+		}
+		for _, re := range []*regexp.Regexp{testMarkerRegex, studentTestRegex, globalContextRegex, exerciseContextRegex} {
+			if m := re.FindStringIndex(source); m != nil {
+				// Remove the marker.
+				source = source[:m[0]] + source[m[1]:]
+			}
+		}
+		return []*Cell{&Cell{
+			Type:     "code",
+			Metadata: metadata,
+			Source:   source,
+		}}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if transformed.Metadata == nil {
+		transformed.Metadata = make(map[string]interface{})
+	} else {
+		transformed.Metadata = cloneMetadata(transformed.Metadata)
+	}
+	for k, v := range assignmentMetadata {
+		transformed.Metadata[k] = v
+	}
+	return transformed, nil
+}
@@ -0,0 +1,70 @@
+package notebook
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCleanSolution(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{"Magic", "%%solution\nx = 1", "x = 1"},
+		{"Block", "%%solution\ndef f():\n  # BEGIN SOLUTION\n  return 1\n  # END SOLUTION\nprint(f())",
+			"def f():\n  return 1\nprint(f())"},
+		{"Prompt", "%%solution\n# BEGIN PROMPT\nx = ...\n# END PROMPT\n# BEGIN SOLUTION\nx = 1\n# END SOLUTION",
+			"x = 1"},
+		{"QuotedPrompt", "%%solution\n\"\"\" # BEGIN PROMPT\nx = ...\n\"\"\" # END PROMPT\nx = 1",
+			"x = 1"},
+		{"Lines", "%%solution\nx = 1 # SOLUTION\nimport os # SOLUTION NO PROMPT\nprint(x)",
+			"x = 1\nimport os\nprint(x)"},
+	}
+	for _, tt := range tests {
+		got, err := cleanSolution(tt.source)
+		if err != nil {
+			t.Errorf("%s: cleanSolution(%q) returned error %s", tt.name, tt.source, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: cleanSolution(%q) = %q, want %q", tt.name, tt.source, got, tt.want)
+		}
+	}
+	if got, err := cleanSolution("%%solution\n# BEGIN SOLUTION\nx = 1"); err == nil {
+		t.Errorf("cleanSolution() with missing END SOLUTION = %q, want error", got)
+	}
+}
+
+func TestToSolution(t *testing.T) {
+	n := taggedNotebook([]string{
+		"```\n# ASSIGNMENT METADATA\nassignment_id: a1\n```",
+		"## Exercise\n**lang:en**Write x.\n**lang:ja**xを書く。\n```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+		"# GLOBAL CONTEXT\nimport math",
+		"# EXERCISE CONTEXT\ny = 0",
+		"%%solution\n# BEGIN PROMPT\nx = ...\n# END PROMPT\n# BEGIN SOLUTION\nx = 1\n# END SOLUTION",
+		"%%studenttest Check\nassert x > 0",
+		"%%inlinetest Test1\nassert x == 1",
+		"# BEGIN UNITTEST\nclass XTest(unittest.TestCase):\n  pass\n# END UNITTEST",
+		"%%submission\nx = 2",
+		"# MASTER ONLY\nprint(x)",
+		"%%template XReport\nReport",
+	}, make([][]interface{}, 11))
+	got, err := n.ToSolution(English)
+	if err != nil {
+		t.Fatalf("ToSolution() returned error %s", err)
+	}
+	want := []string{"## Exercise\nWrite x.", "import math", "x = 1", "assert x > 0"}
+	if !reflect.DeepEqual(sources(got), want) {
+		t.Errorf("ToSolution() = %q, want %q", sources(got), want)
+	}
+	if got.Cells[2].Metadata["exercise_id"] != "ex1" {
+		t.Errorf("solution cell metadata = %v, want exercise_id ex1", got.Cells[2].Metadata)
+	}
+	if got.Metadata["assignment_id"] != "a1" {
+		t.Errorf("solution notebook metadata = %v, want assignment_id a1", got.Metadata)
+	}
+	if _, ok := n.Metadata["assignment_id"]; ok {
+		t.Errorf("ToSolution() modified the master notebook metadata")
+	}
+}
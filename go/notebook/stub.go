@@ -0,0 +1,288 @@
+package notebook
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// This file implements automatic stubbing of %%solution cells: the top-level
+// function and class definitions keep their signatures and docstrings,
+// while the bodies are replaced with a placeholder. It is enabled by the
+// "stub" key in the exercise metadata:
+//
+//   stub: ellipsis   # or true, the bodies become ...
+//   stub: raise      # the bodies become raise NotImplementedError
+
+var (
+	defRegex       = regexp.MustCompile(`^[ \t]*(?:async[ \t]+)?def[ \t]`)
+	classRegex     = regexp.MustCompile(`^[ \t]*class[ \t]`)
+	decoratorRegex = regexp.MustCompile(`^[ \t]*@`)
+	pyImportRegex  = regexp.MustCompile(`^[ \t]*(?:import|from)[ \t]`)
+	// docstringRegex matches a statement that is a single string literal.
+	// The rest of the line may only have a comment, so that expressions
+	// starting with a string, e.g. "".join(x), are not kept in the stub.
+	docstringRegex = regexp.MustCompile(`^[ \t]*[rRuU]?(?:` +
+		`"""(?:[^"\\]|\\(?s:.)|"[^"]|""[^"])*"""|` +
+		`'''(?:[^'\\]|\\(?s:.)|'[^']|''[^'])*'''|` +
+		`"(?:[^"\\\n]|\\.)*"|` +
+		`'(?:[^'\\\n]|\\.)*')` +
+		`[ \t]*(?:#[^\n]*)?$`)
+)
+
+// stubMode returns the placeholder statement for the function bodies
+// as configured in the exercise metadata, or empty string if stubbing
+// is not enabled.
+func stubMode(exerciseMetadata map[string]interface{}) (string, error) {
+	v, ok := exerciseMetadata["stub"]
+	if !ok || v == nil {
+		return "", nil
+	}
+	switch x := v.(type) {
+	case bool:
+		if x {
+			return "...", nil
+		}
+		return "", nil
+	case string:
+		switch x {
+		case "ellipsis", "...":
+			return "...", nil
+		case "raise":
+			return "raise NotImplementedError", nil
+		}
+		return "", fmt.Errorf("unsupported stub mode %q, want ellipsis or raise", x)
+	}
+	return "", fmt.Errorf("exercise metadata stub is %s, not string or bool", reflect.TypeOf(v))
+}
+
+// pyLine is a logical line of Python code, which may span several physical
+// lines because of open brackets, triple-quoted strings or backslash
+// continuations.
+type pyLine struct {
+	// text is the source of the line, including the indentation.
+	text string
+	// indent is the width of the indentation.
+	indent int
+	// blank is true for empty and comment-only lines.
+	blank bool
+	// colon is the offset of the first colon outside brackets and strings
+	// in text, or -1.
+	colon int
+}
+
+// indentWidth computes the width of the leading whitespace,
+// with tabs advancing to the next multiple of 8.
+func indentWidth(s string) int {
+	w := 0
+	for _, c := range s {
+		switch c {
+		case ' ':
+			w++
+		case '\t':
+			w = w/8*8 + 8
+		default:
+			return w
+		}
+	}
+	return w
+}
+
+// splitPyLines splits the Python source into logical lines.
+func splitPyLines(source string) []pyLine {
+	var ret []pyLine
+	start := 0
+	depth := 0
+	quote := ""
+	colon := -1
+	hasCode := false
+	flush := func(end int) {
+		text := source[start:end]
+		ret = append(ret, pyLine{
+			text:   text,
+			indent: indentWidth(text),
+			blank:  !hasCode,
+			colon:  colon,
+		})
+		start = end + 1
+		depth = 0
+		colon = -1
+		hasCode = false
+	}
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+		if quote != "" {
+			switch {
+			case c == '\\':
+				i++
+			case strings.HasPrefix(source[i:], quote):
+				i += len(quote) - 1
+				quote = ""
+			case c == '\n' && len(quote) == 1:
+				// Unterminated string, recover at the end of line.
+				quote = ""
+				flush(i)
+			}
+			continue
+		}
+		switch c {
+		case '#':
+			for i+1 < len(source) && source[i+1] != '\n' {
+				i++
+			}
+		case '\\':
+			if i+1 < len(source) && source[i+1] == '\n' {
+				i++
+			}
+		case '\'', '"':
+			hasCode = true
+			quote = string(c)
+			if strings.HasPrefix(source[i:], strings.Repeat(quote, 3)) {
+				quote = strings.Repeat(quote, 3)
+			}
+			i += len(quote) - 1
+		case '(', '[', '{':
+			hasCode = true
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ':':
+			if depth == 0 && colon < 0 {
+				colon = i - start
+			}
+		case '\n':
+			if depth <= 0 {
+				flush(i)
+			}
+		case ' ', '\t', '\r':
+		default:
+			hasCode = true
+		}
+	}
+	if start <= len(source) {
+		flush(len(source))
+	}
+	return ret
+}
+
+// leadingSpace returns the leading whitespace of s.
+func leadingSpace(s string) string {
+	return s[:len(s)-len(strings.TrimLeft(s, " \t"))]
+}
+
+// stubBlock processes the statements of a block, all at the indentation of
+// the first non-blank line, and returns the output lines. The definitions
+// keep their headers and docstrings, with function bodies replaced with stub.
+// Imports are kept, and all other statements are dropped. Blank lines
+// between the kept statements are preserved.
+func stubBlock(lines []pyLine, stub string) []string {
+	var out []string
+	var decorators []string
+	blank := false
+	emit := func(lines ...string) {
+		if blank && len(out) > 0 {
+			out = append(out, "")
+		}
+		blank = false
+		out = append(out, lines...)
+	}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if line.blank {
+			blank = true
+			continue
+		}
+		if decoratorRegex.MatchString(line.text) {
+			decorators = append(decorators, line.text)
+			continue
+		}
+		// Find the nested block of the statement, leaving out the trailing blank lines.
+		end := i + 1
+		for j := i + 1; j < len(lines); j++ {
+			if lines[j].blank {
+				continue
+			}
+			if lines[j].indent <= line.indent {
+				break
+			}
+			end = j + 1
+		}
+		isDef := defRegex.MatchString(line.text)
+		isClass := classRegex.MatchString(line.text)
+		if !isDef && !isClass {
+			if pyImportRegex.MatchString(line.text) {
+				emit(line.text)
+			}
+			decorators = nil
+			i = end - 1
+			continue
+		}
+		body := lines[i+1 : end]
+		emit(decorators...)
+		decorators = nil
+		header := line.text
+		inline := ""
+		if line.colon >= 0 {
+			header = line.text[:line.colon+1]
+			inline = strings.TrimSpace(line.text[line.colon+1:])
+		}
+		out = append(out, header)
+		if inline != "" && !strings.HasPrefix(inline, "#") {
+			// A one-line definition, e.g. def f(): return 1
+			indent := leadingSpace(line.text) + "    "
+			if docstringRegex.MatchString(inline) {
+				out = append(out, indent+inline)
+			} else {
+				out = append(out, indent+stub)
+			}
+			i = end - 1
+			continue
+		}
+		// Find the first statement of the body.
+		first := 0
+		for first < len(body) && body[first].blank {
+			first++
+		}
+		if first == len(body) {
+			out = append(out, leadingSpace(line.text)+"    "+stub)
+			i = end - 1
+			continue
+		}
+		indent := leadingSpace(body[first].text)
+		rest := body[first:]
+		if docstringRegex.MatchString(rest[0].text) {
+			out = append(out, rest[0].text)
+			rest = rest[1:]
+		}
+		var inner []string
+		if isClass {
+			inner = stubBlock(rest, stub)
+		}
+		if len(inner) > 0 {
+			out = append(out, inner...)
+		} else {
+			out = append(out, indent+stub)
+		}
+		i = end - 1
+	}
+	return out
+}
+
+// stubDefinitions replaces the bodies of the functions and classes defined in
+// the source with the stub statement. It returns false if the source does not
+// contain any definitions.
+func stubDefinitions(source, stub string) (string, bool) {
+	out := stubBlock(splitPyLines(source), stub)
+	found := false
+	for _, line := range out {
+		if defRegex.MatchString(line) || classRegex.MatchString(line) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return "", false
+	}
+	return strings.Join(out, "\n"), true
+}
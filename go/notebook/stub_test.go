@@ -0,0 +1,194 @@
+package notebook
+
+import (
+	"testing"
+)
+
+func TestStubDefinitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		stub  string
+		want  string
+	}{
+		{
+			name: "Function",
+			input: `def f(x):
+    """Returns x squared."""
+    y = x * x
+    return y`,
+			stub: "...",
+			want: `def f(x):
+    """Returns x squared."""
+    ...`,
+		},
+		{
+			name: "NoDocstring",
+			input: `def f(x):
+  # Compute.
+  return x + 1`,
+			stub: "raise NotImplementedError",
+			want: `def f(x):
+  raise NotImplementedError`,
+		},
+		{
+			name: "StringExpression",
+			input: `def f(x):
+    return "".join(x)
+
+def g(x):
+    "abc".format(x)
+    return x
+
+def h(x):
+    'Returns x.'  # Docstring.
+    return x`,
+			stub: "...",
+			want: `def f(x):
+    ...
+
+def g(x):
+    ...
+
+def h(x):
+    'Returns x.'  # Docstring.
+    ...`,
+		},
+		{
+			name: "MultilineSignatureAndDocstring",
+			input: `import math
+
+@decorator
+def area(r: float,
+         scale: float = 1.0) -> float:
+    """Computes the area.
+
+Not indented: line.
+    """
+    return math.pi * r ** 2 * scale
+
+answer = area(2)
+
+async def g(): return 1`,
+			stub: "...",
+			want: `import math
+
+@decorator
+def area(r: float,
+         scale: float = 1.0) -> float:
+    """Computes the area.
+
+Not indented: line.
+    """
+    ...
+
+async def g():
+    ...`,
+		},
+		{
+			name: "Class",
+			input: `class Counter(object):
+    """A counter."""
+    start = 0
+
+    def __init__(self):
+        self.n = self.start
+
+    def inc(self, d={'a': 1}):
+        '''Increments.'''
+        if d:
+            self.n += 1
+
+class Empty:
+    x = 1`,
+			stub: "...",
+			want: `class Counter(object):
+    """A counter."""
+    def __init__(self):
+        ...
+
+    def inc(self, d={'a': 1}):
+        '''Increments.'''
+        ...
+
+class Empty:
+    ...`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := stubDefinitions(tt.input, tt.stub)
+			if !ok {
+				t.Fatalf("stubDefinitions(%q) found no definitions", tt.input)
+			}
+			if got != tt.want {
+				t.Errorf("stubDefinitions(%q) returned\n%s\nwant\n%s", tt.input, got, tt.want)
+			}
+		})
+	}
+	if _, ok := stubDefinitions("x = 1\nprint(x)", "..."); ok {
+		t.Errorf("stubDefinitions() reported definitions in code without definitions")
+	}
+}
+
+func TestToStudentStub(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata string
+		input    string
+		want     string
+	}{
+		{
+			name:     "Disabled",
+			metadata: "exercise_id: ex1",
+			input:    "%%solution\ndef f():\n    return 1",
+			want:     "...",
+		},
+		{
+			name:     "Ellipsis",
+			metadata: "exercise_id: ex1\nstub: true",
+			input:    "%%solution\ndef f():\n    \"\"\"Doc.\"\"\"\n    return 1",
+			want:     "def f():\n    \"\"\"Doc.\"\"\"\n    ...",
+		},
+		{
+			name:     "Raise",
+			metadata: "exercise_id: ex1\nstub: raise",
+			input:    "%%solution\ndef f():\n    return 1",
+			want:     "def f():\n    raise NotImplementedError",
+		},
+		{
+			name:     "NoDefinitions",
+			metadata: "exercise_id: ex1\nstub: raise",
+			input:    "%%solution\nx = 1",
+			want:     "...",
+		},
+		{
+			name:     "MarkersTakePrecedence",
+			metadata: "exercise_id: ex1\nstub: raise",
+			input:    "%%solution\ndef f():\n    # BEGIN SOLUTION\n    return 1\n    # END SOLUTION",
+			want:     "def f():\n    ...",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := createNotebook([]string{
+				"```\n# EXERCISE METADATA\n" + tt.metadata + "\n```",
+				tt.input,
+			})
+			n.Cells[0].Type = "markdown"
+			got, err := n.ToStudent(AnyLanguage, nil)
+			if err != nil {
+				t.Fatalf("ToStudent() returned error %s, want success", err)
+			}
+			last := got.Cells[len(got.Cells)-1]
+			if last.Source != tt.want {
+				t.Errorf("got student cell\n%s\nwant\n%s", last.Source, tt.want)
+			}
+		})
+	}
+	n := createNotebook([]string{"```\n# EXERCISE METADATA\nexercise_id: ex1\nstub: 42\n```", "%%solution\ndef f(): pass"})
+	n.Cells[0].Type = "markdown"
+	if _, err := n.ToStudent(AnyLanguage, nil); err == nil {
+		t.Errorf("ToStudent() with invalid stub mode returned success, want error")
+	}
+}
@@ -0,0 +1,146 @@
+package notebook
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Cell tags (metadata.tags) can be used instead of the magic markers to mark
+// the role of a cell in the master notebook. The tags that need a name take
+// it after a colon, e.g. "inlinetest:HelloTest".
+//
+//   solution           %%solution
+//   submission         %%submission
+//   inlinetest:Name    %%inlinetest Name
+//   studenttest:Name   %%studenttest Name
+//   template:Name      %%template Name
+//   unittest           # BEGIN UNITTEST ... # END UNITTEST
+//   master-only        # MASTER ONLY
+//   exercise-context   # EXERCISE CONTEXT
+//   global-context     # GLOBAL CONTEXT
+//
+// Tagged cells are rewritten into the equivalent marked cells before
+// processing, so both styles can be mixed in one notebook.
+
+// namedTags are the tags that need a name. Without it, the marked cell would
+// not be recognized, e.g. an inline test would be copied into the student
+// notebook.
+var namedTags = map[string]bool{
+	"inlinetest":  true,
+	"studenttest": true,
+	"template":    true,
+}
+
+// tagMarkers maps the cell tags to the marker lines prepended to the cell.
+var tagMarkers = map[string]string{
+	"solution":         "%%solution",
+	"submission":       "%%submission",
+	"inlinetest":       "%%inlinetest",
+	"studenttest":      "%%studenttest",
+	"template":         "%%template",
+	"master-only":      "# MASTER ONLY",
+	"exercise-context": "# EXERCISE CONTEXT",
+	"global-context":   "# GLOBAL CONTEXT",
+}
+
+// Tags returns the list of cell tags from metadata.tags.
+func (cell *Cell) Tags() []string {
+	list, ok := cell.Metadata["tags"].([]interface{})
+	if !ok {
+		if tags, ok := cell.Metadata["tags"].([]string); ok {
+			return tags
+		}
+		return nil
+	}
+	var ret []string
+	for _, v := range list {
+		if tag, ok := v.(string); ok {
+			ret = append(ret, tag)
+		}
+	}
+	return ret
+}
+
+// applyTags rewrites a cell with role tags into the equivalent cell with
+// magic markers. The cell is returned as is if it has no role tags, or if
+// the cell source already has the corresponding markers. It returns an error
+// if a tag that needs a name has none.
+func applyTags(cell *Cell) (*Cell, error) {
+	source := cell.Source
+	// The cell magics must be on the first line, so they are prepended
+	// after the comment markers.
+	var comments, magics []string
+	for _, tag := range cell.Tags() {
+		name := ""
+		if pos := strings.Index(tag, ":"); pos >= 0 {
+			tag, name = tag[:pos], tag[pos+1:]
+		}
+		if tag == "unittest" {
+			if cell.Type == "code" && !unittestBeginRegex.MatchString(source) {
+				source = "# BEGIN UNITTEST\n" + source + "\n# END UNITTEST"
+			}
+			continue
+		}
+		marker, ok := tagMarkers[tag]
+		if !ok {
+			// Other tags are not interpreted.
+			continue
+		}
+		if cell.Type != "code" && tag != "master-only" {
+			continue
+		}
+		if strings.Contains(source, marker) {
+			continue
+		}
+		if namedTags[tag] && name == "" {
+			return nil, fmt.Errorf("tag %q needs a name, e.g. %s:Name", tag, tag)
+		}
+		if name != "" {
+			marker += " " + name
+		}
+		if strings.HasPrefix(marker, "%%") {
+			magics = append(magics, marker)
+		} else {
+			comments = append(comments, marker)
+		}
+	}
+	lines := append(magics, comments...)
+	if len(lines) == 0 && source == cell.Source {
+		return cell, nil
+	}
+	ret := *cell
+	ret.Source = strings.Join(append(lines, source), "\n")
+	return &ret, nil
+}
+
+// withTagsApplied returns a copy of the notebook with the role tags
+// rewritten into magic markers. The cells are in one-to-one correspondence
+// with the original notebook.
+func (n *Notebook) withTagsApplied() (*Notebook, error) {
+	ret, errs := n.applyAllTags()
+	for i := range n.Cells {
+		if err, ok := errs[i]; ok {
+			return nil, fmt.Errorf("cell %d: %s", i, err)
+		}
+	}
+	return ret, nil
+}
+
+// applyAllTags is withTagsApplied that does not stop at the first error.
+// The cells with errors are kept as is, and the errors are returned keyed
+// by the cell index.
+func (n *Notebook) applyAllTags() (*Notebook, map[int]error) {
+	ret := *n
+	ret.origins = nil
+	ret.Cells = make([]*Cell, len(n.Cells))
+	errs := make(map[int]error)
+	for i, cell := range n.Cells {
+		applied, err := applyTags(cell)
+		if err != nil {
+			errs[i] = err
+			applied = cell
+		}
+		ret.Cells[i] = applied
+	}
+	return &ret, errs
+}
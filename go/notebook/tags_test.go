@@ -0,0 +1,122 @@
+package notebook
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// taggedNotebook creates a notebook from the cell sources and tags.
+func taggedNotebook(cells []string, tags [][]interface{}) *Notebook {
+	n := createNotebook(cells)
+	n.Metadata = make(map[string]interface{})
+	for i, cell := range n.Cells {
+		if hasMetadata(assignmentMetadataRegex, cell.Source) || hasMetadata(exerciseMetadataRegex, cell.Source) {
+			cell.Type = "markdown"
+		}
+		if tags[i] != nil {
+			cell.Metadata = map[string]interface{}{"tags": tags[i]}
+		}
+	}
+	return n
+}
+
+func TestTags(t *testing.T) {
+	metadata := []string{
+		"```\n# ASSIGNMENT METADATA\nassignment_id: a1\n```",
+		"```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+	}
+	marked := taggedNotebook(append(metadata,
+		"# GLOBAL CONTEXT\nimport math",
+		"%%solution\n# EXERCISE CONTEXT\nx = 1",
+		"%%inlinetest Test1\nassert x == 1",
+		"# BEGIN UNITTEST\nclass XTest(unittest.TestCase):\n  pass\n# END UNITTEST",
+		"# MASTER ONLY\nprint(x)",
+		"%%studenttest Check\nassert x > 0",
+	), make([][]interface{}, 8))
+	tagged := taggedNotebook(append(metadata,
+		"import math",
+		"x = 1",
+		"assert x == 1",
+		"class XTest(unittest.TestCase):\n  pass",
+		"print(x)",
+		"assert x > 0",
+	), [][]interface{}{
+		nil,
+		nil,
+		{"global-context"},
+		{"exercise-context", "solution", "other"},
+		{"inlinetest:Test1"},
+		{"unittest"},
+		{"master-only"},
+		{"studenttest:Check"},
+	})
+	want, err := marked.ToStudent(AnyLanguage, nil)
+	if err != nil {
+		t.Fatalf("ToStudent(marked) returned error %s", err)
+	}
+	got, err := tagged.ToStudent(AnyLanguage, nil)
+	if err != nil {
+		t.Fatalf("ToStudent(tagged) returned error %s", err)
+	}
+	if !reflect.DeepEqual(sources(got), sources(want)) {
+		t.Errorf("ToStudent(tagged) = %q, want %q", sources(got), sources(want))
+	}
+	want, err = marked.ToAutograder()
+	if err != nil {
+		t.Fatalf("ToAutograder(marked) returned error %s", err)
+	}
+	got, err = tagged.ToAutograder()
+	if err != nil {
+		t.Fatalf("ToAutograder(tagged) returned error %s", err)
+	}
+	if !reflect.DeepEqual(sources(got), sources(want)) {
+		t.Errorf("ToAutograder(tagged) = %q, want %q", sources(got), sources(want))
+	}
+	if problems := tagged.Lint(); len(problems) > 0 {
+		t.Errorf("Lint(tagged) = %v, want no problems", problems)
+	}
+}
+
+func TestApplyTagsKeepsMarkers(t *testing.T) {
+	cell := &Cell{
+		Type:     "code",
+		Metadata: map[string]interface{}{"tags": []interface{}{"solution"}},
+		Source:   "%%solution\nx = 1",
+	}
+	if got, err := applyTags(cell); got != cell || err != nil {
+		t.Errorf("applyTags() rewrote the cell that already has the marker: %q, %v", got.Source, err)
+	}
+}
+
+func TestUnnamedTag(t *testing.T) {
+	n := &Notebook{Cells: []*Cell{
+		{Type: "markdown", Source: "```\n# ASSIGNMENT METADATA\nassignment_id: a1\n```"},
+		{Type: "markdown", Source: "```\n# EXERCISE METADATA\nexercise_id: ex1\n```"},
+		{Type: "code", Source: "%%solution\nx = 1"},
+		{Type: "code", Metadata: map[string]interface{}{"tags": []interface{}{"inlinetest"}}, Source: "assert x == 1"},
+	}}
+	if got, err := n.ToStudent(AnyLanguage, nil); err == nil {
+		t.Errorf("ToStudent() with an unnamed inlinetest tag = %q, want error", sources(got))
+	}
+	if _, err := n.ToAutograder(); err == nil {
+		t.Errorf("ToAutograder() with an unnamed inlinetest tag returned success, want error")
+	}
+	found := false
+	for _, p := range n.Lint() {
+		if p.Severity == Error && p.Cell == 3 && strings.Contains(p.Message, "needs a name") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Lint() = %v, want an error about the unnamed tag in cell 3", n.Lint())
+	}
+}
+
+func sources(n *Notebook) []string {
+	var ret []string
+	for _, cell := range n.Cells {
+		ret = append(ret, cell.Source)
+	}
+	return ret
+}
@@ -0,0 +1,116 @@
+package notebook
+
+// UpgradeReport describes how the answers of an old student notebook were
+// carried over into the student notebook of the new master version.
+type UpgradeReport struct {
+	// Carried lists the exercise IDs whose answers were carried over.
+	Carried []string
+	// Unchanged lists the exercise IDs whose cells the student has not
+	// edited, according to the provenance of the old cells. These cells
+	// get the new version from the master, e.g. with fixed prompts.
+	Unchanged []string
+	// Unmatched lists the exercise IDs of the old student notebook that
+	// have no corresponding cell in the new student notebook. These answers
+	// are not present in the upgraded notebook.
+	Unmatched []string
+	// Missing lists the exercise IDs of the new student notebook that have
+	// no answer in the old student notebook, e.g. new exercises.
+	Missing []string
+}
+
+// exerciseCells returns the cells of the notebook grouped by exercise_id
+// in the cell metadata, along with the list of exercise IDs in the order
+// of appearance.
+func exerciseCells(n *Notebook) (map[string][]*Cell, []string) {
+	cells := make(map[string][]*Cell)
+	var ids []string
+	for _, cell := range n.Cells {
+		id, ok := cell.Metadata["exercise_id"].(string)
+		if !ok || id == "" {
+			continue
+		}
+		if _, ok := cells[id]; !ok {
+			ids = append(ids, id)
+		}
+		cells[id] = append(cells[id], cell)
+	}
+	return cells, ids
+}
+
+// addOnce appends the id to the list unless it is already the last element.
+func addOnce(list []string, id string) []string {
+	if len(list) > 0 && list[len(list)-1] == id {
+		return list
+	}
+	return append(list, id)
+}
+
+// edited returns false if the cell source is the same as when the cell was
+// generated, and true if it has been edited or the provenance is unknown.
+func edited(cell *Cell) bool {
+	p, err := CellProvenance(cell)
+	if err != nil || p == nil || p.SourceHash == "" {
+		return true
+	}
+	return sourceHash(cell.Source) != p.SourceHash
+}
+
+// CarryOverAnswers copies the student's answers from the old student
+// notebook into the cells of the new student notebook with the same
+// exercise_id in metadata. If an exercise has several cells, they are
+// matched in order. Only the cell source is carried over, the metadata
+// of the new cell is kept. The cells that the student has not edited since
+// they were generated are not carried over, which requires the provenance
+// recorded in the old notebook (see StudentOptions.RecordProvenance).
+// The new notebook is modified in place.
+func CarryOverAnswers(n, old *Notebook) *UpgradeReport {
+	oldCells, oldIDs := exerciseCells(old)
+	report := &UpgradeReport{}
+	used := make(map[string]int)
+	for i, cell := range n.Cells {
+		id, ok := cell.Metadata["exercise_id"].(string)
+		if !ok || id == "" {
+			continue
+		}
+		k := used[id]
+		if k >= len(oldCells[id]) {
+			report.Missing = addOnce(report.Missing, id)
+			continue
+		}
+		used[id]++
+		if !edited(oldCells[id][k]) {
+			report.Unchanged = addOnce(report.Unchanged, id)
+			continue
+		}
+		c := *cell
+		c.Source = oldCells[id][k].Source
+		n.Cells[i] = &c
+		report.Carried = addOnce(report.Carried, id)
+	}
+	for _, id := range oldIDs {
+		if used[id] < len(oldCells[id]) {
+			report.Unmatched = append(report.Unmatched, id)
+		}
+	}
+	return report
+}
+
+// UpgradeStudent produces the student notebook from the master notebook
+// and carries over the answers from the old student notebook, which was
+// produced from a previous version of the master notebook. Unless the options
+// specify the seed, the variant of the old student notebook is kept.
+func (n *Notebook) UpgradeStudent(old *Notebook, lang Language, options *StudentOptions) (*Notebook, *UpgradeReport, error) {
+	if seed, ok := old.Metadata[VariantSeedKey].(string); ok && (options == nil || options.Seed == "") {
+		opts := StudentOptions{}
+		if options != nil {
+			opts = *options
+		}
+		opts.Seed = seed
+		options = &opts
+	}
+	student, err := n.ToStudent(lang, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return student, CarryOverAnswers(student, old), nil
+}
@@ -0,0 +1,58 @@
+package notebook
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUpgradeStudent(t *testing.T) {
+	oldMaster := taggedNotebook([]string{
+		"```\n# ASSIGNMENT METADATA\nassignment_id: a1\n```",
+		"```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+		"%%solution\nx = 1",
+		"```\n# EXERCISE METADATA\nexercise_id: ex2\n```",
+		"%%solution\ny = 2",
+		"```\n# EXERCISE METADATA\nexercise_id: ex3\n```",
+		"%%solution\nz = 3",
+	}, make([][]interface{}, 7))
+	old, err := oldMaster.ToStudent(AnyLanguage, &StudentOptions{RecordProvenance: true})
+	if err != nil {
+		t.Fatalf("ToStudent(old master) returned error %s", err)
+	}
+	// The student answers the first two exercises.
+	old.Cells[0].Source = "x = 10"
+	old.Cells[1].Source = "y = 20"
+	// The new version fixes a typo, removes ex2 and adds ex4.
+	newMaster := taggedNotebook([]string{
+		"```\n# ASSIGNMENT METADATA\nassignment_id: a1\n```",
+		"Fixed the typo.",
+		"```\n# EXERCISE METADATA\nexercise_id: ex1\n```",
+		"%%solution\nx = 1",
+		"```\n# EXERCISE METADATA\nexercise_id: ex3\n```",
+		"%%solution\n\"\"\" # BEGIN PROMPT\n# Fixed prompt.\n\"\"\" # END PROMPT\n# BEGIN SOLUTION\nz = 3\n# END SOLUTION",
+		"```\n# EXERCISE METADATA\nexercise_id: ex4\n```",
+		"%%solution\nw = 4",
+	}, make([][]interface{}, 8))
+	newMaster.Cells[1].Type = "markdown"
+	got, report, err := newMaster.UpgradeStudent(old, AnyLanguage, nil)
+	if err != nil {
+		t.Fatalf("UpgradeStudent() returned error %s", err)
+	}
+	// ex3 is not edited by the student, so it gets the fixed prompt.
+	want := []string{"Fixed the typo.", "x = 10", "# Fixed prompt.", "..."}
+	if !reflect.DeepEqual(sources(got), want) {
+		t.Errorf("UpgradeStudent() = %q, want %q", sources(got), want)
+	}
+	wantReport := &UpgradeReport{
+		Carried:   []string{"ex1"},
+		Unchanged: []string{"ex3"},
+		Unmatched: []string{"ex2"},
+		Missing:   []string{"ex4"},
+	}
+	if !reflect.DeepEqual(report, wantReport) {
+		t.Errorf("UpgradeStudent() report = %+v, want %+v", report, wantReport)
+	}
+	if got.Cells[1].Metadata["exercise_id"] != "ex1" {
+		t.Errorf("upgraded cell metadata = %v, want exercise_id ex1", got.Cells[1].Metadata)
+	}
+}
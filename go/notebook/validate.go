@@ -0,0 +1,624 @@
+package notebook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidationError describes one violation of the nbformat v4 schema
+// found by Validate.
+type ValidationError struct {
+	// Cell is the index of the cell where the violation was found,
+	// or -1 if the violation is outside of cells.
+	Cell int
+	// Path is the JSON pointer (RFC 6901) to the offending value,
+	// e.g. "/cells/3/outputs/0/name".
+	Path string
+	// Offset is the byte offset of the offending value in the input.
+	// If a required field is missing, it points to the enclosing object.
+	Offset int64
+	// Message is a human-readable description of the problem.
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Cell >= 0 {
+		return fmt.Sprintf("cell %d: %s (at %s, byte %d)", e.Cell, e.Message, e.Path, e.Offset)
+	}
+	return fmt.Sprintf("%s (at %s, byte %d)", e.Message, e.Path, e.Offset)
+}
+
+// ValidationErrors is a list of validation errors that is itself an error.
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	var parts []string
+	for _, err := range errs {
+		parts = append(parts, err.Error())
+	}
+	return strings.Join(parts, "\n")
+}
+
+// jsonNode is a parsed JSON value that remembers its byte offset in the input.
+type jsonNode struct {
+	// Offset is the byte offset of the first character of the value.
+	Offset int64
+	// Value is the scalar value: string, json.Number, bool or nil.
+	// For objects and arrays it is nil.
+	Value interface{}
+	// IsObject is true for JSON objects.
+	IsObject bool
+	// Keys lists the object keys in the input order.
+	Keys []string
+	// Fields are the object fields keyed by name.
+	Fields map[string]*jsonNode
+	// IsArray is true for JSON arrays.
+	IsArray bool
+	// Elems are the array elements.
+	Elems []*jsonNode
+}
+
+// parseJSONNode parses the JSON input into a tree of nodes with byte offsets.
+func parseJSONNode(b []byte) (*jsonNode, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	node, err := decodeNode(dec, b)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the top-level value at byte %d", dec.InputOffset())
+	}
+	return node, nil
+}
+
+// valueStart skips whitespace and separators starting from the decoder
+// position and returns the offset of the next value.
+func valueStart(b []byte, offset int64) int64 {
+	for offset < int64(len(b)) {
+		switch b[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+func decodeNode(dec *json.Decoder, b []byte) (*jsonNode, error) {
+	offset := valueStart(b, dec.InputOffset())
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	node := &jsonNode{Offset: offset}
+	switch tok {
+	case json.Delim('{'):
+		node.IsObject = true
+		node.Fields = make(map[string]*jsonNode)
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := tok.(string)
+			if !ok {
+				return nil, fmt.Errorf("object key is not a string at byte %d", dec.InputOffset())
+			}
+			value, err := decodeNode(dec, b)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := node.Fields[key]; !ok {
+				node.Keys = append(node.Keys, key)
+			}
+			node.Fields[key] = value
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	case json.Delim('['):
+		node.IsArray = true
+		for dec.More() {
+			elem, err := decodeNode(dec, b)
+			if err != nil {
+				return nil, err
+			}
+			node.Elems = append(node.Elems, elem)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	default:
+		node.Value = tok
+	}
+	return node, nil
+}
+
+// typeName returns the JSON type name of the node for error messages.
+func (node *jsonNode) typeName() string {
+	switch {
+	case node.IsObject:
+		return "an object"
+	case node.IsArray:
+		return "a list"
+	}
+	switch node.Value.(type) {
+	case string:
+		return "a string"
+	case json.Number:
+		return "a number"
+	case bool:
+		return "a boolean"
+	}
+	return "null"
+}
+
+func (node *jsonNode) isString() bool {
+	_, ok := node.Value.(string)
+	return ok
+}
+
+func (node *jsonNode) isNull() bool {
+	return !node.IsObject && !node.IsArray && node.Value == nil
+}
+
+// intValue returns the integer value of the node and true,
+// or false if the node is not an integer.
+func (node *jsonNode) intValue() (int64, bool) {
+	num, ok := node.Value.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(string(num), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// validator accumulates the schema violations.
+type validator struct {
+	errs  ValidationErrors
+	minor int64
+}
+
+func (v *validator) errorf(cell int, path string, node *jsonNode, format string, args ...interface{}) {
+	v.errs = append(v.errs, &ValidationError{
+		Cell:    cell,
+		Path:    path,
+		Offset:  node.Offset,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// escapePointer escapes a key for use in a JSON pointer.
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// checkObject checks that node is an object, has all required fields and,
+// if allowed is not nil, does not have any fields besides allowed ones.
+// It returns false if node is not an object.
+func (v *validator) checkObject(cell int, path string, node *jsonNode, what string, required []string, allowed map[string]bool) bool {
+	if !node.IsObject {
+		v.errorf(cell, path, node, "%s must be an object, but is %s", what, node.typeName())
+		return false
+	}
+	for _, key := range required {
+		if _, ok := node.Fields[key]; !ok {
+			v.errorf(cell, path, node, "%s is missing the required field %q", what, key)
+		}
+	}
+	if allowed != nil {
+		for _, key := range node.Keys {
+			if !allowed[key] {
+				v.errorf(cell, path+"/"+escapePointer(key), node.Fields[key],
+					"%s has an unexpected field %q", what, key)
+			}
+		}
+	}
+	return true
+}
+
+func (v *validator) checkString(cell int, path string, node *jsonNode, what string) {
+	if !node.isString() {
+		v.errorf(cell, path, node, "%s must be a string, but is %s", what, node.typeName())
+	}
+}
+
+// checkMultiline checks the nbformat multiline_string type,
+// which is either a string or a list of strings.
+func (v *validator) checkMultiline(cell int, path string, node *jsonNode, what string) {
+	if node.isString() {
+		return
+	}
+	if !node.IsArray {
+		v.errorf(cell, path, node, "%s must be a string or a list of strings, but is %s", what, node.typeName())
+		return
+	}
+	for i, elem := range node.Elems {
+		if !elem.isString() {
+			v.errorf(cell, fmt.Sprintf("%s/%d", path, i), elem,
+				"line %d of %s must be a string, but is %s", i, what, elem.typeName())
+		}
+	}
+}
+
+func (v *validator) checkStringList(cell int, path string, node *jsonNode, what string) {
+	if !node.IsArray {
+		v.errorf(cell, path, node, "%s must be a list of strings, but is %s", what, node.typeName())
+		return
+	}
+	for i, elem := range node.Elems {
+		if !elem.isString() {
+			v.errorf(cell, fmt.Sprintf("%s/%d", path, i), elem,
+				"element %d of %s must be a string, but is %s", i, what, elem.typeName())
+		}
+	}
+}
+
+// checkExecutionCount checks that the node is null or a non-negative integer.
+func (v *validator) checkExecutionCount(cell int, path string, node *jsonNode) {
+	if node.isNull() {
+		return
+	}
+	if n, ok := node.intValue(); !ok || n < 0 {
+		v.errorf(cell, path, node, "execution_count must be null or a non-negative integer")
+	}
+}
+
+func (v *validator) checkMIMEBundle(cell int, path string, node *jsonNode, what string) {
+	if !v.checkObject(cell, path, node, what, nil, nil) {
+		return
+	}
+	for _, mime := range node.Keys {
+		value := node.Fields[mime]
+		if isJSONMIME(mime) {
+			continue
+		}
+		v.checkMultiline(cell, path+"/"+escapePointer(mime), value, fmt.Sprintf("%s data", mime))
+	}
+}
+
+var (
+	cellIDRegex = regexp.MustCompile(`^[a-zA-Z0-9-_]{1,64}$`)
+
+	codeCellFields = map[string]bool{
+		"id": true, "cell_type": true, "metadata": true, "source": true,
+		"outputs": true, "execution_count": true,
+	}
+	textCellFields = map[string]bool{
+		"id": true, "cell_type": true, "metadata": true, "source": true,
+		"attachments": true,
+	}
+	outputFields = map[string]map[string]bool{
+		StreamOutput: {"output_type": true, "name": true, "text": true},
+		DisplayDataOutput: {"output_type": true, "data": true, "metadata": true,
+			"transient": true},
+		ExecuteResultOutput: {"output_type": true, "data": true, "metadata": true,
+			"execution_count": true},
+		ErrorOutput: {"output_type": true, "ename": true, "evalue": true,
+			"traceback": true},
+	}
+	outputRequired = map[string][]string{
+		StreamOutput:        {"output_type", "name", "text"},
+		DisplayDataOutput:   {"output_type", "data", "metadata"},
+		ExecuteResultOutput: {"output_type", "data", "metadata", "execution_count"},
+		ErrorOutput:         {"output_type", "ename", "evalue", "traceback"},
+	}
+)
+
+func (v *validator) checkOutput(cell int, path string, node *jsonNode) {
+	if !v.checkObject(cell, path, node, "output", []string{"output_type"}, nil) {
+		return
+	}
+	typeNode, ok := node.Fields["output_type"]
+	if !ok {
+		return
+	}
+	outputType, _ := typeNode.Value.(string)
+	allowed, ok := outputFields[outputType]
+	if !ok {
+		v.errorf(cell, path+"/output_type", typeNode, "unknown output_type %s", typeNode.describe())
+		return
+	}
+	what := outputType + " output"
+	v.checkObject(cell, path, node, what, outputRequired[outputType], allowed)
+	for _, key := range node.Keys {
+		value := node.Fields[key]
+		keyPath := path + "/" + escapePointer(key)
+		switch key {
+		case "name", "ename", "evalue":
+			v.checkString(cell, keyPath, value, key)
+		case "text":
+			v.checkMultiline(cell, keyPath, value, "text")
+		case "traceback":
+			v.checkStringList(cell, keyPath, value, "traceback")
+		case "data":
+			v.checkMIMEBundle(cell, keyPath, value, "output data")
+		case "metadata", "transient":
+			v.checkObject(cell, keyPath, value, "output "+key, nil, nil)
+		case "execution_count":
+			v.checkExecutionCount(cell, keyPath, value)
+		}
+	}
+}
+
+// describe returns a short description of the value for error messages.
+func (node *jsonNode) describe() string {
+	if s, ok := node.Value.(string); ok {
+		return strconv.Quote(s)
+	}
+	return node.typeName()
+}
+
+func (v *validator) checkCellMetadata(cell int, path string, node *jsonNode) {
+	if !v.checkObject(cell, path, node, "cell metadata", nil, nil) {
+		return
+	}
+	for _, key := range node.Keys {
+		value := node.Fields[key]
+		keyPath := path + "/" + escapePointer(key)
+		switch key {
+		case "tags":
+			v.checkStringList(cell, keyPath, value, "metadata.tags")
+		case "name", "format":
+			v.checkString(cell, keyPath, value, "metadata."+key)
+		case "collapsed":
+			if _, ok := value.Value.(bool); !ok {
+				v.errorf(cell, keyPath, value, "metadata.collapsed must be a boolean, but is %s", value.typeName())
+			}
+		case "jupyter", "execution":
+			v.checkObject(cell, keyPath, value, "metadata."+key, nil, nil)
+		}
+	}
+}
+
+func (v *validator) checkCell(cell int, path string, node *jsonNode) {
+	if !v.checkObject(cell, path, node, "cell", []string{"cell_type"}, nil) {
+		return
+	}
+	typeNode, ok := node.Fields["cell_type"]
+	if !ok {
+		return
+	}
+	cellType, _ := typeNode.Value.(string)
+	var required []string
+	var allowed map[string]bool
+	switch cellType {
+	case "code":
+		required = []string{"cell_type", "metadata", "source", "outputs", "execution_count"}
+		allowed = codeCellFields
+	case "markdown", "raw":
+		required = []string{"cell_type", "metadata", "source"}
+		allowed = textCellFields
+	default:
+		v.errorf(cell, path+"/cell_type", typeNode,
+			"cell_type must be \"code\", \"markdown\" or \"raw\", but is %s", typeNode.describe())
+		return
+	}
+	if v.minor >= 5 {
+		required = append(required, "id")
+	}
+	v.checkObject(cell, path, node, cellType+" cell", required, allowed)
+	for _, key := range node.Keys {
+		value := node.Fields[key]
+		keyPath := path + "/" + escapePointer(key)
+		switch key {
+		case "id":
+			if v.minor < 5 {
+				v.errorf(cell, keyPath, value, "cell id is only allowed since nbformat 4.5")
+				continue
+			}
+			if s, ok := value.Value.(string); !ok || !cellIDRegex.MatchString(s) {
+				v.errorf(cell, keyPath, value,
+					"cell id must be a string of 1-64 letters, digits, '-' or '_', but is %s", value.describe())
+			}
+		case "metadata":
+			v.checkCellMetadata(cell, keyPath, value)
+		case "source":
+			v.checkMultiline(cell, keyPath, value, "source")
+		case "execution_count":
+			v.checkExecutionCount(cell, keyPath, value)
+		case "outputs":
+			if !value.IsArray {
+				v.errorf(cell, keyPath, value, "outputs must be a list, but is %s", value.typeName())
+				continue
+			}
+			for i, output := range value.Elems {
+				v.checkOutput(cell, fmt.Sprintf("%s/%d", keyPath, i), output)
+			}
+		case "attachments":
+			if !v.checkObject(cell, keyPath, value, "attachments", nil, nil) {
+				continue
+			}
+			for _, name := range value.Keys {
+				v.checkMIMEBundle(cell, keyPath+"/"+escapePointer(name), value.Fields[name],
+					fmt.Sprintf("attachment %q", name))
+			}
+		}
+	}
+}
+
+func (v *validator) checkNotebookMetadata(path string, node *jsonNode) {
+	if !v.checkObject(-1, path, node, "notebook metadata", nil, nil) {
+		return
+	}
+	if ks, ok := node.Fields["kernelspec"]; ok {
+		if v.checkObject(-1, path+"/kernelspec", ks, "metadata.kernelspec", []string{"name", "display_name"}, nil) {
+			for _, key := range []string{"name", "display_name"} {
+				if value, ok := ks.Fields[key]; ok {
+					v.checkString(-1, path+"/kernelspec/"+key, value, "metadata.kernelspec."+key)
+				}
+			}
+		}
+	}
+	if li, ok := node.Fields["language_info"]; ok {
+		if v.checkObject(-1, path+"/language_info", li, "metadata.language_info", []string{"name"}, nil) {
+			if value, ok := li.Fields["name"]; ok {
+				v.checkString(-1, path+"/language_info/name", value, "metadata.language_info.name")
+			}
+		}
+	}
+}
+
+// Validate checks a notebook in JSON encoding against the nbformat v4 schema.
+// Notebooks in nbformat v3 are only checked for the structure that is
+// required for UpgradeV3 to succeed.
+// It returns all violations found, sorted by their position in the input,
+// or nil if the notebook is valid. A notebook that is not well-formed JSON
+// produces a single error pointing at the syntax error.
+func Validate(b []byte) ValidationErrors {
+	root, err := parseJSONNode(b)
+	if err != nil {
+		offset := int64(0)
+		if serr, ok := err.(*json.SyntaxError); ok && serr.Offset > 0 {
+			// SyntaxError.Offset points after the offending character.
+			offset = serr.Offset - 1
+		}
+		return ValidationErrors{&ValidationError{
+			Cell:    -1,
+			Path:    "",
+			Offset:  offset,
+			Message: fmt.Sprintf("not a valid JSON: %s", err),
+		}}
+	}
+	v := &validator{}
+	if root.IsObject && root.Fields["nbformat"] != nil {
+		if major, ok := root.Fields["nbformat"].intValue(); ok && major == 3 {
+			v.checkV3(root)
+			return v.sorted()
+		}
+	}
+	if !v.checkObject(-1, "", root, "notebook", []string{"nbformat", "nbformat_minor", "metadata", "cells"},
+		notebookFields) {
+		return v.errs
+	}
+	if node, ok := root.Fields["nbformat"]; ok {
+		if major, ok := node.intValue(); !ok || major != 4 {
+			v.errorf(-1, "/nbformat", node, "nbformat must be 4, but is %s", node.describe())
+		}
+	}
+	if node, ok := root.Fields["nbformat_minor"]; ok {
+		minor, ok := node.intValue()
+		if !ok || minor < 0 {
+			v.errorf(-1, "/nbformat_minor", node, "nbformat_minor must be a non-negative integer")
+		}
+		v.minor = minor
+	}
+	if node, ok := root.Fields["metadata"]; ok {
+		v.checkNotebookMetadata("/metadata", node)
+	}
+	if node, ok := root.Fields["cells"]; ok {
+		if !node.IsArray {
+			v.errorf(-1, "/cells", node, "cells must be a list, but is %s", node.typeName())
+		} else {
+			for i, cell := range node.Elems {
+				v.checkCell(i, fmt.Sprintf("/cells/%d", i), cell)
+			}
+		}
+	}
+	return v.sorted()
+}
+
+// sorted returns the accumulated errors sorted by the input position.
+func (v *validator) sorted() ValidationErrors {
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		return v.errs[i].Offset < v.errs[j].Offset
+	})
+	return v.errs
+}
+
+// checkV3 checks the structure of an nbformat v3 notebook to the extent
+// that is needed for UpgradeV3 to succeed. Cell indices are counted
+// across all worksheets, matching the cell indices after the upgrade.
+func (v *validator) checkV3(root *jsonNode) {
+	if !v.checkObject(-1, "", root, "notebook", []string{"metadata", "worksheets"}, nil) {
+		return
+	}
+	if node, ok := root.Fields["metadata"]; ok {
+		v.checkObject(-1, "/metadata", node, "notebook metadata", nil, nil)
+	}
+	node, ok := root.Fields["worksheets"]
+	if !ok {
+		return
+	}
+	if !node.IsArray {
+		v.errorf(-1, "/worksheets", node, "worksheets must be a list, but is %s", node.typeName())
+		return
+	}
+	index := 0
+	for i, ws := range node.Elems {
+		wsPath := fmt.Sprintf("/worksheets/%d", i)
+		if !v.checkObject(-1, wsPath, ws, "worksheet", []string{"cells"}, nil) {
+			continue
+		}
+		cells, ok := ws.Fields["cells"]
+		if !ok {
+			continue
+		}
+		if !cells.IsArray {
+			v.errorf(-1, wsPath+"/cells", cells, "cells must be a list, but is %s", cells.typeName())
+			continue
+		}
+		for j, cell := range cells.Elems {
+			v.checkCellV3(index, fmt.Sprintf("%s/cells/%d", wsPath, j), cell)
+			index++
+		}
+	}
+}
+
+func (v *validator) checkCellV3(cell int, path string, node *jsonNode) {
+	if !v.checkObject(cell, path, node, "cell", []string{"cell_type"}, nil) {
+		return
+	}
+	typeNode, ok := node.Fields["cell_type"]
+	if !ok {
+		return
+	}
+	cellType, _ := typeNode.Value.(string)
+	switch cellType {
+	case "code":
+		v.checkObject(cell, path, node, "code cell", []string{"input", "outputs"}, nil)
+		if input, ok := node.Fields["input"]; ok {
+			v.checkMultiline(cell, path+"/input", input, "input")
+		}
+		if outputs, ok := node.Fields["outputs"]; ok {
+			if !outputs.IsArray {
+				v.errorf(cell, path+"/outputs", outputs, "outputs must be a list, but is %s", outputs.typeName())
+				return
+			}
+			for i, output := range outputs.Elems {
+				outputPath := fmt.Sprintf("%s/outputs/%d", path, i)
+				if !v.checkObject(cell, outputPath, output, "output", []string{"output_type"}, nil) {
+					continue
+				}
+				t := output.Fields["output_type"]
+				if t == nil {
+					continue
+				}
+				switch t.Value {
+				case "pyout", "display_data", "stream", "pyerr":
+				default:
+					v.errorf(cell, outputPath+"/output_type", t, "unknown output_type %s", t.describe())
+				}
+			}
+		}
+	case "markdown", "raw", "heading":
+		v.checkObject(cell, path, node, cellType+" cell", []string{"source"}, nil)
+		if source, ok := node.Fields["source"]; ok {
+			v.checkMultiline(cell, path+"/source", source, "source")
+		}
+	default:
+		v.errorf(cell, path+"/cell_type", typeNode,
+			"cell_type must be \"code\", \"markdown\", \"heading\" or \"raw\", but is %s", typeNode.describe())
+	}
+}
@@ -0,0 +1,100 @@
+package notebook
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	type wantError struct {
+		cell int
+		path string
+		// at is a substring of the input that the error offset should point at.
+		at string
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  []wantError
+	}{
+		{
+			name: "Valid",
+			input: `{"nbformat": 4, "nbformat_minor": 2, "metadata": {}, "cells": [
+ {"cell_type": "markdown", "metadata": {}, "source": ["# Title"]},
+ {"cell_type": "code", "execution_count": 1, "metadata": {"tags": ["a"]}, "source": "x",
+  "outputs": [{"output_type": "stream", "name": "stdout", "text": ["1\n"]}]}]}`,
+		},
+		{
+			name:  "NotJSON",
+			input: `{"nbformat": 4,,}`,
+			want:  []wantError{{-1, "", ","}},
+		},
+		{
+			name:  "MissingCells",
+			input: `{"nbformat": 4, "nbformat_minor": 2, "metadata": {}}`,
+			want:  []wantError{{-1, "", `{"nbformat"`}},
+		},
+		{
+			name:  "WrongMajor",
+			input: `{"nbformat": 5, "nbformat_minor": 0, "metadata": {}, "cells": []}`,
+			want:  []wantError{{-1, "/nbformat", "5,"}},
+		},
+		{
+			name:  "V3MissingWorksheets",
+			input: `{"nbformat": 3, "nbformat_minor": 0, "metadata": {}, "cells": []}`,
+			want:  []wantError{{-1, "", `{"nbformat"`}},
+		},
+		{
+			name: "BadSource",
+			input: `{"nbformat": 4, "nbformat_minor": 2, "metadata": {}, "cells": [
+ {"cell_type": "markdown", "metadata": {}, "source": ["ok"]},
+ {"cell_type": "markdown", "metadata": {}, "source": ["ok", 42]}]}`,
+			want: []wantError{{1, "/cells/1/source/1", "42]"}},
+		},
+		{
+			name: "BadOutput",
+			input: `{"nbformat": 4, "nbformat_minor": 2, "metadata": {}, "cells": [
+ {"cell_type": "code", "execution_count": null, "metadata": {}, "source": "",
+  "outputs": [{"output_type": "stream", "text": "x"}]}]}`,
+			want: []wantError{{0, "/cells/0/outputs/0", `{"output_type": "stream"`}},
+		},
+		{
+			name: "UnknownCellType",
+			input: `{"nbformat": 4, "nbformat_minor": 2, "metadata": {}, "cells": [
+ {"cell_type": "heading", "metadata": {}, "source": ""}]}`,
+			want: []wantError{{0, "/cells/0/cell_type", `"heading"`}},
+		},
+		{
+			name: "UnexpectedField",
+			input: `{"nbformat": 4, "nbformat_minor": 2, "metadata": {}, "cells": [
+ {"cell_type": "markdown", "metadata": {}, "source": "", "outputs": []}]}`,
+			want: []wantError{{0, "/cells/0/outputs", "[]}"}},
+		},
+		{
+			name: "MissingID",
+			input: `{"nbformat": 4, "nbformat_minor": 5, "metadata": {}, "cells": [
+ {"id": "a-1", "cell_type": "markdown", "metadata": {}, "source": ""},
+ {"cell_type": "markdown", "metadata": {}, "source": ""}]}`,
+			want: []wantError{{1, "/cells/1", `{"cell_type": "markdown", "metadata": {}, "source": ""}]}`}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := Validate([]byte(tt.input))
+			if len(errs) != len(tt.want) {
+				t.Fatalf("Validate() returned %d errors, want %d:\n%s", len(errs), len(tt.want), errs)
+			}
+			for i, err := range errs {
+				want := tt.want[i]
+				if err.Cell != want.cell || err.Path != want.path {
+					t.Errorf("got error at cell %d path %q, want cell %d path %q: %s",
+						err.Cell, err.Path, want.cell, want.path, err)
+				}
+				if !strings.HasPrefix(tt.input[err.Offset:], want.at) {
+					t.Errorf("error offset %d points at %q, want %q: %s",
+						err.Offset, tt.input[err.Offset:], want.at, err)
+				}
+			}
+		})
+	}
+}
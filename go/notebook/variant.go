@@ -0,0 +1,242 @@
+package notebook
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Exercises can have per-student variants to discourage sharing of answers.
+// The parameters of the variant are declared in exercise metadata either as
+// a list of values or as a range of numbers:
+//
+//	parameters:
+//	  size: [3, 5, 7]
+//	  threshold: {min: 1, max: 10}
+//	  rate: {min: 0.1, max: 0.5, step: 0.1}
+//	  dataset: [weather-tokyo.csv, weather-osaka.csv]
+//	  'N': [10, 100]
+//
+// Note that YAML reads names such as N, y or no as booleans unless quoted.
+// The lines of code marked with # PARAMETER get the value of the variant:
+//
+//	size = 3 # PARAMETER   ===>   size = 7
+//
+// and {{size}} in markdown cells is replaced with the value. The variant is
+// chosen by the seed, e.g. the user hash, so that the same seed always gives
+// the same values. The empty seed gives the first value of each parameter.
+
+// ParametersKey is the exercise metadata key with the parameter declarations.
+const ParametersKey = "parameters"
+
+// ParametersFilename is the name of the file with the parameter declarations
+// in the autograder directory of an exercise.
+const ParametersFilename = "parameters.json"
+
+// VariantSeedKey is the notebook metadata key under which ToStudent records
+// the seed of the variant, so that the autograder can regenerate it.
+const VariantSeedKey = "variant_seed"
+
+// maxParameterValues limits the number of values in a parameter range.
+const maxParameterValues = 100000
+
+var (
+	parameterNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	parameterLineRegex = regexp.MustCompile(`^([ \t]*)([a-zA-Z_][a-zA-Z0-9_]*)([ \t]*=[ \t]*).*?[ \t]*# PARAMETER[ \t]*$`)
+	placeholderRegex   = regexp.MustCompile(`{{([a-zA-Z_][a-zA-Z0-9_]*)}}`)
+)
+
+// number converts a numeric metadata value to float64.
+func number(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case int:
+		return float64(x), true
+	}
+	return 0, false
+}
+
+// parseParameters returns the parameter declarations from the exercise
+// metadata with the ranges expanded into lists of values, or nil if the
+// exercise has no parameters.
+func parseParameters(exerciseMetadata map[string]interface{}) (map[string][]interface{}, error) {
+	v, ok := exerciseMetadata[ParametersKey]
+	if !ok {
+		return nil, nil
+	}
+	data, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not a map, but %s", ParametersKey, reflect.TypeOf(v))
+	}
+	ret := make(map[string][]interface{})
+	for name, v := range data {
+		if !parameterNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("parameter name %q is not a valid identifier", name)
+		}
+		switch x := v.(type) {
+		case []interface{}:
+			if len(x) == 0 {
+				return nil, fmt.Errorf("parameter %s has no values", name)
+			}
+			for _, value := range x {
+				switch value.(type) {
+				case string, float64, int, bool:
+				default:
+					return nil, fmt.Errorf("value of parameter %s is not a string, number or boolean, but %s", name, reflect.TypeOf(value))
+				}
+			}
+			ret[name] = x
+		case map[string]interface{}:
+			values, err := parameterRange(x)
+			if err != nil {
+				return nil, fmt.Errorf("parameter %s: %s", name, err)
+			}
+			ret[name] = values
+		default:
+			return nil, fmt.Errorf("parameter %s is neither a list nor a range, but %s", name, reflect.TypeOf(v))
+		}
+	}
+	return ret, nil
+}
+
+// parameterRange expands the range {min: a, max: b, step: c} into the list
+// of values. The step defaults to 1.
+func parameterRange(r map[string]interface{}) ([]interface{}, error) {
+	for k := range r {
+		if k != "min" && k != "max" && k != "step" {
+			return nil, fmt.Errorf("unknown range field %q, want min, max and step", k)
+		}
+	}
+	min, ok := number(r["min"])
+	if !ok {
+		return nil, fmt.Errorf("range min is not a number, but %s", reflect.TypeOf(r["min"]))
+	}
+	max, ok := number(r["max"])
+	if !ok {
+		return nil, fmt.Errorf("range max is not a number, but %s", reflect.TypeOf(r["max"]))
+	}
+	step := 1.0
+	if v, ok := r["step"]; ok {
+		if step, ok = number(v); !ok || step <= 0 {
+			return nil, fmt.Errorf("range step is not a positive number: %v", v)
+		}
+	}
+	if max < min {
+		return nil, fmt.Errorf("range max %v is less than min %v", max, min)
+	}
+	// Allow for the rounding errors in the step.
+	count := int(math.Floor((max-min)/step+1e-9)) + 1
+	if count > maxParameterValues {
+		return nil, fmt.Errorf("range has %d values, more than %d", count, maxParameterValues)
+	}
+	var values []interface{}
+	for i := 0; i < count; i++ {
+		// Round off the accumulated errors, e.g. 0.1+0.2.
+		values = append(values, math.Round((min+float64(i)*step)*1e9)/1e9)
+	}
+	return values, nil
+}
+
+// VariantValues chooses the values of the parameters of the exercise for the
+// given seed. The choice only depends on the seed, the exercise ID and the
+// parameter name, and the empty seed chooses the first value of each parameter.
+func VariantValues(parameters map[string][]interface{}, seed, exerciseID string) map[string]interface{} {
+	if parameters == nil {
+		return nil
+	}
+	ret := make(map[string]interface{})
+	for name, values := range parameters {
+		if seed == "" {
+			ret[name] = values[0]
+			continue
+		}
+		h := sha256.Sum256([]byte(seed + "\x00" + exerciseID + "\x00" + name))
+		ret[name] = values[binary.BigEndian.Uint64(h[:8])%uint64(len(values))]
+	}
+	return ret
+}
+
+// formatValue formats the parameter value for markdown text.
+func formatValue(v interface{}) string {
+	if x, ok := number(v); ok {
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// pythonLiteral formats the parameter value as a Python literal.
+func pythonLiteral(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return strconv.Quote(x)
+	case bool:
+		if x {
+			return "True"
+		}
+		return "False"
+	}
+	return formatValue(v)
+}
+
+// applyParameters replaces the # PARAMETER lines of the code with the values.
+// If strict is true, a parameter that has no value is an error, otherwise the
+// line is left unchanged.
+func applyParameters(source string, values map[string]interface{}, strict bool) (string, error) {
+	if !strings.Contains(source, "# PARAMETER") {
+		return source, nil
+	}
+	lines := strings.Split(source, "\n")
+	var missing []string
+	for i, line := range lines {
+		m := parameterLineRegex.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		value, ok := values[m[2]]
+		if !ok {
+			missing = append(missing, m[2])
+			continue
+		}
+		lines[i] = m[1] + m[2] + m[3] + pythonLiteral(value)
+	}
+	if strict && len(missing) > 0 {
+		sort.Strings(missing)
+		return "", fmt.Errorf("# PARAMETER %s not declared in exercise metadata", strings.Join(missing, ", "))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// ApplyParameters replaces the lines of code marked with # PARAMETER with
+// the values of the variant. The lines of parameters without a value are
+// left unchanged.
+func ApplyParameters(source string, values map[string]interface{}) string {
+	source, _ = applyParameters(source, values, false)
+	return source
+}
+
+// renderVariant renders the cell source for the variant: the # PARAMETER
+// lines of code cells and {{name}} placeholders of markdown cells.
+func renderVariant(cellType, source string, values map[string]interface{}) (string, error) {
+	switch cellType {
+	case "code":
+		return applyParameters(source, values, true)
+	case "markdown":
+		if values == nil {
+			return source, nil
+		}
+		return placeholderRegex.ReplaceAllStringFunc(source, func(s string) string {
+			if v, ok := values[s[2:len(s)-2]]; ok {
+				return formatValue(v)
+			}
+			return s
+		}), nil
+	}
+	return source, nil
+}
@@ -0,0 +1,168 @@
+package notebook
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseParameters(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want map[string][]interface{}
+	}{
+		{"List", "size: [3, 5, 7]", map[string][]interface{}{"size": {3.0, 5.0, 7.0}}},
+		{"QuotedName", "'N': [3, 5]", map[string][]interface{}{"N": {3.0, 5.0}}},
+		{"Strings", "data: [a.csv, b.csv]", map[string][]interface{}{"data": {"a.csv", "b.csv"}}},
+		{"Range", "size: {min: 1, max: 4}", map[string][]interface{}{"size": {1.0, 2.0, 3.0, 4.0}}},
+		{"Step", "rate: {min: 0.1, max: 0.4, step: 0.1}", map[string][]interface{}{"rate": {0.1, 0.2, 0.3, 0.4}}},
+	}
+	for _, tt := range tests {
+		metadata, _, err := extractMetadata(exerciseMetadataRegex,
+			"```\n# EXERCISE METADATA\nparameters:\n  "+tt.yaml+"\n```")
+		if err != nil {
+			t.Errorf("%s: error parsing metadata: %s", tt.name, err)
+			continue
+		}
+		got, err := parseParameters(metadata)
+		if err != nil {
+			t.Errorf("%s: parseParameters(%q) returned error %s", tt.name, tt.yaml, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseParameters(%q) = %v, want %v", tt.name, tt.yaml, got, tt.want)
+		}
+	}
+	errors := []map[string]interface{}{
+		{"parameters": []interface{}{1.0}},
+		{"parameters": map[string]interface{}{"N": []interface{}{}}},
+		{"parameters": map[string]interface{}{"N": 5.0}},
+		{"parameters": map[string]interface{}{"not-a-name": []interface{}{1.0}}},
+		{"parameters": map[string]interface{}{"N": map[string]interface{}{"min": 5.0, "max": 1.0}}},
+		{"parameters": map[string]interface{}{"N": map[string]interface{}{"min": 0.0, "max": 1.0, "step": 0.0}}},
+		{"parameters": map[string]interface{}{"N": map[string]interface{}{"min": 0.0, "max": 1e9}}},
+		{"parameters": map[string]interface{}{"N": map[string]interface{}{"from": 0.0, "max": 1.0}}},
+	}
+	for _, metadata := range errors {
+		if got, err := parseParameters(metadata); err == nil {
+			t.Errorf("parseParameters(%v) = %v, want error", metadata, got)
+		}
+	}
+}
+
+func TestVariantValues(t *testing.T) {
+	parameters := map[string][]interface{}{
+		"N":    {1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0},
+		"data": {"a.csv", "b.csv", "c.csv", "d.csv"},
+	}
+	want := map[string]interface{}{"N": 1.0, "data": "a.csv"}
+	if got := VariantValues(parameters, "", "ex1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("VariantValues(seed \"\") = %v, want %v", got, want)
+	}
+	a := VariantValues(parameters, "user1", "ex1")
+	if b := VariantValues(parameters, "user1", "ex1"); !reflect.DeepEqual(a, b) {
+		t.Errorf("VariantValues() is not deterministic: %v != %v", a, b)
+	}
+	distinct := false
+	for _, seed := range []string{"user2", "user3", "user4", "user5"} {
+		if !reflect.DeepEqual(a, VariantValues(parameters, seed, "ex1")) {
+			distinct = true
+		}
+	}
+	if !distinct {
+		t.Errorf("VariantValues() gives the same variant %v for all seeds", a)
+	}
+	if got := VariantValues(nil, "user1", "ex1"); got != nil {
+		t.Errorf("VariantValues(nil) = %v, want nil", got)
+	}
+}
+
+func TestApplyParameters(t *testing.T) {
+	values := map[string]interface{}{"N": 7.0, "rate": 0.5, "data": "b.csv", "flag": true}
+	source := "N = 3 # PARAMETER\n  rate=0.1  # PARAMETER\ndata = 'a.csv' # PARAMETER\nflag = False # PARAMETER\nM = 1 # PARAMETER\nprint(N)"
+	want := "N = 7\n  rate=0.5\ndata = \"b.csv\"\nflag = True\nM = 1 # PARAMETER\nprint(N)"
+	if got := ApplyParameters(source, values); got != want {
+		t.Errorf("ApplyParameters(%q) = %q, want %q", source, got, want)
+	}
+	if got, err := applyParameters(source, values, true); err == nil || !strings.Contains(err.Error(), "M") {
+		t.Errorf("applyParameters(strict) = %q, %v, want error about M", got, err)
+	}
+}
+
+func TestVariant(t *testing.T) {
+	n := taggedNotebook([]string{
+		"```\n# ASSIGNMENT METADATA\nassignment_id: a1\n```",
+		"Sum the first {{N}} numbers.\n```\n# EXERCISE METADATA\nexercise_id: ex1\nparameters:\n  'N': {min: 10, max: 99}\n```",
+		"%%solution\nN = 10 # PARAMETER\n# BEGIN SOLUTION\nresult = sum(range(N))\n# END SOLUTION",
+		"%%inlinetest Test1\nN = 10 # PARAMETER\nassert result == sum(range(N))",
+	}, make([][]interface{}, 4))
+	values := VariantValues(map[string][]interface{}{"N": mustParameterRange(t, 10, 99)}, "user1", "ex1")
+	N := formatValue(values["N"])
+	student, err := n.ToStudent(AnyLanguage, &StudentOptions{Seed: "user1"})
+	if err != nil {
+		t.Fatalf("ToStudent() returned error %s", err)
+	}
+	want := []string{"Sum the first " + N + " numbers.\n", "N = " + N + "\n..."}
+	if !reflect.DeepEqual(sources(student), want) {
+		t.Errorf("ToStudent(seed) = %q, want %q", sources(student), want)
+	}
+	if student.Metadata[VariantSeedKey] != "user1" {
+		t.Errorf("student metadata = %v, want %s user1", student.Metadata, VariantSeedKey)
+	}
+	if _, ok := n.Metadata[VariantSeedKey]; ok {
+		t.Errorf("ToStudent() modified the master notebook metadata")
+	}
+	student, err = n.ToStudent(AnyLanguage, nil)
+	if err != nil {
+		t.Fatalf("ToStudent() returned error %s", err)
+	}
+	want = []string{"Sum the first 10 numbers.\n", "N = 10\n..."}
+	if !reflect.DeepEqual(sources(student), want) {
+		t.Errorf("ToStudent() = %q, want %q", sources(student), want)
+	}
+
+	autograder, err := n.ToAutograder()
+	if err != nil {
+		t.Fatalf("ToAutograder() returned error %s", err)
+	}
+	found := false
+	for _, cell := range autograder.Cells {
+		switch cell.Metadata["filename"] {
+		case ParametersFilename:
+			found = true
+			var parameters map[string][]interface{}
+			if err := json.Unmarshal([]byte(cell.Source), &parameters); err != nil {
+				t.Fatalf("error parsing %s: %s", ParametersFilename, err)
+			}
+			if got := VariantValues(parameters, "user1", "ex1"); !reflect.DeepEqual(got, values) {
+				t.Errorf("variant from %s = %v, want %v", ParametersFilename, got, values)
+			}
+		case "Test1_inline.py":
+			if !strings.Contains(cell.Source, "# PARAMETER") {
+				t.Errorf("Test1_inline.py = %q, want # PARAMETER kept for the autograder", cell.Source)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("ToAutograder() did not produce %s", ParametersFilename)
+	}
+
+	// A parameter must be declared.
+	n.Cells[1].Source = "```\n# EXERCISE METADATA\nexercise_id: ex1\n```"
+	if _, err := n.ToStudent(AnyLanguage, nil); err == nil {
+		t.Errorf("ToStudent() with undeclared parameter returned success, want error")
+	}
+	if problems := n.Lint(); !problems.HasErrors() {
+		t.Errorf("Lint() with undeclared parameter = %v, want error", problems)
+	}
+}
+
+func mustParameterRange(t *testing.T, min, max float64) []interface{} {
+	values, err := parameterRange(map[string]interface{}{"min": min, "max": max})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
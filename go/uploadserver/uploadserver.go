@@ -26,6 +26,7 @@ import (
 	"cloud.google.com/go/storage"
 	"github.com/golang/glog"
 	"github.com/google/prog-edu-assistant/autograder"
+	"github.com/google/prog-edu-assistant/notebook"
 	"github.com/google/prog-edu-assistant/queue"
 	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
@@ -91,6 +92,13 @@ type Options struct {
 	// ProjectID is the GCP project ID that is used for Google
 	// Cloud Storage access if LogToBucket is true.
 	ProjectID string
+	// ValidateSubmissions enables checking the uploaded notebooks against
+	// the nbformat schema. Invalid notebooks are rejected with a list of problems.
+	ValidateSubmissions bool
+	// ScrubPolicy is applied to the uploaded notebooks before they are
+	// stored, logged or queued for grading. If nil, the uploads are kept
+	// verbatim.
+	ScrubPolicy *notebook.ScrubPolicy
 }
 
 // Server provides an implementation of a web server for handling student
@@ -827,6 +835,22 @@ func (s *Server) handleUpload(w http.ResponseWriter, req *http.Request) error {
 	if err != nil {
 		return fmt.Errorf("error reading upload: %s", err)
 	}
+	if s.opts.ValidateSubmissions {
+		if errs := notebook.Validate(b); len(errs) > 0 {
+			glog.V(1).Infof("Rejected invalid notebook upload: %s", errs)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			return invalidUploadTmpl.Execute(w, errs)
+		}
+	}
+	if s.opts.ScrubPolicy != nil {
+		size := len(b)
+		b, err = notebook.Scrub(b, s.opts.ScrubPolicy)
+		if err != nil {
+			return fmt.Errorf("error scrubbing upload: %s", err)
+		}
+		glog.V(3).Infof("Scrubbed upload from %d to %d bytes", size, len(b))
+	}
 	// If exercise_id is specified in the request, then we need to grade only that exercise.
 	requestedExerciseID := req.FormValue("exercise_id")
 	// TODO(salikh): Add user identifier to the file name.
@@ -945,6 +969,21 @@ var uploadResultTmpl = template.Must(template.New("uploadResultTmpl").Parse(`
 Click here for the <a href='{{.}}'>Report</a>.
 `))
 
+// invalidUploadTmpl renders the list of problems found in an invalid notebook.
+var invalidUploadTmpl = template.Must(template.New("invalidUploadTmpl").Parse(`
+<html>
+<title>Invalid notebook</title>
+<link rel='stylesheet' type='text/css' href='/static/style.css'/>
+<h2>The uploaded file is not a valid notebook</h2>
+Please fix the following problems, or download a fresh copy of the notebook
+and copy your solutions into it.
+<ul>
+{{range .}}
+<li>{{if ge .Cell 0}}Cell {{.Cell}}: {{end}}{{.Message}} <small>({{.Path}})</small></li>
+{{end}}
+</ul>
+`))
+
 func (s *Server) scheduleCheck(content []byte) error {
 	return s.opts.Channel.Post(s.opts.QueueName, content)
 }